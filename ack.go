@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// AckRequest acknowledges a pipeline, or snoozes it when Snooze is set.
+// An empty Pipeline means the most severe one.
+type AckRequest struct {
+	Pipeline string   `json:"pipeline,omitempty"`
+	By       string   `json:"by,omitempty"`
+	Note     string   `json:"note,omitempty"`
+	Snooze   Duration `json:"snooze,omitempty"`
+}
+
+// AckHandler lists acknowledged pipelines on GET, acknowledges or snoozes
+// one on POST and clears one named by ?pipeline= on DELETE
+func AckHandler(registry *StatusRegistry, history *History) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			acked := []PipelineStatus{}
+			for _, ps := range registry.All() {
+				if ps.Ack != nil {
+					acked = append(acked, ps)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(acked)
+
+		case http.MethodPost:
+			var req AckRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				log.Println("Error parsing ack request", err)
+				http.Error(w, "Error parsing request", http.StatusBadRequest)
+				return
+			}
+
+			ack := Acknowledgment{At: time.Now(), By: req.By, Note: req.Note}
+			kind := "acknowledged"
+			if req.Snooze > 0 {
+				until := ack.At.Add(time.Duration(req.Snooze))
+				ack.Until = &until
+				kind = "snoozed"
+			}
+
+			var ps PipelineStatus
+			var ok bool
+			if req.Pipeline == "" {
+				ps, ok = registry.AcknowledgeWorst(ack)
+			} else {
+				ps, ok = registry.Acknowledge(req.Pipeline, ack)
+			}
+			if !ok {
+				http.Error(w, "nothing to acknowledge", http.StatusConflict)
+				return
+			}
+			history.Record(kind, ps.Pipeline, ackDetail(ack))
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ps)
+
+		case http.MethodDelete:
+			pipeline := r.URL.Query().Get("pipeline")
+			if !registry.Unacknowledge(pipeline) {
+				http.Error(w, "pipeline is not acknowledged", http.StatusNotFound)
+				return
+			}
+			history.Record("unacknowledged", pipeline, "")
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func ackDetail(ack Acknowledgment) string {
+	var parts []string
+	if ack.By != "" {
+		parts = append(parts, "by "+ack.By)
+	}
+	if ack.Until != nil {
+		parts = append(parts, "until "+ack.Until.Format(time.RFC3339))
+	}
+	if ack.Note != "" {
+		parts = append(parts, ack.Note)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// runAck is the ack subcommand: gobot-ci ack [flags] [pipeline]
+func runAck(args []string) error {
+	fs := flag.NewFlagSet("ack", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:3000", "gobot-ci server to talk to")
+	by := fs.String("by", os.Getenv("USER"), "who is acknowledging")
+	note := fs.String("note", "", "note to record with the acknowledgment")
+	snooze := fs.Duration("snooze", 0, "snooze the pipeline for this long instead")
+	clear := fs.Bool("clear", false, "clear the acknowledgment instead")
+	fs.Parse(args)
+
+	pipeline := fs.Arg(0)
+	endpoint := strings.TrimSuffix(*server, "/") + "/acks"
+
+	var req *http.Request
+	var err error
+	if *clear {
+		if pipeline == "" {
+			return fmt.Errorf("-clear needs a pipeline")
+		}
+		req, err = http.NewRequest(http.MethodDelete, endpoint+"?pipeline="+url.QueryEscape(pipeline), nil)
+	} else {
+		body, _ := json.Marshal(AckRequest{
+			Pipeline: pipeline,
+			By:       *by,
+			Note:     *note,
+			Snooze:   Duration(*snooze),
+		})
+		req, err = http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+	os.Stdout.Write(out)
+	return nil
+}
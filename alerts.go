@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertSeverity is how alerts of one severity are shown
+type AlertSeverity struct {
+	Name    string       `json:"name"`
+	Color   Color        `json:"color"`
+	Pattern PatternStyle `json:"pattern"`
+}
+
+// AlertsConfig lists severities from most to least severe. Alerts whose
+// severity label is missing or unknown are treated as DefaultSeverity.
+type AlertsConfig struct {
+	Severities      []AlertSeverity `json:"severities"`
+	DefaultSeverity string          `json:"defaultSeverity"`
+}
+
+func DefaultAlertsConfig() AlertsConfig {
+	return AlertsConfig{
+		Severities: []AlertSeverity{
+			{Name: "critical", Color: Color{Red: 255}, Pattern: StyleStrobe},
+			{Name: "error", Color: Color{Red: 255}, Pattern: StylePulse},
+			{Name: "warning", Color: Color{Red: 255, Green: 120}, Pattern: StylePulse},
+			{Name: "info", Color: Color{Red: 255, Green: 120}, Pattern: StyleSteady},
+		},
+		DefaultSeverity: "warning",
+	}
+}
+
+// Alert is a firing alert from Alertmanager or Grafana
+type Alert struct {
+	Fingerprint string            `json:"fingerprint"`
+	Name        string            `json:"name"`
+	Severity    string            `json:"severity"`
+	Receiver    string            `json:"receiver"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+}
+
+// AlertTracker keeps the set of firing alerts. While any alert fires it
+// overrides the build status with the pattern for the worst severity.
+type AlertTracker struct {
+	cfg AlertsConfig
+
+	mu      sync.Mutex
+	firing  map[string]Alert
+	changed chan struct{}
+}
+
+func NewAlertTracker(cfg AlertsConfig) *AlertTracker {
+	return &AlertTracker{
+		cfg:     cfg,
+		firing:  make(map[string]Alert),
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Fire records a firing alert
+func (t *AlertTracker) Fire(a Alert) {
+	if a.Severity == "" || t.rank(a.Severity) < 0 {
+		a.Severity = t.cfg.DefaultSeverity
+	}
+
+	t.mu.Lock()
+	prev, ok := t.firing[a.Fingerprint]
+	t.firing[a.Fingerprint] = a
+	t.mu.Unlock()
+
+	if !ok || prev.Severity != a.Severity {
+		log.Println("alert firing", a.Name, a.Severity, a.Fingerprint)
+		t.notify()
+	}
+}
+
+// Resolve forgets a resolved alert
+func (t *AlertTracker) Resolve(fingerprint string) {
+	t.mu.Lock()
+	a, ok := t.firing[fingerprint]
+	delete(t.firing, fingerprint)
+	t.mu.Unlock()
+
+	if ok {
+		log.Println("alert resolved", a.Name, fingerprint)
+		t.notify()
+	}
+}
+
+// Firing returns the firing alerts, most severe first
+func (t *AlertTracker) Firing() []Alert {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(t.firing))
+	for _, a := range t.firing {
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		ri, rj := t.rank(alerts[i].Severity), t.rank(alerts[j].Severity)
+		if ri != rj {
+			return ri < rj
+		}
+		return alerts[i].StartsAt.Before(alerts[j].StartsAt)
+	})
+	return alerts
+}
+
+// Pattern shows the most severe firing alert
+func (t *AlertTracker) Pattern() (Pattern, bool) {
+	firing := t.Firing()
+	if len(firing) == 0 {
+		return nil, false
+	}
+
+	i := t.rank(firing[0].Severity)
+	if i < 0 {
+		return StyleStrobe.Pattern(Color{Red: 255}), true
+	}
+	sev := t.cfg.Severities[i]
+	return sev.Pattern.Pattern(sev.Color), true
+}
+
+// Changed fires after an alert starts or stops firing
+func (t *AlertTracker) Changed() <-chan struct{} { return t.changed }
+
+func (t *AlertTracker) rank(severity string) int {
+	for i, sev := range t.cfg.Severities {
+		if strings.EqualFold(sev.Name, severity) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *AlertTracker) notify() {
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+}
+
+// ServeHTTP lists the firing alerts
+func (t *AlertTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.Firing())
+}
+
+// alertmanagerAlert is one alert in an Alertmanager webhook. Grafana's
+// unified alerting webhook uses the same shape.
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	StartsAt    time.Time         `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+type alertmanagerPayload struct {
+	Receiver string              `json:"receiver"`
+	Alerts   []alertmanagerAlert `json:"alerts"`
+}
+
+// grafanaLegacyPayload is the webhook sent by Grafana's legacy alerting
+type grafanaLegacyPayload struct {
+	RuleID   int64             `json:"ruleId"`
+	RuleName string            `json:"ruleName"`
+	State    string            `json:"state"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// AlertmanagerHandler receives the Prometheus Alertmanager webhook
+func AlertmanagerHandler(t *AlertTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var payload alertmanagerPayload
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			log.Println("Error parsing alertmanager webhook", err)
+			http.Error(w, "Error parsing request", http.StatusBadRequest)
+			return
+		}
+
+		t.apply(payload, "alertmanager")
+	}
+}
+
+// GrafanaHandler receives Grafana alert webhooks, both the unified
+// alerting format and the legacy per-rule format
+func GrafanaHandler(t *AlertTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var raw map[string]json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&raw)
+		if err == nil {
+			if _, unified := raw["alerts"]; unified {
+				var payload alertmanagerPayload
+				if err = remarshal(raw, &payload); err == nil {
+					t.apply(payload, "grafana")
+					return
+				}
+			} else {
+				var payload grafanaLegacyPayload
+				if err = remarshal(raw, &payload); err == nil {
+					t.applyLegacy(payload)
+					return
+				}
+			}
+		}
+
+		log.Println("Error parsing grafana webhook", err)
+		http.Error(w, "Error parsing request", http.StatusBadRequest)
+	}
+}
+
+func (t *AlertTracker) apply(payload alertmanagerPayload, receiver string) {
+	for _, a := range payload.Alerts {
+		fp := a.Fingerprint
+		if fp == "" {
+			fp = labelsFingerprint(a.Labels)
+		}
+
+		if a.Status == "resolved" {
+			t.Resolve(fp)
+			continue
+		}
+		t.Fire(Alert{
+			Fingerprint: fp,
+			Name:        a.Labels["alertname"],
+			Severity:    a.Labels["severity"],
+			Receiver:    receiver,
+			Labels:      a.Labels,
+			StartsAt:    a.StartsAt,
+		})
+	}
+}
+
+func (t *AlertTracker) applyLegacy(payload grafanaLegacyPayload) {
+	fp := fmt.Sprintf("grafana-rule-%d", payload.RuleID)
+
+	switch payload.State {
+	case "alerting":
+		t.Fire(Alert{
+			Fingerprint: fp,
+			Name:        payload.RuleName,
+			Severity:    payload.Tags["severity"],
+			Receiver:    "grafana",
+			Labels:      payload.Tags,
+			StartsAt:    time.Now(),
+		})
+	case "ok", "paused":
+		t.Resolve(fp)
+	}
+}
+
+// labelsFingerprint identifies an alert by its label set, for senders
+// that don't include a fingerprint
+func labelsFingerprint(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "%s=%q,", k, labels[k])
+	}
+	return sb.String()
+}
+
+func remarshal(raw map[string]json.RawMessage, v interface{}) error {
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func postAlert(t *testing.T, h http.Handler, body string) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/alerts", strings.NewReader(body)))
+	return w.Code
+}
+
+func TestAlertWebhooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		grafana bool
+		before  string
+		body    string
+		code    int
+		firing  []string
+	}{
+		{
+			name: "alertmanager firing",
+			body: `{"receiver":"robot","alerts":[
+				{"status":"firing","fingerprint":"a1","labels":{"alertname":"DiskFull","severity":"critical"}},
+				{"status":"firing","fingerprint":"a2","labels":{"alertname":"SlowDeploy","severity":"info"}}]}`,
+			code:   http.StatusOK,
+			firing: []string{"DiskFull/critical", "SlowDeploy/info"},
+		},
+		{
+			name: "alertmanager resolved",
+			body: `{"receiver":"robot","alerts":[
+				{"status":"firing","fingerprint":"a1","labels":{"alertname":"DiskFull","severity":"critical"}},
+				{"status":"resolved","fingerprint":"a1","labels":{"alertname":"DiskFull","severity":"critical"}}]}`,
+			code:   http.StatusOK,
+			firing: nil,
+		},
+		{
+			name:   "unknown severity",
+			body:   `{"alerts":[{"status":"firing","fingerprint":"a1","labels":{"alertname":"Odd","severity":"page"}}]}`,
+			code:   http.StatusOK,
+			firing: []string{"Odd/warning"},
+		},
+		{
+			name: "no fingerprint",
+			body: `{"alerts":[
+				{"status":"firing","labels":{"alertname":"Down","instance":"a"}},
+				{"status":"firing","labels":{"alertname":"Down","instance":"b"}},
+				{"status":"resolved","labels":{"alertname":"Down","instance":"a"}}]}`,
+			code:   http.StatusOK,
+			firing: []string{"Down/warning"},
+		},
+		{
+			name:    "grafana unified",
+			grafana: true,
+			body:    `{"receiver":"robot","alerts":[{"status":"firing","fingerprint":"g1","labels":{"alertname":"HighCPU","severity":"error"}}]}`,
+			code:    http.StatusOK,
+			firing:  []string{"HighCPU/error"},
+		},
+		{
+			name:    "grafana legacy",
+			grafana: true,
+			body:    `{"ruleId":7,"ruleName":"Latency","state":"alerting","tags":{"severity":"critical"}}`,
+			code:    http.StatusOK,
+			firing:  []string{"Latency/critical"},
+		},
+		{
+			name:    "grafana legacy ok",
+			grafana: true,
+			before:  `{"ruleId":7,"ruleName":"Latency","state":"alerting"}`,
+			body:    `{"ruleId":7,"ruleName":"Latency","state":"ok"}`,
+			code:    http.StatusOK,
+			firing:  nil,
+		},
+		{
+			name: "bad body",
+			body: `{"alerts":`,
+			code: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := NewAlertTracker(DefaultAlertsConfig())
+			h := AlertmanagerHandler(tracker)
+			if tt.grafana {
+				h = GrafanaHandler(tracker)
+			}
+			if tt.before != "" {
+				postAlert(t, h, tt.before)
+			}
+
+			if code := postAlert(t, h, tt.body); code != tt.code {
+				t.Fatalf("got %d, want %d", code, tt.code)
+			}
+			var firing []string
+			for _, a := range tracker.Firing() {
+				firing = append(firing, a.Name+"/"+a.Severity)
+			}
+			if strings.Join(firing, ",") != strings.Join(tt.firing, ",") {
+				t.Errorf("firing %q, want %q", firing, tt.firing)
+			}
+		})
+	}
+}
+
+func TestAlertPatternFollowsWorstSeverity(t *testing.T) {
+	tracker := NewAlertTracker(DefaultAlertsConfig())
+	if _, ok := tracker.Pattern(); ok {
+		t.Fatal("pattern with nothing firing")
+	}
+
+	tracker.Fire(Alert{Fingerprint: "1", Severity: "info"})
+	tracker.Fire(Alert{Fingerprint: "2", Severity: "critical"})
+	p, ok := tracker.Pattern()
+	want := StyleStrobe.Pattern(Color{Red: 255})
+	if !ok || !reflect.DeepEqual(p, want) {
+		t.Errorf("got %v, want the critical strobe", p)
+	}
+
+	tracker.Resolve("2")
+	p, _ = tracker.Pattern()
+	if want := StyleSteady.Pattern(Color{Red: 255, Green: 120}); !reflect.DeepEqual(p, want) {
+		t.Errorf("after resolving: got %v, want the info pattern", p)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/logiraptor/gobot-ci/spherov1"
+	"gobot.io/x/gobot/platforms/ble"
+	"gobot.io/x/gobot/platforms/sphero/bb8"
+)
+
+const (
+	ollieCommandsCharacteristic = "22bb746f2ba175542d6f726568705327"
+	ollieResponseCharacteristic = "22bb746f2ba675542d6f726568705327"
+	cidSetRGB                   = 0x20
+	didCore                     = 0x00
+	cidSleep                    = 0x22
+)
+
+// bb8Light is gobot's BB-8 driver with a SetRGB that writes the command
+// itself. The driver queues commands and only publishes write errors as
+// events, so they never reach the caller.
+type bb8Light struct {
+	*bb8.BB8Driver
+	link    *v1Sequencer
+	confirm bool
+}
+
+// v1Connection is the BLE connection a v1 robot is driven over, such as a
+// ClientAdaptor or a ReplayConnector. listen keeps delivering
+// notifications across reconnects and timeout is how long the robot may
+// take to answer.
+type v1Connection interface {
+	ble.BLEConnector
+	listen(cUUID string, f func([]byte))
+	timeout() time.Duration
+}
+
+// newBB8Light drives a BB-8. With confirm set, SetRGB waits for the robot
+// to acknowledge the command.
+func newBB8Light(a v1Connection, confirm bool) *bb8Light {
+	link := newV1Sequencer(a)
+	a.listen(ollieResponseCharacteristic, link.response)
+	return &bb8Light{
+		BB8Driver: bb8.NewDriver(link),
+		link:      link,
+		confirm:   confirm,
+	}
+}
+
+// SetRGB sets the main LED
+func (d *bb8Light) SetRGB(r, g, b uint8) error {
+	ack := make(chan byte, 1)
+	seq, err := d.link.send(spherov1.Packet{DeviceID: didSphero, CommandID: cidSetRGB, Data: []byte{r, g, b, 0x01}}, ack)
+	defer d.link.forget(seq, ack)
+	if err != nil || !d.confirm {
+		return err
+	}
+
+	timeout := time.NewTimer(d.link.timeout())
+	defer timeout.Stop()
+	select {
+	case code := <-ack:
+		if code != 0 {
+			return fmt.Errorf("robot rejected color with response code %#x", code)
+		}
+		return nil
+	case <-timeout.C:
+		return &BLEError{Op: "confirm", Address: d.link.Address(), Characteristic: ollieResponseCharacteristic, Err: ErrTimeout}
+	}
+}
+
+// Sleep puts the robot to sleep until the next connection. Unlike the
+// gobot driver's Sleep, it reports whether the command was written.
+func (d *bb8Light) Sleep() error {
+	// no timed wakeup, macro or orbBasic program on waking
+	return d.command(didCore, cidSleep, []byte{0, 0, 0, 0, 0})
+}
+
+// command writes a command without waiting for its response
+func (d *bb8Light) command(did, cid byte, data []byte) error {
+	_, err := d.link.send(spherov1.Packet{DeviceID: did, CommandID: cid, Data: data}, nil)
+	return err
+}
+
+// v1Sequencer numbers every command written to a v1 robot from a single
+// counter, whoever wrote it. The gobot driver stamps its sequence number
+// when it queues a packet but only counts up once the packet is written,
+// so its numbers repeat and collide with ours. Its packets come through
+// WriteCharacteristic and are renumbered on the way out.
+type v1Sequencer struct {
+	v1Connection
+
+	// writing keeps packets on the wire in the order they were numbered
+	writing sync.Mutex
+
+	mu      sync.Mutex
+	seq     byte
+	pending map[byte]v1Pending
+}
+
+// v1Pending is a command waiting for its response. Ack is nil when nobody
+// waits for the response code.
+type v1Pending struct {
+	did, cid byte
+	ack      chan byte
+}
+
+func newV1Sequencer(a v1Connection) *v1Sequencer {
+	return &v1Sequencer{
+		v1Connection: a,
+		pending:      make(map[byte]v1Pending),
+	}
+}
+
+// WriteCharacteristic renumbers the commands the gobot driver writes
+func (s *v1Sequencer) WriteCharacteristic(cUUID string, data []byte) error {
+	if cUUID != ollieCommandsCharacteristic {
+		return s.v1Connection.WriteCharacteristic(cUUID, data)
+	}
+	p, n, err := spherov1.DecodeCommand(data)
+	if err != nil || n != len(data) {
+		return s.v1Connection.WriteCharacteristic(cUUID, data)
+	}
+	_, err = s.send(p, nil)
+	return err
+}
+
+// send numbers the command and writes it. The robot's response code goes
+// to ack, if there is one.
+func (s *v1Sequencer) send(p spherov1.Packet, ack chan byte) (byte, error) {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+
+	s.mu.Lock()
+	p.Kind, p.Answer, p.Seq = spherov1.Command, true, s.seq
+	buf, err := p.Encode()
+	if err != nil {
+		s.mu.Unlock()
+		return p.Seq, err
+	}
+	s.seq++
+	s.pending[p.Seq] = v1Pending{p.DeviceID, p.CommandID, ack}
+	s.mu.Unlock()
+
+	return p.Seq, s.v1Connection.WriteCharacteristic(ollieCommandsCharacteristic, buf)
+}
+
+// forget stops waiting for the response to a command, unless its
+// sequence number has been handed out again since
+func (s *v1Sequencer) forget(seq byte, ack chan byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending[seq].ack == ack {
+		delete(s.pending, seq)
+	}
+}
+
+// response passes simple responses on to the command waiting for them
+func (s *v1Sequencer) response(data []byte) {
+	p, _, err := spherov1.DecodeReply(data)
+	if err != nil || p.Kind != spherov1.Response {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cmd, ok := s.pending[p.Seq]
+	if !ok {
+		return
+	}
+	delete(s.pending, p.Seq)
+	if cmd.ack == nil {
+		if p.Response != 0 {
+			log.Println("robot rejected", spherov1.CommandName(cmd.did, cmd.cid)+":", spherov1.ResponseName(p.Response))
+		}
+		return
+	}
+	select {
+	case cmd.ack <- p.Response:
+	default:
+	}
+}
@@ -4,17 +4,14 @@ package main
 import (
 	"fmt"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/pkg/errors"
-
 	"tinygo.org/x/bluetooth"
 )
 
 //var currentDevice *blelib.Device
-var currentAdapter *bluetooth.Adapter
-var bleMutex sync.Mutex
 
 // ClientAdaptor represents a Client Connection to a BLE Peripheral
 type ClientAdaptor struct {
@@ -22,25 +19,43 @@ type ClientAdaptor struct {
 	address     string
 	AdapterName string
 
-	addr            bluetooth.Address
+	filter          DeviceFilter
+	discovery       *Discovery
+	adapters        *AdapterPool
 	adpt            *bluetooth.Adapter
+	adapterID       string
 	device          *bluetooth.Device
 	characteristics map[string]bluetooth.DeviceCharacteristic
+	required        []GATTRequirement
 
 	connected        bool
 	ready            chan struct{}
 	withoutResponses bool
+	writes           WriteConfig
+	trace            TraceRecorder
+
+	subMu     sync.Mutex
+	subs      map[string][]*Subscription
+	notifying map[string]bool
 }
 
-// NewClientAdaptor returns a new ClientAdaptor given an address
-func NewClientAdaptor(name string) *ClientAdaptor {
+// NewClientAdaptor returns a new ClientAdaptor for the device matching
+// filter, found through discovery on a controller from adapters.
+// AdapterName is the preferred controller.
+func NewClientAdaptor(filter DeviceFilter, discovery *Discovery, adapters *AdapterPool) *ClientAdaptor {
 	return &ClientAdaptor{
-		name:             name,
+		name:             firstNonEmpty(filter.Name, filter.NamePrefix, filter.Address, filter.Service),
+		filter:           filter,
+		discovery:        discovery,
+		adapters:         adapters,
 		address:          "",
-		AdapterName:      "default",
+		AdapterName:      "",
 		connected:        false,
 		withoutResponses: false,
+		writes:           DefaultWriteConfig(),
 		characteristics:  make(map[string]bluetooth.DeviceCharacteristic),
+		subs:             make(map[string][]*Subscription),
+		notifying:        make(map[string]bool),
 	}
 }
 
@@ -57,60 +72,69 @@ func (b *ClientAdaptor) Address() string { return b.address }
 // writing characteristics for this device
 func (b *ClientAdaptor) WithoutResponses(use bool) { b.withoutResponses = use }
 
+// Require limits service discovery to what the driver uses and fails
+// connecting when the device doesn't have it
+func (b *ClientAdaptor) Require(reqs ...GATTRequirement) {
+	b.required = append(b.required, reqs...)
+}
+
 // Connect initiates a connection to the BLE peripheral. Returns true on successful connection.
 func (b *ClientAdaptor) Connect() (err error) {
-	bleMutex.Lock()
-	defer bleMutex.Unlock()
-
-	// enable adaptor
-	b.adpt, err = getBLEAdapter(b.AdapterName)
-	if err != nil {
-		return errors.Wrap(err, "can't enable adapter "+b.AdapterName)
-	}
+	a := b.adapters.Choose(b.AdapterName)
+	a.mu.Lock()
+	defer a.mu.Unlock()
 
-	// scan for the address
-	ch := make(chan bluetooth.ScanResult, 1)
-	err = b.adpt.Scan(func(adapter *bluetooth.Adapter, result bluetooth.ScanResult) {
-		if result.LocalName() == b.Name() {
-			fmt.Println("found device", result.LocalName(), result.Address.String())
-			b.adpt.StopScan()
-			b.address = result.Address.String()
-			ch <- result
+	defer func() {
+		if err != nil {
+			b.adapters.Failed(a, err)
 		} else {
-			fmt.Println("skipping device", result.LocalName(), result.Address.String())
+			b.adapters.Succeeded(a)
 		}
-	})
+	}()
 
+	// enable adaptor
+	b.adpt, err = a.enable()
 	if err != nil {
 		return err
 	}
-
-	// handle address
-	b.addr.Set(b.Address())
-
-	// wait to connect to peripheral device
-	select {
-	case result := <-ch:
-		b.device, err = b.adpt.Connect(result.Address, bluetooth.ConnectionParams{})
+	b.adapterID = a.name
+
+	// try the last known address before scanning again
+	b.device = nil
+	b.dropSubscriptions()
+	if addr, ok := b.discovery.Cached(b.filter); ok {
+		log.Println("connecting to cached address", addr.String(), "on", a.name)
+		b.device, err = b.adpt.Connect(addr, bluetooth.ConnectionParams{})
 		if err != nil {
-			return err
+			log.Println("cached address failed, scanning", err)
+			b.discovery.Forget(b.filter)
+		} else {
+			b.address = addr.String()
 		}
 	}
 
-	// get all services/characteristics
-	srvcs, err := b.device.DiscoverServices(nil)
-	for _, srvc := range srvcs {
-		chars, err := srvc.DiscoverCharacteristics(nil)
+	if b.device == nil {
+		var addr bluetooth.Addresser
+		addr, err = b.discovery.Find(b.adpt, b.filter)
 		if err != nil {
-			log.Println(err)
-			continue
+			return err
 		}
-		for _, char := range chars {
-			b.characteristics[char.UUID().String()] = char
+		b.address = addr.String()
+
+		b.device, err = b.adpt.Connect(addr, bluetooth.ConnectionParams{})
+		if err != nil {
+			return err
 		}
 	}
 
+	if err = b.discoverGATT(); err != nil {
+		b.device.Disconnect()
+		b.device = nil
+		return err
+	}
+
 	b.connected = true
+	b.resubscribe()
 	return
 }
 
@@ -126,7 +150,13 @@ func (b *ClientAdaptor) Reconnect() (err error) {
 
 // Disconnect terminates the connection to the BLE peripheral. Returns true on successful disconnect.
 func (b *ClientAdaptor) Disconnect() (err error) {
+	if b.device == nil {
+		return nil
+	}
 	err = b.device.Disconnect()
+	b.device = nil
+	b.connected = false
+	b.dropSubscriptions()
 	time.Sleep(500 * time.Millisecond)
 	return
 }
@@ -139,89 +169,41 @@ func (b *ClientAdaptor) Finalize() (err error) {
 // ReadCharacteristic returns bytes from the BLE device for the
 // requested characteristic uuid
 func (b *ClientAdaptor) ReadCharacteristic(cUUID string) (data []byte, err error) {
-	if !b.connected {
-		log.Fatalf("Cannot read from BLE device until connected")
-		return
-	}
-
-	cUUID = convertUUID(cUUID)
-
-	if char, ok := b.characteristics[cUUID]; ok {
-		buf := make([]byte, 255)
-		n, err := char.Read(buf)
-		if err != nil {
-			return nil, err
-		}
-		return buf[:n], nil
+	buf := make([]byte, 255)
+	n := 0
+	err = b.gattOp("read", cUUID, func(char bluetooth.DeviceCharacteristic) (err error) {
+		n, err = char.Read(buf)
+		return err
+	})
+	if err != nil {
+		b.record(TraceRead, cUUID, nil, err)
+		return nil, err
 	}
-
-	return nil, fmt.Errorf("Unknown characteristic: %s", cUUID)
+	b.record(TraceRead, cUUID, buf[:n], nil)
+	return buf[:n], nil
 }
 
 // WriteCharacteristic writes bytes to the BLE device for the
 // requested service and characteristic
 func (b *ClientAdaptor) WriteCharacteristic(cUUID string, data []byte) (err error) {
-	if !b.connected {
-		log.Println("Cannot write to BLE device until connected")
-		return
-	}
-
-	cUUID = convertUUID(cUUID)
-
-	if char, ok := b.characteristics[cUUID]; ok {
-		_, err := char.WriteWithoutResponse(data)
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-
-	return fmt.Errorf("Unknown characteristic: %s", cUUID)
-}
-
-// Subscribe subscribes to notifications from the BLE device for the
-// requested service and characteristic
-func (b *ClientAdaptor) Subscribe(cUUID string, f func([]byte, error)) (err error) {
-	if !b.connected {
-		log.Fatalf("Cannot subscribe to BLE device until connected")
-		return
-	}
-
-	cUUID = convertUUID(cUUID)
-
-	if char, ok := b.characteristics[cUUID]; ok {
-		fn := func(d []byte) {
-			f(d, nil)
-		}
-		err = char.EnableNotifications(fn)
-		return
-	}
-
-	return fmt.Errorf("Unknown characteristic: %s", cUUID)
+	return b.retry(func() error {
+		err := b.gattOp("write", cUUID, func(char bluetooth.DeviceCharacteristic) error {
+			return b.write(char, data)
+		})
+		b.record(TraceWrite, cUUID, data, err)
+		return err
+	})
 }
 
-// getBLEDevice is singleton for bluetooth adapter connection
-func getBLEAdapter(impl string) (*bluetooth.Adapter, error) {
-	if currentAdapter != nil {
-		return currentAdapter, nil
-	}
-
-	currentAdapter = bluetooth.DefaultAdapter
-	err := currentAdapter.Enable()
-	if err != nil {
-		return nil, errors.Wrap(err, "can't get device")
-	}
-
-	return currentAdapter, nil
-}
+// Connected reports whether the adaptor has a connection to the device
+func (b *ClientAdaptor) Connected() bool { return b.connected }
 
 func convertUUID(cUUID string) string {
 	switch len(cUUID) {
 	case 4:
-		// 2a270000-0000-0000-0000-000000000000
-		// convert "22bb"
-		// to "22bb0000-0000-0000-0000-000000000000"
-		return fmt.Sprintf("%s0000-0000-0000-0000-000000000000", cUUID)
+		// convert "2a27"
+		// to "00002a27-0000-1000-8000-00805f9b34fb", on the Bluetooth base UUID
+		return fmt.Sprintf("0000%s-0000-1000-8000-00805f9b34fb", strings.ToLower(cUUID))
 	case 32:
 		// convert "22bb746f2bbd75542d6f726568705327"
 		// to "22bb746f-2bbd-7554-2d6f-726568705327"
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// AdaptersConfig lists the local Bluetooth controllers to use, such as
+// "hci0" and "hci1", in order of preference; "default" is the system
+// default. After Failover connects in a row fail on a controller the next
+// one is tried, and the failing one is given another chance after
+// Cooldown.
+type AdaptersConfig struct {
+	Order    []string `json:"order"`
+	Failover int      `json:"failover"`
+	Cooldown Duration `json:"cooldown"`
+}
+
+func DefaultAdaptersConfig() AdaptersConfig {
+	return AdaptersConfig{
+		Order:    []string{"default"},
+		Failover: 3,
+		Cooldown: Duration(5 * time.Minute),
+	}
+}
+
+// bleAdapter is the state of one local controller. mu serializes scans
+// and connects on it.
+type bleAdapter struct {
+	name string
+
+	mu      sync.Mutex
+	adapter *bluetooth.Adapter
+
+	failures    int
+	lastFailure time.Time
+}
+
+// AdapterPool hands out local controllers to BLE devices
+type AdapterPool struct {
+	cfg AdaptersConfig
+
+	mu       sync.Mutex
+	adapters map[string]*bleAdapter
+}
+
+func NewAdapterPool(cfg AdaptersConfig) *AdapterPool {
+	if len(cfg.Order) == 0 {
+		cfg.Order = []string{"default"}
+	}
+	if cfg.Failover <= 0 {
+		cfg.Failover = 3
+	}
+	return &AdapterPool{
+		cfg:      cfg,
+		adapters: make(map[string]*bleAdapter),
+	}
+}
+
+func (p *AdapterPool) get(name string) *bleAdapter {
+	name = resolveAdapterName(name)
+	a, ok := p.adapters[name]
+	if !ok {
+		a = &bleAdapter{name: name}
+		p.adapters[name] = a
+	}
+	return a
+}
+
+// Choose returns the controller to connect through: preferred, then the
+// configured order, skipping controllers that keep failing
+func (p *AdapterPool) Choose(preferred string) *bleAdapter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []*bleAdapter
+	if preferred != "" {
+		candidates = append(candidates, p.get(preferred))
+	}
+	for _, name := range p.cfg.Order {
+		candidates = append(candidates, p.get(name))
+	}
+
+	cooldown := p.cfg.Cooldown.Or(5 * time.Minute)
+	for _, a := range candidates {
+		if a.failures < p.cfg.Failover || time.Since(a.lastFailure) > cooldown {
+			return a
+		}
+	}
+	return candidates[0]
+}
+
+// Failed records a failed connect through a
+func (p *AdapterPool) Failed(a *bleAdapter, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a.failures++
+	a.lastFailure = time.Now()
+	if a.failures == p.cfg.Failover {
+		log.Println("adapter", a.name, "failed", a.failures, "times, failing over:", err)
+	}
+}
+
+// Succeeded records a successful connect through a
+func (p *AdapterPool) Succeeded(a *bleAdapter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a.failures = 0
+}
+
+// enable returns the controller, enabling it on first use. The caller
+// holds a.mu.
+func (a *bleAdapter) enable() (*bluetooth.Adapter, error) {
+	if a.adapter != nil {
+		return a.adapter, nil
+	}
+
+	adapter, err := openAdapter(a.name)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't enable adapter "+a.name)
+	}
+	a.adapter = adapter
+	return adapter, nil
+}
+
+// ServeHTTP lists the controllers in use and their failures
+func (p *AdapterPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type adapterState struct {
+		Name        string    `json:"name"`
+		Failures    int       `json:"failures"`
+		LastFailure time.Time `json:"lastFailure,omitempty"`
+	}
+
+	p.mu.Lock()
+	states := make([]adapterState, 0, len(p.adapters))
+	for _, a := range p.adapters {
+		states = append(states, adapterState{a.name, a.failures, a.lastFailure})
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	"tinygo.org/x/bluetooth"
+)
+
+// enableMu guards BlueZ's default adapter ID while a controller is enabled
+var enableMu sync.Mutex
+
+// resolveAdapterName maps "default" to the controller BlueZ uses by
+// default, so both names share one adapter
+func resolveAdapterName(name string) string {
+	if name == "" || name == "default" {
+		return adapter.GetDefaultAdapterID()
+	}
+	return name
+}
+
+// openAdapter enables the controller with the given hciN ID. The tinygo
+// adapter enables whichever controller BlueZ considers the default, so
+// that is switched for the duration of the call.
+func openAdapter(name string) (*bluetooth.Adapter, error) {
+	enableMu.Lock()
+	defer enableMu.Unlock()
+
+	prev := adapter.GetDefaultAdapterID()
+	if name == prev {
+		return bluetooth.DefaultAdapter, bluetooth.DefaultAdapter.Enable()
+	}
+
+	adapter.SetDefaultAdapterID(name)
+	defer adapter.SetDefaultAdapterID(prev)
+
+	a := &bluetooth.Adapter{}
+	a.SetConnectHandler(func(bluetooth.Addresser, bool) {})
+	return a, a.Enable()
+}
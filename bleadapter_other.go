@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+
+	"tinygo.org/x/bluetooth"
+)
+
+func resolveAdapterName(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+// openAdapter only knows the default controller outside Linux
+func openAdapter(name string) (*bluetooth.Adapter, error) {
+	if name != "default" {
+		return nil, fmt.Errorf("choosing adapter %s is only supported on Linux", name)
+	}
+	return bluetooth.DefaultAdapter, bluetooth.DefaultAdapter.Enable()
+}
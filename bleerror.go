@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// Errors returned by GATT operations, wrapped in a BLEError. Match them
+// with errors.Is.
+var (
+	ErrNotConnected          = errors.New("not connected")
+	ErrUnknownCharacteristic = errors.New("unknown characteristic")
+	ErrDisconnected          = errors.New("disconnected")
+	ErrTimeout               = errors.New("timed out")
+)
+
+// BLEError is a failed GATT operation on a device
+type BLEError struct {
+	Op             string
+	Address        string
+	Characteristic string
+	Err            error
+}
+
+func (e *BLEError) Error() string {
+	return fmt.Sprintf("ble %s %s on %s: %v", e.Op, e.Characteristic, firstNonEmpty(e.Address, "unknown device"), e.Err)
+}
+
+// Unwrap returns the underlying error, for errors.Is
+func (e *BLEError) Unwrap() error { return e.Err }
+
+// Cause returns the underlying error, for errors.Cause
+func (e *BLEError) Cause() error { return e.Err }
+
+// gattOp runs f on the characteristic, checking the device is connected
+// first and giving up after the configured timeout
+func (b *ClientAdaptor) gattOp(op, cUUID string, f func(bluetooth.DeviceCharacteristic) error) error {
+	fail := func(err error) error {
+		return &BLEError{Op: op, Address: b.address, Characteristic: cUUID, Err: err}
+	}
+
+	if !b.connected {
+		return fail(ErrNotConnected)
+	}
+	char, ok := b.characteristics[convertUUID(cUUID)]
+	if !ok {
+		return fail(ErrUnknownCharacteristic)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- f(char) }()
+
+	timeout := time.NewTimer(b.timeout())
+	defer timeout.Stop()
+	select {
+	case err := <-done:
+		if err == nil {
+			return nil
+		}
+		if isDisconnect(err) {
+			err = fmt.Errorf("%w: %v", ErrDisconnected, err)
+		}
+		return fail(err)
+	case <-timeout.C:
+		return fail(ErrTimeout)
+	}
+}
+
+// connectionLost reports whether err means the device has to be
+// connected again
+func connectionLost(err error) bool {
+	return errors.Is(err, ErrNotConnected) || errors.Is(err, ErrDisconnected)
+}
+
+// isDisconnect recognizes BlueZ's errors for a device that went away
+// during an operation
+func isDisconnect(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not connected") ||
+		strings.Contains(msg, "notconnected") ||
+		strings.Contains(msg, "disconnected") ||
+		strings.Contains(msg, "unknown object")
+}
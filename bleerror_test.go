@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// testAdaptor is connected to a device with a single characteristic, fff3
+func testAdaptor() *ClientAdaptor {
+	b := NewClientAdaptor(DeviceFilter{Name: "test"}, nil, nil)
+	b.address = "aa"
+	b.connected = true
+	b.characteristics[convertUUID("fff3")] = bluetooth.DeviceCharacteristic{}
+	return b
+}
+
+func TestGATTOpErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(b *ClientAdaptor)
+		char   string
+		result error
+		want   error
+		lost   bool
+		retry  bool
+	}{
+		{"succeeds", nil, "fff3", nil, nil, false, false},
+		{"not connected", func(b *ClientAdaptor) { b.connected = false }, "fff3", nil, ErrNotConnected, true, false},
+		{"unknown characteristic", nil, "fff4", nil, ErrUnknownCharacteristic, false, false},
+		{"device went away", nil, "fff3", errors.New("org.bluez.Error.NotConnected"), ErrDisconnected, true, false},
+		{"unknown object", nil, "fff3", errors.New("Method \"WriteValue\" with signature \"aya{sv}\" on interface \"org.bluez.GattCharacteristic1\" doesn't exist: unknown object"), ErrDisconnected, true, false},
+		{"busy", nil, "fff3", errors.New("org.bluez.Error.InProgress"), nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testAdaptor()
+			if tt.setup != nil {
+				tt.setup(b)
+			}
+			err := b.gattOp("write", tt.char, func(bluetooth.DeviceCharacteristic) error { return tt.result })
+			if tt.result == nil && tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var bleErr *BLEError
+			if !errors.As(err, &bleErr) {
+				t.Fatalf("got %T %v, want a BLEError", err, err)
+			}
+			if bleErr.Op != "write" || bleErr.Address != "aa" || bleErr.Characteristic != tt.char {
+				t.Errorf("got %+v", bleErr)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("%v is not %v", err, tt.want)
+			}
+			if got := connectionLost(err); got != tt.lost {
+				t.Errorf("connection lost %v, want %v", got, tt.lost)
+			}
+			if got := transient(err); got != tt.retry {
+				t.Errorf("transient %v, want %v", got, tt.retry)
+			}
+		})
+	}
+}
+
+func TestGATTOpTimeout(t *testing.T) {
+	b := testAdaptor()
+	b.writes.Timeout = Duration(10 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+
+	err := b.gattOp("read", "fff3", func(bluetooth.DeviceCharacteristic) error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("got %v, want a timeout", err)
+	}
+	if transient(err) || connectionLost(err) {
+		t.Error("a timeout is neither transient nor a lost connection")
+	}
+}
+
+func TestBLEErrorWrapped(t *testing.T) {
+	err := errors.Wrap(&BLEError{Op: "write", Characteristic: "fff3", Err: ErrDisconnected}, "can't set color")
+	if !errors.Is(err, ErrDisconnected) || !connectionLost(err) {
+		t.Errorf("lost the cause of %v", err)
+	}
+	if errors.Cause(err) != ErrDisconnected {
+		t.Errorf("cause %v", errors.Cause(err))
+	}
+	if want := "can't set color: ble write fff3 on unknown device: disconnected"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+
+	wrapped := fmt.Errorf("%w: %v", ErrDisconnected, "gone")
+	if !errors.Is(&BLEError{Err: wrapped}, ErrDisconnected) {
+		t.Error("didn't match a wrapped disconnect")
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// WriteConfig tunes GATT operations on a device. Timeout bounds each
+// attempt, and writes that fail for a transient reason are tried again up
+// to Retries times, waiting Backoff plus jitter and doubling it each time.
+// WithoutResponses sends write commands instead of write requests, which
+// is faster but never tells whether the write arrived. Confirm makes a v1
+// Sphero robot acknowledge every color before it counts as set.
+type WriteConfig struct {
+	Timeout          Duration `json:"timeout"`
+	Retries          int      `json:"retries"`
+	Backoff          Duration `json:"backoff"`
+	WithoutResponses bool     `json:"withoutResponses"`
+	Confirm          bool     `json:"confirm"`
+}
+
+func DefaultWriteConfig() WriteConfig {
+	return WriteConfig{
+		Timeout: Duration(5 * time.Second),
+		Retries: 2,
+		Backoff: Duration(100 * time.Millisecond),
+	}
+}
+
+// Configure applies the write settings to the adaptor
+func (b *ClientAdaptor) Configure(cfg WriteConfig) {
+	b.writes = cfg
+	b.WithoutResponses(cfg.WithoutResponses)
+}
+
+// timeout is how long a single GATT operation may take
+func (b *ClientAdaptor) timeout() time.Duration {
+	return b.writes.Timeout.Or(5 * time.Second)
+}
+
+// retry runs op until it succeeds, fails for good or runs out of retries
+func (b *ClientAdaptor) retry(op func() error) error {
+	backoff := b.writes.Backoff.Or(100 * time.Millisecond)
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil || !transient(err) || attempt >= b.writes.Retries {
+			return err
+		}
+
+		wait := backoff << attempt
+		wait += time.Duration(rand.Int63n(int64(wait)))
+		log.Println("retrying in", wait, "after", err)
+		time.Sleep(wait)
+	}
+}
+
+// transient reports whether trying again might help. A write that timed
+// out may still have reached the device, so it isn't repeated here: that
+// would run a command such as a roll or a macro twice. The command queue
+// tries keyed commands again, where only the latest one counts anyway.
+func transient(err error) bool {
+	return !connectionLost(err) && !errors.Is(err, ErrUnknownCharacteristic) && !errors.Is(err, ErrTimeout)
+}
+
+// write sends data to the characteristic as a write request, or as a
+// write command without responses
+func (b *ClientAdaptor) write(char bluetooth.DeviceCharacteristic, data []byte) error {
+	if b.withoutResponses {
+		return writeValue(b, char, data, "command")
+	}
+	return writeValue(b, char, data, "request")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/muka/go-bluetooth/bluez"
+	"github.com/muka/go-bluetooth/bluez/profile/gatt"
+	"tinygo.org/x/bluetooth"
+)
+
+// gattPaths caches the BlueZ object of each characteristic written to, by
+// device path and UUID
+var gattPaths = struct {
+	sync.Mutex
+	chars map[string]*gatt.GattCharacteristic1
+}{chars: make(map[string]*gatt.GattCharacteristic1)}
+
+// writeValue writes through BlueZ directly, as the tinygo adapter can't
+// choose between write requests and commands. kind is "request" or
+// "command".
+func writeValue(b *ClientAdaptor, char bluetooth.DeviceCharacteristic, data []byte, kind string) error {
+	devicePath := "/org/bluez/" + b.adapterID + "/dev_" + strings.ReplaceAll(strings.ToUpper(b.address), ":", "_")
+	uuid := char.UUID().String()
+	key := devicePath + " " + uuid
+
+	gattPaths.Lock()
+	gc, ok := gattPaths.chars[key]
+	gattPaths.Unlock()
+
+	if !ok {
+		var err error
+		gc, err = findCharacteristic(devicePath, uuid)
+		if err != nil {
+			return err
+		}
+		gattPaths.Lock()
+		gattPaths.chars[key] = gc
+		gattPaths.Unlock()
+	}
+
+	err := gc.WriteValue(data, map[string]interface{}{"type": kind})
+	if err != nil {
+		// the object goes away with the connection
+		gattPaths.Lock()
+		delete(gattPaths.chars, key)
+		gattPaths.Unlock()
+	}
+	return err
+}
+
+// findCharacteristic looks up the characteristic with uuid on the device
+func findCharacteristic(devicePath, uuid string) (*gatt.GattCharacteristic1, error) {
+	om, err := bluez.GetObjectManager()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := om.GetManagedObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	for path, ifaces := range objects {
+		if !strings.HasPrefix(string(path), devicePath+"/service") {
+			continue
+		}
+		props, ok := ifaces[gatt.GattCharacteristic1Interface]
+		if !ok {
+			continue
+		}
+		if v, ok := props["UUID"].Value().(string); ok && strings.EqualFold(v, uuid) {
+			return gatt.NewGattCharacteristic1(path)
+		}
+	}
+	return nil, ErrUnknownCharacteristic
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "tinygo.org/x/bluetooth"
+
+// writeValue always sends a write command, the only kind of write the
+// tinygo adapter offers outside Linux
+func writeValue(b *ClientAdaptor, char bluetooth.DeviceCharacteristic, data []byte, kind string) error {
+	_, err := char.WriteWithoutResponse(data)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestRetry(t *testing.T) {
+	busy := &BLEError{Op: "write", Err: errors.New("org.bluez.Error.InProgress")}
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+		err      error
+	}{
+		{"first time", []error{nil}, 1, nil},
+		{"after a transient failure", []error{busy, nil}, 2, nil},
+		{"out of retries", []error{busy, busy, busy, nil}, 3, busy},
+		{"timed out", []error{&BLEError{Err: ErrTimeout}, nil}, 1, ErrTimeout},
+		{"disconnected", []error{&BLEError{Err: ErrDisconnected}, nil}, 1, ErrDisconnected},
+		{"unknown characteristic", []error{&BLEError{Err: ErrUnknownCharacteristic}, nil}, 1, ErrUnknownCharacteristic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := testAdaptor()
+			b.writes.Retries = 2
+			b.writes.Backoff = Duration(time.Millisecond)
+
+			attempts := 0
+			err := b.retry(func() error {
+				attempts++
+				return tt.errs[attempts-1]
+			})
+			if attempts != tt.attempts {
+				t.Errorf("tried %d times, want %d", attempts, tt.attempts)
+			}
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRetryBacksOff(t *testing.T) {
+	b := testAdaptor()
+	b.writes.Retries = 3
+	b.writes.Backoff = Duration(5 * time.Millisecond)
+
+	var at []time.Time
+	b.retry(func() error {
+		at = append(at, time.Now())
+		return errors.New("org.bluez.Error.InProgress")
+	})
+	if len(at) != 4 {
+		t.Fatalf("tried %d times, want 4", len(at))
+	}
+	// each wait is the doubled backoff plus up to as much again in jitter
+	for i := 1; i < len(at); i++ {
+		least := 5 * time.Millisecond << (i - 1)
+		if wait := at[i].Sub(at[i-1]); wait < least {
+			t.Errorf("waited %v before attempt %d, want at least %v", wait, i+1, least)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/ble"
+)
+
+// ByteTemplate is a command for a BLE bulb written as space separated hex
+// bytes. The placeholders {r}, {g} and {b} are replaced with the color.
+type ByteTemplate string
+
+// Render fills in the color and returns the bytes to write
+func (t ByteTemplate) Render(c Color) ([]byte, error) {
+	fields := strings.Fields(string(t))
+	buf := make([]byte, 0, len(fields))
+	for _, field := range fields {
+		switch strings.ToLower(field) {
+		case "{r}":
+			buf = append(buf, c.Red)
+		case "{g}":
+			buf = append(buf, c.Green)
+		case "{b}":
+			buf = append(buf, c.Blue)
+		default:
+			b, err := hex.DecodeString(field)
+			if err != nil || len(b) != 1 {
+				return nil, fmt.Errorf("bad byte %q in template %q", field, t)
+			}
+			buf = append(buf, b[0])
+		}
+	}
+	return buf, nil
+}
+
+// BulbProfile describes how to drive a family of BLE bulbs: the GATT
+// service and characteristic to write to and the command templates for
+// color and power. Power commands are optional.
+type BulbProfile struct {
+	Service        string       `json:"service"`
+	Characteristic string       `json:"characteristic"`
+	Color          ByteTemplate `json:"color"`
+	On             ByteTemplate `json:"on,omitempty"`
+	Off            ByteTemplate `json:"off,omitempty"`
+}
+
+func (p BulbProfile) validate() error {
+	if p.Characteristic == "" {
+		return fmt.Errorf("bulb profile needs a characteristic")
+	}
+	for _, t := range []ByteTemplate{p.Color, p.On, p.Off} {
+		if _, err := t.Render(Color{}); err != nil {
+			return err
+		}
+	}
+	if p.Color == "" {
+		return fmt.Errorf("bulb profile needs a color template")
+	}
+	return nil
+}
+
+// bulbProfiles are the built in profiles, by name
+var bulbProfiles = map[string]BulbProfile{
+	"magicblue": {
+		Service:        "0000ffe5-0000-1000-8000-00805f9b34fb",
+		Characteristic: "0000ffe9-0000-1000-8000-00805f9b34fb",
+		Color:          "56 {r} {g} {b} 00 f0 aa",
+		On:             "cc 23 33",
+		Off:            "cc 24 33",
+	},
+	"triones": {
+		Service:        "0000ffd5-0000-1000-8000-00805f9b34fb",
+		Characteristic: "0000ffd9-0000-1000-8000-00805f9b34fb",
+		Color:          "56 {r} {g} {b} 00 f0 aa",
+		On:             "cc 23 33",
+		Off:            "cc 24 33",
+	},
+}
+
+// BulbConfig selects a BLE bulb with a device filter. Profile names a
+// built in profile or one from Profiles. The other settings are the same
+// as a robot's.
+type BulbConfig struct {
+	DeviceFilter
+	Profile  string                 `json:"profile"`
+	Profiles map[string]BulbProfile `json:"profiles,omitempty"`
+	Adapter  string                 `json:"adapter,omitempty"`
+	Writes   WriteConfig            `json:"writes"`
+	Trace    TraceConfig            `json:"trace"`
+}
+
+// profile looks up the configured profile, preferring custom ones
+func (cfg BulbConfig) profile() (BulbProfile, error) {
+	p, ok := cfg.Profiles[cfg.Profile]
+	if !ok {
+		p, ok = bulbProfiles[cfg.Profile]
+	}
+	if !ok {
+		return p, fmt.Errorf("unknown bulb profile %q", cfg.Profile)
+	}
+	return p, p.validate()
+}
+
+// BulbDriver is a Gobot driver for a BLE bulb described by a BulbProfile
+type BulbDriver struct {
+	name       string
+	connection gobot.Connection
+	profile    BulbProfile
+}
+
+func NewBulbDriver(a ble.BLEConnector, profile BulbProfile) *BulbDriver {
+	return &BulbDriver{
+		name:       gobot.DefaultName("Bulb"),
+		connection: a,
+		profile:    profile,
+	}
+}
+
+// Name returns the name for the Driver
+func (d *BulbDriver) Name() string { return d.name }
+
+// SetName sets the Name for the Driver
+func (d *BulbDriver) SetName(n string) { d.name = n }
+
+// Connection returns the connection to this bulb
+func (d *BulbDriver) Connection() gobot.Connection { return d.connection }
+
+// Start turns the bulb on
+func (d *BulbDriver) Start() error {
+	return d.write(d.profile.On, Color{})
+}
+
+// Halt turns the bulb off
+func (d *BulbDriver) Halt() error {
+	return d.write(d.profile.Off, Color{})
+}
+
+// SetRGB sets the color of the bulb
+func (d *BulbDriver) SetRGB(r uint8, g uint8, b uint8) error {
+	return d.write(d.profile.Color, Color{Red: r, Green: g, Blue: b})
+}
+
+// GATTRequirements lists the service the profile writes to, when it names
+// one
+func (d *BulbDriver) GATTRequirements() []GATTRequirement {
+	if d.profile.Service == "" {
+		return nil
+	}
+	return []GATTRequirement{
+		{Service: d.profile.Service, Characteristics: []string{d.profile.Characteristic}},
+	}
+}
+
+func (d *BulbDriver) write(t ByteTemplate, c Color) error {
+	if t == "" {
+		return nil
+	}
+	buf, err := t.Render(c)
+	if err != nil {
+		return err
+	}
+	return d.Connection().(ble.BLEConnector).WriteCharacteristic(d.profile.Characteristic, buf)
+}
+
+// NewBulbAdapter connects to the configured bulb through the same Gobot
+// plumbing as the robots
+func NewBulbAdapter(cfg BulbConfig, discovery *Discovery, adapters *AdapterPool) (*gobotAdapter, error) {
+	profile, err := cfg.profile()
+	if err != nil {
+		return nil, err
+	}
+	// without anything else to go on, look for the profile's service
+	filter := cfg.DeviceFilter
+	if filter == (DeviceFilter{}) {
+		filter.Service = profile.Service
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	bleAdaptor := NewClientAdaptor(filter, discovery, adapters)
+	bleAdaptor.AdapterName = cfg.Adapter
+	bleAdaptor.Configure(cfg.Writes)
+	if err := bleAdaptor.Trace(cfg.Trace); err != nil {
+		return nil, err
+	}
+	driver := NewBulbDriver(bleAdaptor, profile)
+	bleAdaptor.Require(driver.GATTRequirements()...)
+	return newGobotAdapter("bulb", bleAdaptor, driver), nil
+}
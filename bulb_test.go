@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestByteTemplate(t *testing.T) {
+	tests := []struct {
+		template ByteTemplate
+		want     string
+		err      bool
+	}{
+		{"56 {r} {g} {b} 00 f0 aa", "56 01 02 03 00 f0 aa", false},
+		{"7E 00 05 03 {R} {G} {B} 00 EF", "7e 00 05 03 01 02 03 00 ef", false},
+		{"", "", false},
+		{"56 {x} aa", "", true},
+		{"5", "", true},
+		{"5600", "", true},
+	}
+	for _, tt := range tests {
+		got, err := tt.template.Render(Color{Red: 1, Green: 2, Blue: 3})
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.template)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.template, err)
+			continue
+		}
+		if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%q: got % x, want % x", tt.template, got, want)
+		}
+	}
+}
+
+func TestBulbProfiles(t *testing.T) {
+	for name := range bulbProfiles {
+		if _, err := (BulbConfig{Profile: name}).profile(); err != nil {
+			t.Errorf("built in profile %s: %v", name, err)
+		}
+	}
+
+	custom := BulbProfile{Characteristic: "fff3", Color: "7e {r} {g} {b} ef"}
+	tests := map[string]struct {
+		cfg BulbConfig
+		err bool
+	}{
+		"custom":              {BulbConfig{Profile: "mine", Profiles: map[string]BulbProfile{"mine": custom}}, false},
+		"custom over builtin": {BulbConfig{Profile: "triones", Profiles: map[string]BulbProfile{"triones": {Color: "00"}}}, true},
+		"unknown":             {BulbConfig{Profile: "nope"}, true},
+		"no color":            {BulbConfig{Profile: "x", Profiles: map[string]BulbProfile{"x": {Characteristic: "fff3"}}}, true},
+		"bad power command":   {BulbConfig{Profile: "x", Profiles: map[string]BulbProfile{"x": {Characteristic: "fff3", Color: "00", On: "zz"}}}, true},
+	}
+	for name, tt := range tests {
+		if _, err := tt.cfg.profile(); (err != nil) != tt.err {
+			t.Errorf("%s: got error %v", name, err)
+		}
+	}
+}
+
+func TestBulbDriverWrites(t *testing.T) {
+	conn := &writeRecorder{}
+	d := NewBulbDriver(conn, bulbProfiles["magicblue"])
+	d.Start()
+	d.SetRGB(0xFF, 0x80, 0)
+	d.Halt()
+
+	want := []string{"cc 23 33", "56 ff 80 00 00 f0 aa", "cc 24 33"}
+	if len(conn.writes) != len(want) {
+		t.Fatalf("got %d writes, want %d", len(conn.writes), len(want))
+	}
+	for i, w := range want {
+		if !bytes.Equal(conn.writes[i], unhex(t, w)) {
+			t.Errorf("write %d: got % x, want %s", i, conn.writes[i], w)
+		}
+	}
+
+	// profiles without power commands only send colors
+	conn.writes = nil
+	quiet := NewBulbDriver(conn, BulbProfile{Characteristic: "fff3", Color: "{r} {g} {b}"})
+	quiet.Start()
+	quiet.Halt()
+	if len(conn.writes) != 0 {
+		t.Errorf("sent % x without power commands", conn.writes)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	cloudEventsSpecVersion = "1.0"
+	cloudEventsMediaType   = "application/cloudevents+json"
+	cloudEventsBatchType   = "application/cloudevents-batch+json"
+	cloudEventsDedupSize   = 1024
+	cloudEventsMaxBody     = 1 << 20
+)
+
+// CloudEvent holds the attributes of a CloudEvents 1.0 event we care about
+type CloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// Validate checks the required context attributes
+func (e *CloudEvent) Validate() error {
+	if e.SpecVersion != cloudEventsSpecVersion {
+		return fmt.Errorf("unsupported specversion %q", e.SpecVersion)
+	}
+	if e.ID == "" {
+		return fmt.Errorf("missing required attribute id")
+	}
+	if e.Source == "" {
+		return fmt.Errorf("missing required attribute source")
+	}
+	if e.Type == "" {
+		return fmt.Errorf("missing required attribute type")
+	}
+	return nil
+}
+
+// Payload returns the event data, decoding data_base64 if needed
+func (e *CloudEvent) Payload() ([]byte, error) {
+	if e.DataBase64 != "" {
+		return base64.StdEncoding.DecodeString(e.DataBase64)
+	}
+	return e.Data, nil
+}
+
+// CloudEventRoute maps events matching Type and Source to an action.
+// Type and Source may contain '*' wildcards; an empty pattern matches
+// anything.
+//
+// Action "status" updates the status registry. The pipeline comes from
+// Pipeline, then the "pipeline" field of the event data, then the subject,
+// then the source. The status comes from Status, then the "status" field
+// of the event data.
+//
+// Action "plan" pushes Interval onto the plan, or the event data decoded
+// as an Interval when Interval is left empty.
+//
+// Action "motion" plays the choreography named by Motion on the robot.
+type CloudEventRoute struct {
+	Type     string   `json:"type"`
+	Source   string   `json:"source"`
+	Action   string   `json:"action"`
+	Pipeline string   `json:"pipeline,omitempty"`
+	Status   *Status  `json:"status,omitempty"`
+	Interval Interval `json:"interval,omitempty"`
+	Motion   string   `json:"motion,omitempty"`
+}
+
+type CloudEventsConfig struct {
+	Routes []CloudEventRoute `json:"routes"`
+}
+
+// DefaultCloudEventsConfig routes Tekton pipeline runs and the native
+// dev.gobot-ci.* event types.
+func DefaultCloudEventsConfig() CloudEventsConfig {
+	running, success, failure := StatusRunning, StatusSuccess, StatusFailure
+	return CloudEventsConfig{
+		Routes: []CloudEventRoute{
+			{Type: "dev.tekton.event.pipelinerun.started.*", Action: "status", Status: &running},
+			{Type: "dev.tekton.event.pipelinerun.running.*", Action: "status", Status: &running},
+			{Type: "dev.tekton.event.pipelinerun.successful.*", Action: "status", Status: &success},
+			{Type: "dev.tekton.event.pipelinerun.failed.*", Action: "status", Status: &failure},
+			{Type: "dev.gobot-ci.status", Action: "status"},
+			{Type: "dev.gobot-ci.interval", Action: "plan"},
+			{Type: "dev.gobot-ci.deploy", Action: "motion", Motion: "nod"},
+		},
+	}
+}
+
+// CloudEventsHandler accepts CloudEvents over HTTP in structured, batched
+// and binary content modes.
+type CloudEventsHandler struct {
+	routes   []CloudEventRoute
+	registry *StatusRegistry
+	plan     *Plan
+	motion   *Choreographer
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+	ring []string
+	next int
+}
+
+func NewCloudEventsHandler(cfg CloudEventsConfig, registry *StatusRegistry, plan *Plan) *CloudEventsHandler {
+	return &CloudEventsHandler{
+		routes:   cfg.Routes,
+		registry: registry,
+		plan:     plan,
+		seen:     make(map[string]struct{}),
+		ring:     make([]string, cloudEventsDedupSize),
+	}
+}
+
+// Choreograph lets "motion" routes play choreographies on c
+func (h *CloudEventsHandler) Choreograph(c *Choreographer) {
+	h.motion = c
+}
+
+func (h *CloudEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cloudEventsMaxBody)
+	events, batch, err := readCloudEvents(r)
+	if err != nil {
+		log.Println("Error parsing cloudevent", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, e := range events {
+		if err := e.Validate(); err != nil {
+			log.Println("Rejecting cloudevent", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	results := make([]CloudEventResult, len(events))
+	failed := false
+	for i, e := range events {
+		results[i] = CloudEventResult{ID: e.ID, Source: e.Source, Result: "accepted"}
+
+		dup, err := h.deliver(e)
+		switch {
+		case dup:
+			log.Println("skipping duplicate cloudevent", e.Source, e.ID)
+			results[i].Result = "duplicate"
+		case err != nil:
+			log.Println("Error routing cloudevent", e.Type, err)
+			results[i].Result, results[i].Error = "failed", err.Error()
+			failed = true
+		}
+	}
+
+	status := http.StatusAccepted
+	if failed {
+		status = http.StatusUnprocessableEntity
+	}
+	if !batch {
+		if failed {
+			http.Error(w, results[0].Error, status)
+			return
+		}
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// CloudEventResult reports what happened to one event of a batch. Result
+// is "accepted", "duplicate" or "failed".
+type CloudEventResult struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// readCloudEvents parses the events in a request, and whether they came
+// as a batch
+func readCloudEvents(r *http.Request) ([]CloudEvent, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case cloudEventsMediaType:
+		var e CloudEvent
+		err := json.NewDecoder(r.Body).Decode(&e)
+		return []CloudEvent{e}, false, err
+	case cloudEventsBatchType:
+		var batch []CloudEvent
+		err := json.NewDecoder(r.Body).Decode(&batch)
+		return batch, true, err
+	}
+
+	// binary content mode: attributes travel as ce- headers
+	if r.Header.Get("ce-specversion") == "" {
+		return nil, false, fmt.Errorf("not a cloudevent: no ce-specversion header and content type %q", mediaType)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	e := CloudEvent{
+		SpecVersion:     r.Header.Get("ce-specversion"),
+		ID:              r.Header.Get("ce-id"),
+		Source:          r.Header.Get("ce-source"),
+		Type:            r.Header.Get("ce-type"),
+		Subject:         r.Header.Get("ce-subject"),
+		Time:            r.Header.Get("ce-time"),
+		DataContentType: r.Header.Get("Content-Type"),
+	}
+	if len(body) > 0 {
+		if json.Valid(body) {
+			e.Data = body
+		} else {
+			e.DataBase64 = base64.StdEncoding.EncodeToString(body)
+		}
+	}
+	return []CloudEvent{e}, false, nil
+}
+
+// deliver routes the event unless it was already seen, and reports
+// whether it was a duplicate. Only routed events count as seen, so the
+// sender can retry the others with the same id. The lock is held while
+// routing, so two copies of an event arriving together can't both be
+// routed. The most recent cloudEventsDedupSize events are remembered.
+func (h *CloudEventsHandler) deliver(e CloudEvent) (bool, error) {
+	key := e.Source + "\x00" + e.ID
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.seen[key]; ok {
+		return true, nil
+	}
+	if err := h.route(e); err != nil {
+		return false, err
+	}
+
+	if old := h.ring[h.next]; old != "" {
+		delete(h.seen, old)
+	}
+	h.ring[h.next] = key
+	h.next = (h.next + 1) % len(h.ring)
+	h.seen[key] = struct{}{}
+	return false, nil
+}
+
+func (h *CloudEventsHandler) route(e CloudEvent) error {
+	for _, rt := range h.routes {
+		if !matchWildcard(rt.Type, e.Type) || !matchWildcard(rt.Source, e.Source) {
+			continue
+		}
+
+		data, err := e.Payload()
+		if err != nil {
+			return err
+		}
+
+		switch rt.Action {
+		case "status":
+			return h.routeStatus(rt, e, data)
+		case "plan":
+			return h.routePlan(rt, data)
+		case "motion":
+			return h.routeMotion(rt)
+		default:
+			return fmt.Errorf("unknown route action %q", rt.Action)
+		}
+	}
+
+	log.Println("no route for cloudevent", e.Type, e.Source)
+	return nil
+}
+
+func (h *CloudEventsHandler) routeStatus(rt CloudEventRoute, e CloudEvent, data []byte) error {
+	var payload struct {
+		Pipeline string  `json:"pipeline"`
+		Status   *Status `json:"status"`
+	}
+	if len(data) > 0 && json.Valid(data) {
+		if err := json.Unmarshal(data, &payload); err != nil {
+			log.Println("ignoring cloudevent data", err)
+		}
+	}
+
+	pipeline := firstNonEmpty(rt.Pipeline, payload.Pipeline, e.Subject, e.Source)
+
+	status := rt.Status
+	if status == nil {
+		status = payload.Status
+	}
+	if status == nil {
+		return fmt.Errorf("no status for %s", e.Type)
+	}
+
+	h.registry.Set(pipeline, *status, "cloudevents")
+	return nil
+}
+
+func (h *CloudEventsHandler) routePlan(rt CloudEventRoute, data []byte) error {
+	i := rt.Interval
+	if i == (Interval{}) {
+		if err := json.Unmarshal(data, &i); err != nil {
+			return err
+		}
+	}
+	if i.DurationMillis == 0 {
+		i.DurationMillis = 1000
+	}
+
+	log.Println("pushing", i)
+	h.plan.Push(i)
+	return nil
+}
+
+func (h *CloudEventsHandler) routeMotion(rt CloudEventRoute) error {
+	if h.motion == nil {
+		return fmt.Errorf("no robot to play %q on", rt.Motion)
+	}
+
+	go func() {
+		if err := h.motion.Play(rt.Motion); err != nil {
+			log.Println("error playing choreography", rt.Motion, err)
+		}
+	}()
+	return nil
+}
+
+// matchWildcard matches s against a pattern where '*' matches any run of
+// characters. An empty pattern matches everything.
+func matchWildcard(pattern, s string) bool {
+	if pattern == "" || pattern == "*" {
+		return true
+	}
+
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, pattern[:star]) {
+		return false
+	}
+
+	rest := pattern[star+1:]
+	for i := star; i <= len(s); i++ {
+		if matchWildcard(rest, s[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
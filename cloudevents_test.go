@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func postCloudEvents(t *testing.T, h http.Handler, contentType, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestCloudEventsRetryAfterFailure(t *testing.T) {
+	registry := NewStatusRegistry()
+	h := NewCloudEventsHandler(DefaultCloudEventsConfig(), registry, NewPlan())
+
+	// no status in the data, so routing fails
+	bad := `{"specversion":"1.0","id":"1","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"build"}}`
+	if w := postCloudEvents(t, h, cloudEventsMediaType, bad); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("failed event got %d, want 422", w.Code)
+	}
+
+	good := `{"specversion":"1.0","id":"1","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"build","status":"success"}}`
+	if w := postCloudEvents(t, h, cloudEventsMediaType, good); w.Code != http.StatusAccepted {
+		t.Fatalf("retry got %d, want 202", w.Code)
+	}
+	if ps, ok := registry.Get("build"); !ok || ps.Status != StatusSuccess {
+		t.Fatalf("retry wasn't applied: %+v", ps)
+	}
+
+	if w := postCloudEvents(t, h, cloudEventsMediaType, good); w.Code != http.StatusAccepted {
+		t.Fatalf("duplicate got %d, want 202", w.Code)
+	}
+}
+
+func TestCloudEventsBatchResults(t *testing.T) {
+	registry := NewStatusRegistry()
+	h := NewCloudEventsHandler(DefaultCloudEventsConfig(), registry, NewPlan())
+
+	batch := `[
+		{"specversion":"1.0","id":"a","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"a","status":"success"}},
+		{"specversion":"1.0","id":"b","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"b"}},
+		{"specversion":"1.0","id":"c","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"c","status":"failure"}},
+		{"specversion":"1.0","id":"a","source":"ci","type":"dev.gobot-ci.status","data":{"pipeline":"a","status":"success"}}
+	]`
+	w := postCloudEvents(t, h, cloudEventsBatchType, batch)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want 422", w.Code)
+	}
+
+	var results []CloudEventResult
+	if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"accepted", "failed", "accepted", "duplicate"}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, r := range results {
+		if r.Result != want[i] {
+			t.Errorf("event %s: got %s, want %s", r.ID, r.Result, want[i])
+		}
+	}
+	if _, ok := registry.Get("c"); !ok {
+		t.Error("event after the failure wasn't applied")
+	}
+}
+
+func TestCloudEventsSimultaneousDuplicates(t *testing.T) {
+	plan := NewPlan()
+	h := NewCloudEventsHandler(DefaultCloudEventsConfig(), NewStatusRegistry(), plan)
+
+	event := `{"specversion":"1.0","id":"1","source":"ci","type":"dev.gobot-ci.interval","data":{"duration":500,"r":255}}`
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			postCloudEvents(t, h, cloudEventsMediaType, event)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(plan.Intervals); n != 1 {
+		t.Errorf("event was routed %d times, want once", n)
+	}
+}
+
+func TestCloudEventsBodyLimit(t *testing.T) {
+	plan := NewPlan()
+	h := NewCloudEventsHandler(DefaultCloudEventsConfig(), NewStatusRegistry(), plan)
+
+	padding := strings.Repeat(" ", cloudEventsMaxBody)
+	event := `{"specversion":"1.0","id":"1","source":"ci","type":"dev.gobot-ci.interval",` + padding + `"data":{"duration":500}}`
+	if w := postCloudEvents(t, h, cloudEventsMediaType, event); w.Code != http.StatusBadRequest {
+		t.Errorf("oversized event got %d, want 400", w.Code)
+	}
+	if !plan.Empty() {
+		t.Error("oversized event was routed")
+	}
+}
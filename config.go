@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config is the on-disk configuration for gobot-ci. Every section is
+// optional; a missing file or section falls back to the defaults.
+type Config struct {
+	Listen      string            `json:"listen"`
+	CloudEvents CloudEventsConfig `json:"cloudevents"`
+	Alerts      AlertsConfig      `json:"alerts"`
+	Probes      []ProbeConfig     `json:"probes"`
+	Pollers     []PollerConfig    `json:"pollers"`
+	Relay       RelayConfig       `json:"relay"`
+	Robot       RobotConfig       `json:"robot"`
+	Matrix      MatrixConfig      `json:"matrix"`
+	Serial      SerialConfig      `json:"serial"`
+	Bulb        BulbConfig        `json:"bulb"`
+	Motion      MotionConfig      `json:"motion"`
+	Tap         TapConfig         `json:"tap"`
+	Escalation  EscalationConfig  `json:"escalation"`
+	Discovery   DiscoveryConfig   `json:"discovery"`
+	Adapters    AdaptersConfig    `json:"adapters"`
+	Queue       QueueConfig       `json:"queue"`
+	Power       PowerConfig       `json:"power"`
+}
+
+// RobotConfig describes the robot showing the status. Model is "bb8",
+// "mini" or "bolt" and the device filter picks it out of a BLE scan. With
+// Macros set, idle patterns are uploaded to the robot as macros instead
+// of being streamed one color at a time. Adapter names the Bluetooth
+// controller to prefer, such as "hci1", Writes tunes how commands are
+// sent and Trace records the traffic.
+type RobotConfig struct {
+	Model string `json:"model"`
+	DeviceFilter
+	Macros  bool        `json:"macros"`
+	Adapter string      `json:"adapter,omitempty"`
+	Writes  WriteConfig `json:"writes"`
+	Trace   TraceConfig `json:"trace"`
+}
+
+// DefaultConfig returns the configuration used when no file is given
+func DefaultConfig() Config {
+	return Config{
+		Listen:      ":3000",
+		CloudEvents: DefaultCloudEventsConfig(),
+		Alerts:      DefaultAlertsConfig(),
+		Robot:       RobotConfig{Writes: DefaultWriteConfig()},
+		Matrix:      DefaultMatrixConfig(),
+		Bulb:        BulbConfig{Writes: DefaultWriteConfig()},
+		Motion:      DefaultMotionConfig(),
+		Tap:         DefaultTapConfig(),
+		Escalation:  DefaultEscalationConfig(),
+		Discovery:   DefaultDiscoveryConfig(),
+		Adapters:    DefaultAdaptersConfig(),
+		Queue:       DefaultQueueConfig(),
+		Power:       DefaultPowerConfig(),
+	}
+}
+
+// LoadConfig reads a JSON config file on top of the defaults. An empty
+// path returns the defaults unchanged.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return cfg, errors.Wrap(err, "can't open config")
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&cfg)
+	if err != nil {
+		return cfg, errors.Wrap(err, "can't parse config "+path)
+	}
+	return cfg, nil
+}
+
+// Duration is a time.Duration written as a string like "30s" in config
+type Duration time.Duration
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Or returns d, or def when d is unset
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/logiraptor/gobot-ci/spherov1"
+)
+
+// v1Decoder turns a stream of v1 packets into readable lines, naming
+// responses after the command with the same sequence number
+type v1Decoder struct {
+	out      io.Writer
+	commands map[byte]spherov1.Packet
+}
+
+func newV1Decoder(out io.Writer) *v1Decoder {
+	return &v1Decoder{out: out, commands: make(map[byte]spherov1.Packet)}
+}
+
+// decode prints every packet in buf. fromRobot picks between commands
+// and replies, which can't be told apart by their framing. Bytes that
+// don't frame a packet are reported and skipped up to the next SOP.
+func (d *v1Decoder) decode(prefix string, buf []byte, fromRobot bool) {
+	for len(buf) > 0 {
+		var p spherov1.Packet
+		var n int
+		var err error
+		if fromRobot {
+			p, n, err = spherov1.DecodeReply(buf)
+		} else {
+			p, n, err = spherov1.DecodeCommand(buf)
+		}
+		if err != nil {
+			skip := 1
+			for skip < len(buf) && buf[skip] != spherov1.SOP1 {
+				skip++
+			}
+			fmt.Fprintf(d.out, "%s%s: %s\n", prefix, hex.EncodeToString(buf[:skip]), err)
+			buf = buf[skip:]
+			continue
+		}
+		buf = buf[n:]
+
+		line := p.String()
+		switch p.Kind {
+		case spherov1.Command:
+			d.commands[p.Seq] = p
+		case spherov1.Response:
+			if cmd, ok := d.commands[p.Seq]; ok {
+				line += " to " + spherov1.CommandName(cmd.DeviceID, cmd.CommandID)
+				if fields := spherov1.DescribeResponse(p, cmd.DeviceID, cmd.CommandID); fields != "" {
+					line += " " + fields
+				}
+				delete(d.commands, p.Seq)
+			}
+		}
+		fmt.Fprintf(d.out, "%s%s\n", prefix, line)
+	}
+}
+
+// decodeTrace prints recorded GATT operations. Only the ollie commands
+// and responses carry v1 packets; anything else, such as a bulb or a v2
+// robot, is printed as raw hex.
+func (d *v1Decoder) decodeTrace(recs []TraceRecord) {
+	commands := convertUUID(ollieCommandsCharacteristic)
+	responses := convertUUID(ollieResponseCharacteristic)
+	for _, rec := range recs {
+		prefix := fmt.Sprintf("%s %-6s ", rec.Time.Format("15:04:05.000"), rec.Op)
+		switch {
+		case rec.Err != "":
+			fmt.Fprintf(d.out, "%serror: %s\n", prefix, rec.Err)
+		case rec.Characteristic == commands:
+			d.decode(prefix, rec.Data, false)
+		case rec.Characteristic == responses:
+			d.decode(prefix, rec.Data, true)
+		default:
+			fmt.Fprintf(d.out, "%s%s % x\n", prefix, rec.Characteristic, []byte(rec.Data))
+		}
+	}
+}
+
+// runDecode is the decode subcommand: gobot-ci decode [flags] [hex...]
+func runDecode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	from := fs.String("from", "host", "who sent the hex packets, host or robot")
+	trace := fs.String("trace", "", "decode a recorded JSONL trace instead")
+	fs.Parse(args)
+
+	d := newV1Decoder(os.Stdout)
+	if *trace != "" {
+		f, err := os.Open(*trace)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		recs, err := LoadTrace(f)
+		if err != nil {
+			return err
+		}
+		d.decodeTrace(recs)
+		return nil
+	}
+
+	if *from != "host" && *from != "robot" {
+		return fmt.Errorf("-from must be host or robot, not %q", *from)
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("nothing to decode")
+	}
+	for _, arg := range fs.Args() {
+		buf, err := hex.DecodeString(strings.NewReplacer(" ", "", ":", "").Replace(arg))
+		if err != nil {
+			return fmt.Errorf("%q isn't hex: %v", arg, err)
+		}
+		d.decode("", buf, *from == "robot")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logiraptor/gobot-ci/spherov1"
+)
+
+func TestDecodeTrace(t *testing.T) {
+	encode := func(p spherov1.Packet) HexBytes {
+		buf, err := p.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	setRGB := encode(spherov1.Packet{Kind: spherov1.Command, Answer: true, DeviceID: 0x02, CommandID: cidSetRGB, Seq: 7, Data: []byte{0xFF, 0, 0, 0}})
+	ok := encode(spherov1.Packet{Kind: spherov1.Response, Seq: 7})
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	recs := []TraceRecord{
+		{Time: at, Op: TraceWrite, Characteristic: convertUUID(ollieCommandsCharacteristic), Data: setRGB},
+		{Time: at, Op: TraceNotify, Characteristic: convertUUID(ollieResponseCharacteristic), Data: ok},
+		// the same bytes written to a bulb aren't a v1 command
+		{Time: at, Op: TraceWrite, Characteristic: convertUUID("fff3"), Data: setRGB},
+		{Time: at, Op: TraceWrite, Characteristic: convertUUID("fff3"), Err: "timed out"},
+	}
+
+	var out bytes.Buffer
+	newV1Decoder(&out).decodeTrace(recs)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("got %d lines:\n%s", len(lines), out.String())
+	}
+
+	for i, want := range []string{
+		"03:04:05.000 write  command " + spherov1.CommandName(0x02, cidSetRGB) + " seq=7",
+		"03:04:05.000 notify response",
+		"03:04:05.000 write  0000fff3-0000-1000-8000-00805f9b34fb ff ff 02 20 07 05 ff 00 00 00",
+		"03:04:05.000 write  error: timed out",
+	} {
+		if !strings.HasPrefix(lines[i], want) {
+			t.Errorf("line %d: got %q, want it to start with %q", i, lines[i], want)
+		}
+	}
+	if !strings.Contains(lines[1], "to "+spherov1.CommandName(0x02, cidSetRGB)) {
+		t.Errorf("response not matched to its command: %q", lines[1])
+	}
+}
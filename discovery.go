@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// DeviceFilter selects which BLE device to connect to. Every field that
+// is set has to match. Service is a 16 or 128 bit UUID the device has to
+// advertise, and MinRSSI ignores devices with a weaker signal.
+type DeviceFilter struct {
+	Address    string `json:"address,omitempty"`
+	Name       string `json:"name,omitempty"`
+	NamePrefix string `json:"namePrefix,omitempty"`
+	Service    string `json:"service,omitempty"`
+	MinRSSI    int16  `json:"minRSSI,omitempty"`
+}
+
+func (f DeviceFilter) String() string {
+	var parts []string
+	for _, kv := range [][2]string{
+		{"address", f.Address},
+		{"name", f.Name},
+		{"prefix", f.NamePrefix},
+		{"service", f.Service},
+	} {
+		if kv[1] != "" {
+			parts = append(parts, kv[0]+"="+kv[1])
+		}
+	}
+	if f.MinRSSI != 0 {
+		parts = append(parts, fmt.Sprintf("rssi>=%d", f.MinRSSI))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Validate checks the filter selects something and its service parses
+func (f DeviceFilter) Validate() error {
+	if f.Address == "" && f.Name == "" && f.NamePrefix == "" && f.Service == "" {
+		return fmt.Errorf("device filter needs an address, name, name prefix or service")
+	}
+	if f.Service != "" {
+		if _, err := parseBLEUUID(f.Service); err != nil {
+			return fmt.Errorf("bad service UUID %q in device filter", f.Service)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a scan result passes the filter
+func (f DeviceFilter) matches(result bluetooth.ScanResult) bool {
+	if f.Address != "" && !strings.EqualFold(f.Address, result.Address.String()) {
+		return false
+	}
+	if f.Name != "" && result.LocalName() != f.Name {
+		return false
+	}
+	if f.NamePrefix != "" && !strings.HasPrefix(result.LocalName(), f.NamePrefix) {
+		return false
+	}
+	if f.Service != "" {
+		uuid, err := parseBLEUUID(f.Service)
+		if err != nil || !result.HasServiceUUID(uuid) {
+			return false
+		}
+	}
+	return f.MinRSSI == 0 || result.RSSI >= f.MinRSSI
+}
+
+// parseBLEUUID parses a 16 bit UUID such as "ffe5" or a 128 bit one with
+// or without dashes
+func parseBLEUUID(s string) (bluetooth.UUID, error) {
+	if len(s) == 4 {
+		short, err := strconv.ParseUint(s, 16, 16)
+		if err != nil {
+			return bluetooth.UUID{}, err
+		}
+		return bluetooth.New16BitUUID(uint16(short)), nil
+	}
+	return bluetooth.ParseUUID(strings.ToLower(convertUUID(s)))
+}
+
+// DiscoveryConfig bounds scanning. A scan gives up after Timeout, and
+// keeps going for Settle after the first match in case a stronger one
+// shows up.
+type DiscoveryConfig struct {
+	Timeout Duration `json:"timeout"`
+	Settle  Duration `json:"settle"`
+}
+
+func DefaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		Timeout: Duration(30 * time.Second),
+		Settle:  Duration(2 * time.Second),
+	}
+}
+
+// ScanRecord is one device seen by the last scan
+type ScanRecord struct {
+	Address string    `json:"address"`
+	Name    string    `json:"name,omitempty"`
+	RSSI    int16     `json:"rssi"`
+	Matched bool      `json:"matched"`
+	Seen    time.Time `json:"seen"`
+}
+
+// Discovery finds BLE devices and remembers where they were and what
+// services they have, so that reconnecting skips the scan
+type Discovery struct {
+	cfg DiscoveryConfig
+
+	mu      sync.Mutex
+	scanned map[string]ScanRecord
+	cache   map[DeviceFilter]bluetooth.Addresser
+	layouts map[string]GATTLayout
+}
+
+func NewDiscovery(cfg DiscoveryConfig) *Discovery {
+	return &Discovery{
+		cfg:     cfg,
+		scanned: make(map[string]ScanRecord),
+		cache:   make(map[DeviceFilter]bluetooth.Addresser),
+		layouts: make(map[string]GATTLayout),
+	}
+}
+
+// Cached returns the last address found for the filter
+func (d *Discovery) Cached(f DeviceFilter) (bluetooth.Addresser, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	addr, ok := d.cache[f]
+	return addr, ok
+}
+
+// Forget drops the cached address for the filter, for example after
+// connecting to it failed
+func (d *Discovery) Forget(f DeviceFilter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.cache, f)
+}
+
+// Layout returns the services found on the device at address last time
+func (d *Discovery) Layout(address string) (GATTLayout, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	layout, ok := d.layouts[address]
+	return layout, ok
+}
+
+// LayoutCovering returns the layout cached for address if it has everything
+// in want, and forgets it if it doesn't
+func (d *Discovery) LayoutCovering(address string, want GATTLayout) (GATTLayout, bool) {
+	layout, ok := d.Layout(address)
+	if !ok {
+		return nil, false
+	}
+	if !layout.covers(want) {
+		log.Println("cached gatt layout for", address, "lacks what the driver needs")
+		d.ForgetLayout(address)
+		return nil, false
+	}
+	return layout, true
+}
+
+// StoreLayout remembers the services found on the device at address
+func (d *Discovery) StoreLayout(address string, layout GATTLayout) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.layouts[address] = layout
+}
+
+// ForgetLayout drops the services remembered for the device at address
+func (d *Discovery) ForgetLayout(address string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.layouts, address)
+}
+
+// Find scans for the strongest device matching the filter
+func (d *Discovery) Find(adapter *bluetooth.Adapter, f DeviceFilter) (bluetooth.Addresser, error) {
+	d.mu.Lock()
+	d.scanned = make(map[string]ScanRecord)
+	d.mu.Unlock()
+
+	// the advertisement payload isn't valid after the callback, so the
+	// best match is copied out
+	var (
+		mu       sync.Mutex
+		found    bool
+		best     bluetooth.Addresser
+		bestName string
+		bestRSSI int16
+		matched  = make(chan struct{})
+	)
+
+	log.Println("scanning for", f)
+	done := make(chan error, 1)
+	go func() {
+		done <- adapter.Scan(func(_ *bluetooth.Adapter, result bluetooth.ScanResult) {
+			ok := f.matches(result)
+			d.record(result, ok)
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !found {
+				close(matched)
+			}
+			if !found || result.RSSI > bestRSSI {
+				found, best, bestName, bestRSSI = true, result.Address, result.LocalName(), result.RSSI
+			}
+		})
+	}()
+
+	timeout := time.NewTimer(d.cfg.Timeout.Or(30 * time.Second))
+	defer timeout.Stop()
+	var settle <-chan time.Time
+
+wait:
+	for {
+		select {
+		case err := <-done:
+			if err == nil {
+				err = fmt.Errorf("scan stopped before finding %s", f)
+			}
+			return nil, err
+		case <-matched:
+			matched = nil
+			settle = time.After(d.cfg.Settle.Or(2 * time.Second))
+		case <-settle:
+			break wait
+		case <-timeout.C:
+			break wait
+		}
+	}
+	adapter.StopScan()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("no device matching %s found within %s", f, d.cfg.Timeout.Or(30*time.Second))
+	}
+
+	log.Println("found", bestName, best.String(), "with rssi", bestRSSI)
+	d.mu.Lock()
+	d.cache[f] = best
+	d.mu.Unlock()
+	return best, nil
+}
+
+func (d *Discovery) record(result bluetooth.ScanResult, matched bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	addr := result.Address.String()
+	d.scanned[addr] = ScanRecord{
+		Address: addr,
+		Name:    result.LocalName(),
+		RSSI:    result.RSSI,
+		Matched: matched || d.scanned[addr].Matched,
+		Seen:    time.Now(),
+	}
+}
+
+// ServeHTTP lists the devices seen by the last scan, strongest first, the
+// cached addresses and the services found on connected devices
+func (d *Discovery) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	d.mu.Lock()
+	scanned := make([]ScanRecord, 0, len(d.scanned))
+	for _, rec := range d.scanned {
+		scanned = append(scanned, rec)
+	}
+	cached := make(map[string]string, len(d.cache))
+	for f, addr := range d.cache {
+		cached[f.String()] = addr.String()
+	}
+	layouts := make(map[string]GATTLayout, len(d.layouts))
+	for addr, layout := range d.layouts {
+		layouts[addr] = layout
+	}
+	d.mu.Unlock()
+
+	sort.Slice(scanned, func(i, j int) bool { return scanned[i].RSSI > scanned[j].RSSI })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Scanned []ScanRecord          `json:"scanned"`
+		Cached  map[string]string     `json:"cached"`
+		Layouts map[string]GATTLayout `json:"layouts"`
+	}{scanned, cached, layouts})
+}
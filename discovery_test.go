@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// testAddress is a fixed BLE address
+type testAddress string
+
+func (a testAddress) String() string { return string(a) }
+func (a testAddress) Set(string)     {}
+func (a testAddress) SetRandom(bool) {}
+func (a testAddress) IsRandom() bool { return false }
+
+// testAdvertisement is an advertisement with a name and services
+type testAdvertisement struct {
+	name     string
+	services []bluetooth.UUID
+}
+
+func (a testAdvertisement) LocalName() string { return a.name }
+func (a testAdvertisement) Bytes() []byte     { return nil }
+
+func (a testAdvertisement) HasServiceUUID(uuid bluetooth.UUID) bool {
+	for _, s := range a.services {
+		if s == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDeviceFilterMatches(t *testing.T) {
+	bb8 := bluetooth.ScanResult{
+		Address: testAddress("C4:0D:A1:B2:C3:D4"),
+		RSSI:    -60,
+		AdvertisementPayload: testAdvertisement{
+			name:     "BB-A1B2",
+			services: []bluetooth.UUID{bluetooth.New16BitUUID(0xffe5)},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		filter DeviceFilter
+		want   bool
+	}{
+		{"address", DeviceFilter{Address: "c4:0d:a1:b2:c3:d4"}, true},
+		{"other address", DeviceFilter{Address: "C4:0D:A1:B2:C3:D5"}, false},
+		{"name", DeviceFilter{Name: "BB-A1B2"}, true},
+		{"name is exact", DeviceFilter{Name: "BB-A1"}, false},
+		{"prefix", DeviceFilter{NamePrefix: "BB-"}, true},
+		{"other prefix", DeviceFilter{NamePrefix: "SM-"}, false},
+		{"short service", DeviceFilter{Service: "ffe5"}, true},
+		{"long service", DeviceFilter{Service: "0000ffe5-0000-1000-8000-00805f9b34fb"}, true},
+		{"missing service", DeviceFilter{Service: "ffe9"}, false},
+		{"strong enough", DeviceFilter{NamePrefix: "BB-", MinRSSI: -70}, true},
+		{"just strong enough", DeviceFilter{NamePrefix: "BB-", MinRSSI: -60}, true},
+		{"too weak", DeviceFilter{NamePrefix: "BB-", MinRSSI: -50}, false},
+		{"all of them", DeviceFilter{Address: "C4:0D:A1:B2:C3:D4", NamePrefix: "BB-", Service: "ffe5", MinRSSI: -90}, true},
+		{"one fails", DeviceFilter{Address: "C4:0D:A1:B2:C3:D4", NamePrefix: "SM-"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matches(bb8); got != tt.want {
+			t.Errorf("%s: matched %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDeviceFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter DeviceFilter
+		ok     bool
+	}{
+		{DeviceFilter{NamePrefix: "BB-"}, true},
+		{DeviceFilter{Service: "22bb746f-2ba0-7554-2d6f-726568705327"}, true},
+		{DeviceFilter{}, false},
+		{DeviceFilter{MinRSSI: -70}, false},
+		{DeviceFilter{Service: "not a uuid"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: got error %v", tt.filter, err)
+		}
+	}
+
+	f := DeviceFilter{NamePrefix: "BB-", MinRSSI: -70}
+	if s := f.String(); s != "prefix=BB- rssi>=-70" {
+		t.Errorf("got %q", s)
+	}
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	d := NewDiscovery(DefaultDiscoveryConfig())
+	f := DeviceFilter{NamePrefix: "BB-"}
+	d.record(bluetooth.ScanResult{Address: testAddress("aa"), RSSI: -40, AdvertisementPayload: testAdvertisement{name: "BB-1"}}, true)
+	d.record(bluetooth.ScanResult{Address: testAddress("aa"), RSSI: -80, AdvertisementPayload: testAdvertisement{name: "BB-1"}}, false)
+	if rec := d.scanned["aa"]; !rec.Matched || rec.RSSI != -80 {
+		t.Errorf("scan record %+v, want the latest rssi and still matched", rec)
+	}
+
+	if _, ok := d.Cached(f); ok {
+		t.Fatal("cached before anything was found")
+	}
+	d.cache[f] = testAddress("aa")
+	if addr, ok := d.Cached(f); !ok || addr.String() != "aa" {
+		t.Errorf("cached %v", addr)
+	}
+	d.Forget(f)
+	if _, ok := d.Cached(f); ok {
+		t.Error("still cached after Forget")
+	}
+}
+
+func TestDiscoveryLayoutCovering(t *testing.T) {
+	want, err := requiredLayout(ollieGATT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := make(GATTLayout)
+	for service, chars := range want {
+		full[service] = append(append([]string(nil), chars...), "0000ffe1-0000-1000-8000-00805f9b34fb")
+	}
+	missing := make(GATTLayout)
+	for service, chars := range want {
+		missing[service] = chars[:len(chars)-1]
+	}
+
+	tests := []struct {
+		name   string
+		cached GATTLayout
+		want   GATTLayout
+		hit    bool
+	}{
+		{"nothing cached", nil, want, false},
+		{"exactly what's needed", want, want, true},
+		{"more than needed", full, want, true},
+		{"nothing needed", full, GATTLayout{}, true},
+		{"stale characteristic", missing, want, false},
+		{"stale service", GATTLayout{"0000ffe0-0000-1000-8000-00805f9b34fb": nil}, want, false},
+	}
+	for _, tt := range tests {
+		d := NewDiscovery(DefaultDiscoveryConfig())
+		if tt.cached != nil {
+			d.StoreLayout("aa", tt.cached)
+		}
+		layout, ok := d.LayoutCovering("aa", tt.want)
+		if ok != tt.hit {
+			t.Errorf("%s: hit %v, want %v", tt.name, ok, tt.hit)
+			continue
+		}
+		if ok && !reflect.DeepEqual(layout, tt.cached) {
+			t.Errorf("%s: got %v, want the cached layout", tt.name, layout)
+		}
+		if _, kept := d.Layout("aa"); kept != tt.hit {
+			t.Errorf("%s: cached layout kept %v", tt.name, kept)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// PatternSource supplies the idle pattern. ok is false when the source
+// has nothing to show and the next source should be asked.
+type PatternSource interface {
+	Pattern() (p Pattern, ok bool)
+}
+
+// PatternPlayer can run a whole pattern on the light by itself
+type PatternPlayer interface {
+	PlayPattern(p Pattern) error
+	StopPattern()
+}
+
+// Display decides what the light shows. Intervals pushed onto the plan
+// always play first; when the plan is empty the first source with
+// something to say loops its pattern.
+type Display struct {
+	plan    *Plan
+	sources []PatternSource
+	player  PatternPlayer
+	wake    chan struct{}
+}
+
+func NewDisplay(plan *Plan, sources ...PatternSource) *Display {
+	return &Display{
+		plan:    plan,
+		sources: sources,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Watch makes the display re-evaluate its sources whenever changed fires
+func (d *Display) Watch(changed <-chan struct{}) {
+	go func() {
+		for range changed {
+			select {
+			case d.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// Offload hands animated idle patterns to player instead of streaming
+// them step by step
+func (d *Display) Offload(player PatternPlayer) {
+	d.player = player
+}
+
+func (d *Display) idle() Pattern {
+	for _, src := range d.sources {
+		if p, ok := src.Pattern(); ok && len(p) > 0 {
+			return p
+		}
+	}
+	return Steady(Color{})
+}
+
+// Run sends the colors to show on colors forever
+func (d *Display) Run(colors chan<- Color) {
+	var pattern Pattern
+	step := 0
+	offloaded := false
+
+	for {
+		if pattern == nil {
+			pattern = d.idle()
+			step = 0
+		}
+
+		c, dur := pattern[step].Split()
+		colors <- c
+
+		if step == 0 && len(pattern) > 1 && d.player != nil {
+			err := d.player.PlayPattern(pattern)
+			if err != nil {
+				log.Println("streaming pattern instead of offloading it:", err)
+			} else {
+				offloaded = true
+				dur = patternLength(pattern) * macroPatternLoops
+			}
+		}
+		timer := time.NewTimer(dur)
+
+		select {
+		case interval := <-d.plan.Intervals:
+			timer.Stop()
+			d.stopOffload(&offloaded)
+			for {
+				currentColor, dur := interval.Split()
+				log.Println("popped", currentColor, dur)
+				colors <- currentColor
+				<-time.After(dur)
+
+				if d.plan.Empty() {
+					break
+				}
+				interval = <-d.plan.Intervals
+			}
+			pattern = nil
+		case <-d.wake:
+			timer.Stop()
+			d.stopOffload(&offloaded)
+			pattern = nil
+		case <-timer.C:
+			if offloaded {
+				offloaded = false
+				pattern = nil
+				continue
+			}
+			step = (step + 1) % len(pattern)
+		}
+	}
+}
+
+func (d *Display) stopOffload(offloaded *bool) {
+	if *offloaded {
+		d.player.StopPattern()
+		*offloaded = false
+	}
+}
+
+func patternLength(p Pattern) time.Duration {
+	var total time.Duration
+	for _, step := range p {
+		_, dur := step.Split()
+		total += dur
+	}
+	return total
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EscalationStage is how an unacknowledged failure is shown once it has
+// needed attention for After. Motion, if set, is played once on entering
+// the stage.
+type EscalationStage struct {
+	After   Duration     `json:"after"`
+	Pattern PatternStyle `json:"pattern"`
+	Motion  string       `json:"motion,omitempty"`
+}
+
+// EscalationConfig lists the stages in order of After
+type EscalationConfig struct {
+	Stages []EscalationStage `json:"stages"`
+}
+
+func DefaultEscalationConfig() EscalationConfig {
+	return EscalationConfig{
+		Stages: []EscalationStage{
+			{Pattern: StyleSteady},
+			{After: Duration(15 * time.Minute), Pattern: StylePulse},
+			{After: Duration(45 * time.Minute), Pattern: StyleStrobe, Motion: "wiggle"},
+		},
+	}
+}
+
+// Escalator shows the most severe pipeline like the registry does, but
+// gets louder the longer a failure goes unacknowledged
+type Escalator struct {
+	cfg      EscalationConfig
+	registry *StatusRegistry
+	motion   *Choreographer
+	changed  chan struct{}
+
+	mu    sync.Mutex
+	shown escalation
+}
+
+// escalation identifies a stage of one failure, so each is entered once
+type escalation struct {
+	pipeline string
+	since    time.Time
+	stage    int
+}
+
+// NewEscalator checks the stages are in order of After
+func NewEscalator(cfg EscalationConfig, registry *StatusRegistry, motion *Choreographer) (*Escalator, error) {
+	for i := 1; i < len(cfg.Stages); i++ {
+		if cfg.Stages[i].After <= cfg.Stages[i-1].After {
+			return nil, fmt.Errorf("escalation stage %d after %s isn't later than the one before", i, time.Duration(cfg.Stages[i].After))
+		}
+	}
+	return &Escalator{
+		cfg:      cfg,
+		registry: registry,
+		motion:   motion,
+		changed:  make(chan struct{}, 1),
+		shown:    escalation{stage: -1},
+	}, nil
+}
+
+// current returns the escalation of the most severe pipeline. ok is false
+// unless that is an unacknowledged failure without its own pattern that
+// has reached the first stage.
+func (e *Escalator) current(now time.Time) (ps PipelineStatus, esc escalation, ok bool) {
+	ps, ok = e.registry.Worst()
+	if !ok || ps.Status != StatusFailure || ps.Acknowledged() || ps.Pattern != nil {
+		return ps, escalation{stage: -1}, false
+	}
+
+	esc = escalation{pipeline: ps.Pipeline, since: ps.AttentionSince(), stage: -1}
+	for i, stage := range e.cfg.Stages {
+		if now.Sub(esc.since) >= time.Duration(stage.After) {
+			esc.stage = i
+		}
+	}
+	return ps, esc, esc.stage >= 0
+}
+
+// Pattern implements PatternSource
+func (e *Escalator) Pattern() (Pattern, bool) {
+	ps, esc, ok := e.current(time.Now())
+	if !ok {
+		return e.registry.Pattern()
+	}
+	return e.cfg.Stages[esc.stage].Pattern.Pattern(ps.Status.Color()), true
+}
+
+// Changed fires when a failure moves to another stage
+func (e *Escalator) Changed() <-chan struct{} {
+	return e.changed
+}
+
+// Run checks for failures entering a new stage until the process exits
+func (e *Escalator) Run() {
+	changed := e.registry.Changed()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		e.check()
+		select {
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *Escalator) check() {
+	_, esc, ok := e.current(time.Now())
+
+	e.mu.Lock()
+	prev := e.shown
+	e.shown = esc
+	e.mu.Unlock()
+
+	if !ok || esc == prev {
+		return
+	}
+
+	// a new failure changes the registry already
+	stage := e.cfg.Stages[esc.stage]
+	if esc.pipeline == prev.pipeline && esc.since == prev.since {
+		log.Println("escalating", esc.pipeline, "to", stage.Pattern)
+		select {
+		case e.changed <- struct{}{}:
+		default:
+		}
+	}
+	if stage.Motion != "" && e.motion != nil {
+		go func() {
+			if err := e.motion.Play(stage.Motion); err != nil {
+				log.Println("error playing choreography", stage.Motion, err)
+			}
+		}()
+	}
+}
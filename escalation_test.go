@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEscalationConfig() EscalationConfig {
+	return EscalationConfig{
+		Stages: []EscalationStage{
+			{After: Duration(5 * time.Minute), Pattern: StyleSteady},
+			{After: Duration(15 * time.Minute), Pattern: StylePulse},
+			{After: Duration(45 * time.Minute), Pattern: StyleStrobe},
+		},
+	}
+}
+
+func TestEscalationStages(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		ack     bool
+		stage   int
+	}{
+		{"just failed", 0, false, -1},
+		{"before the first stage", 4 * time.Minute, false, -1},
+		{"first stage", 5 * time.Minute, false, 0},
+		{"second stage", 20 * time.Minute, false, 1},
+		{"last stage", 3 * time.Hour, false, 2},
+		{"acknowledged", 3 * time.Hour, true, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewStatusRegistry()
+			registry.Set("build", StatusFailure, "ci")
+			if tt.ack {
+				registry.Acknowledge("build", Acknowledgment{At: time.Now(), By: "test"})
+			}
+			e, err := NewEscalator(testEscalationConfig(), registry, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, esc, ok := e.current(time.Now().Add(tt.elapsed))
+			if ok != (tt.stage >= 0) || esc.stage != tt.stage {
+				t.Errorf("stage %d (ok %v), want %d", esc.stage, ok, tt.stage)
+			}
+		})
+	}
+}
+
+func TestEscalationRestartsAfterSnooze(t *testing.T) {
+	registry := NewStatusRegistry()
+	registry.Set("build", StatusFailure, "ci")
+	until := time.Now().Add(10 * time.Millisecond)
+	registry.Acknowledge("build", Acknowledgment{At: time.Now(), By: "test", Until: &until})
+	e, err := NewEscalator(testEscalationConfig(), registry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, ok := e.current(time.Now().Add(time.Hour)); ok {
+		t.Error("escalated a snoozed failure")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the clock starts over when the snooze runs out
+	if _, esc, _ := e.current(until.Add(10 * time.Minute)); esc.stage != 0 {
+		t.Errorf("10 minutes after the snooze: stage %d, want 0", esc.stage)
+	}
+	if _, esc, _ := e.current(until.Add(20 * time.Minute)); esc.stage != 1 {
+		t.Errorf("20 minutes after the snooze: stage %d, want 1", esc.stage)
+	}
+}
+
+func TestEscalationChangesOnlyWhenEscalating(t *testing.T) {
+	registry := NewStatusRegistry()
+	e, err := NewEscalator(EscalationConfig{Stages: []EscalationStage{
+		{Pattern: StyleSteady},
+		{After: Duration(30 * time.Millisecond), Pattern: StylePulse},
+	}}, registry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := func() bool {
+		select {
+		case <-e.Changed():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// the registry announces a new failure itself
+	registry.Set("build", StatusFailure, "ci")
+	e.check()
+	if changed() {
+		t.Error("changed on a new failure")
+	}
+	e.check()
+	if changed() {
+		t.Error("changed without a new stage")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	e.check()
+	if !changed() {
+		t.Error("no change on escalating")
+	}
+}
+
+func TestEscalationStagesInOrder(t *testing.T) {
+	configs := map[string][]EscalationStage{
+		"backwards": {{After: Duration(time.Hour)}, {After: Duration(time.Minute)}},
+		"same time": {{After: Duration(time.Minute)}, {After: Duration(time.Minute)}},
+	}
+	for name, stages := range configs {
+		if _, err := NewEscalator(EscalationConfig{Stages: stages}, NewStatusRegistry(), nil); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := NewEscalator(DefaultEscalationConfig(), NewStatusRegistry(), nil); err != nil {
+		t.Errorf("default stages: %v", err)
+	}
+}
+
+func TestAckHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   int
+		kind   string
+	}{
+		{"acknowledge worst", http.MethodPost, "/acks", `{"by":"sam"}`, http.StatusOK, "acknowledged"},
+		{"nothing left", http.MethodPost, "/acks", `{"by":"sam"}`, http.StatusConflict, ""},
+		{"snooze", http.MethodPost, "/acks", `{"pipeline":"build","snooze":"1h"}`, http.StatusOK, "snoozed"},
+		{"unknown pipeline", http.MethodPost, "/acks", `{"pipeline":"lint"}`, http.StatusConflict, ""},
+		{"clear", http.MethodDelete, "/acks?pipeline=build", ``, http.StatusNoContent, "unacknowledged"},
+		{"clear again", http.MethodDelete, "/acks?pipeline=build", ``, http.StatusNotFound, ""},
+		{"bad body", http.MethodPost, "/acks", `{`, http.StatusBadRequest, ""},
+	}
+
+	registry := NewStatusRegistry()
+	registry.Set("build", StatusFailure, "ci")
+	history := NewHistory(10)
+	h := AckHandler(registry, history)
+	for _, tt := range tests {
+		before := len(history.Events())
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+		events := history.Events()
+		switch {
+		case tt.kind == "" && len(events) != before:
+			t.Errorf("%s: recorded %+v", tt.name, events[before:])
+		case tt.kind != "" && (len(events) != before+1 || events[before].Kind != tt.kind):
+			t.Errorf("%s: history %+v, want %s", tt.name, events[before:], tt.kind)
+		}
+	}
+}
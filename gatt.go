@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/pkg/errors"
+	"tinygo.org/x/bluetooth"
+)
+
+// GATTRequirement is a service a driver needs and the characteristics it
+// uses on it. UUIDs are 16 or 128 bit, with or without dashes.
+type GATTRequirement struct {
+	Service         string
+	Characteristics []string
+}
+
+// GATTLayout lists the characteristics found on a device by service, all
+// as canonical UUID strings
+type GATTLayout map[string][]string
+
+// errMissing is the cause of a GATTError for something the device doesn't
+// have
+var errMissing = errors.New("not found")
+
+// GATTError says which part of discovering a device's services failed
+type GATTError struct {
+	Address        string
+	Service        string
+	Characteristic string
+	Err            error
+}
+
+func (e *GATTError) Error() string {
+	msg := "gatt discovery on " + e.Address
+	if e.Service != "" {
+		msg += ": service " + e.Service
+	}
+	if e.Characteristic != "" {
+		msg += ": characteristic " + e.Characteristic
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Cause returns the underlying error, for errors.Cause
+func (e *GATTError) Cause() error { return e.Err }
+
+// ollieGATT is what the BB-8 driver uses, from gobot's ollie driver
+var ollieGATT = []GATTRequirement{
+	{
+		Service: "22bb746f2bb075542d6f726568705327",
+		Characteristics: []string{
+			"22bb746f2bbf75542d6f726568705327", // wake
+			"22bb746f2bb275542d6f726568705327", // tx power
+			"22bb746f2bbd75542d6f726568705327", // anti dos
+		},
+	},
+	{
+		Service: "22bb746f2ba075542d6f726568705327",
+		Characteristics: []string{
+			ollieCommandsCharacteristic,
+			"22bb746f2ba675542d6f726568705327", // responses
+		},
+	},
+}
+
+// requiredLayout turns requirements into a layout of canonical UUIDs
+func requiredLayout(reqs []GATTRequirement) (GATTLayout, error) {
+	layout := make(GATTLayout)
+	for _, req := range reqs {
+		service, err := parseBLEUUID(req.Service)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad service UUID %q", req.Service)
+		}
+		chars := layout[service.String()]
+		for _, c := range req.Characteristics {
+			char, err := parseBLEUUID(c)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad characteristic UUID %q", c)
+			}
+			chars = append(chars, char.String())
+		}
+		layout[service.String()] = chars
+	}
+	return layout, nil
+}
+
+// discoverGATT fills in the characteristics of the connected device. It
+// first looks for what was found on the device last time, as long as that
+// has everything the driver requires, and otherwise looks only for what
+// the driver requires, or for everything when it requires nothing.
+func (b *ClientAdaptor) discoverGATT() error {
+	want, err := requiredLayout(b.required)
+	if err != nil {
+		return err
+	}
+	b.characteristics = make(map[string]bluetooth.DeviceCharacteristic)
+
+	if cached, ok := b.discovery.LayoutCovering(b.address, want); ok {
+		if _, err = b.discoverLayout(cached); err == nil {
+			log.Println("found the cached", cached.describe(), "on", b.address)
+			return nil
+		}
+		log.Println("cached gatt layout is stale, rediscovering:", err)
+		b.discovery.ForgetLayout(b.address)
+		b.characteristics = make(map[string]bluetooth.DeviceCharacteristic)
+	}
+
+	found, err := b.discoverLayout(want)
+	if err != nil {
+		return err
+	}
+	log.Println("discovered", found.describe(), "on", b.address)
+	b.discovery.StoreLayout(b.address, found)
+	return nil
+}
+
+// discoverLayout discovers the services and characteristics in want, or
+// all of them when want is nil
+func (b *ClientAdaptor) discoverLayout(want GATTLayout) (GATTLayout, error) {
+	var serviceUUIDs []bluetooth.UUID
+	for s := range want {
+		uuid, err := bluetooth.ParseUUID(s)
+		if err != nil {
+			return nil, &GATTError{Address: b.address, Service: s, Err: err}
+		}
+		serviceUUIDs = append(serviceUUIDs, uuid)
+	}
+
+	srvcs, err := b.device.DiscoverServices(serviceUUIDs)
+	if err != nil {
+		return nil, b.missingService(want, err)
+	}
+
+	found := make(GATTLayout)
+	for _, srvc := range srvcs {
+		service := srvc.UUID().String()
+
+		var charUUIDs []bluetooth.UUID
+		for _, c := range want[service] {
+			uuid, err := bluetooth.ParseUUID(c)
+			if err != nil {
+				return nil, &GATTError{Address: b.address, Service: service, Characteristic: c, Err: err}
+			}
+			charUUIDs = append(charUUIDs, uuid)
+		}
+
+		chars, err := srvc.DiscoverCharacteristics(charUUIDs)
+		if err != nil {
+			return nil, b.missingCharacteristic(srvc, want[service], err)
+		}
+		for _, char := range chars {
+			b.characteristics[char.UUID().String()] = char
+			found[service] = append(found[service], char.UUID().String())
+		}
+		sort.Strings(found[service])
+	}
+	return found, nil
+}
+
+// missingService turns a failed service discovery into an error naming
+// the first wanted service the device doesn't have
+func (b *ClientAdaptor) missingService(want GATTLayout, cause error) error {
+	if len(want) == 0 {
+		return &GATTError{Address: b.address, Err: cause}
+	}
+
+	srvcs, err := b.device.DiscoverServices(nil)
+	if err != nil {
+		return &GATTError{Address: b.address, Err: cause}
+	}
+	have := make(map[string]bool, len(srvcs))
+	for _, srvc := range srvcs {
+		have[srvc.UUID().String()] = true
+	}
+	for _, s := range sortedKeys(want) {
+		if !have[s] {
+			return &GATTError{Address: b.address, Service: s, Err: errMissing}
+		}
+	}
+	return &GATTError{Address: b.address, Err: cause}
+}
+
+// missingCharacteristic is missingService for characteristics
+func (b *ClientAdaptor) missingCharacteristic(srvc bluetooth.DeviceService, want []string, cause error) error {
+	service := srvc.UUID().String()
+	if len(want) == 0 {
+		return &GATTError{Address: b.address, Service: service, Err: cause}
+	}
+
+	chars, err := srvc.DiscoverCharacteristics(nil)
+	if err != nil {
+		return &GATTError{Address: b.address, Service: service, Err: cause}
+	}
+	have := make(map[string]bool, len(chars))
+	for _, char := range chars {
+		have[char.UUID().String()] = true
+	}
+	for _, c := range want {
+		if !have[c] {
+			return &GATTError{Address: b.address, Service: service, Characteristic: c, Err: errMissing}
+		}
+	}
+	return &GATTError{Address: b.address, Service: service, Err: cause}
+}
+
+func sortedKeys(layout GATTLayout) []string {
+	keys := make([]string, 0, len(layout))
+	for k := range layout {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// covers reports whether l has every service and characteristic in want
+func (l GATTLayout) covers(want GATTLayout) bool {
+	for service, chars := range want {
+		have, ok := l[service]
+		if !ok {
+			return false
+		}
+		for _, c := range chars {
+			found := false
+			for _, h := range have {
+				found = found || h == c
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// describe lists the services and characteristics for log messages
+func (l GATTLayout) describe() string {
+	n := 0
+	for _, chars := range l {
+		n += len(chars)
+	}
+	return fmt.Sprintf("%d services, %d characteristics", len(l), n)
+}
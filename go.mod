@@ -2,11 +2,16 @@ module github.com/logiraptor/gobot-ci
 
 go 1.18
 
-require gobot.io/x/gobot v1.16.0
+require (
+	github.com/muka/go-bluetooth v0.0.0-20220830075246-0746e3a1ea53
+	github.com/pkg/errors v0.9.1
+	go.bug.st/serial v1.4.0
+	gobot.io/x/gobot v1.16.0
+	tinygo.org/x/bluetooth v0.5.0
+)
 
 require (
 	github.com/JuulLabs-OSS/cbgo v0.0.2 // indirect
-	github.com/bmizerany/pat v0.0.0-20170815010413-6226ea591a40 // indirect
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/fatih/structs v1.1.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
@@ -14,10 +19,6 @@ require (
 	github.com/gofrs/uuid v4.3.0+incompatible // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
-	github.com/muka/go-bluetooth v0.0.0-20220830075246-0746e3a1ea53 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.9.0 // indirect
-	go.bug.st/serial v1.4.0 // indirect
 	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
-	tinygo.org/x/bluetooth v0.5.0 // indirect
 )
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HistoryEvent is one thing that happened to the light, such as a
+// pipeline changing status or someone acknowledging it
+type HistoryEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Pipeline string    `json:"pipeline,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// History keeps the most recent events, oldest first
+type History struct {
+	mu     sync.Mutex
+	size   int
+	events []HistoryEvent
+}
+
+func NewHistory(size int) *History {
+	return &History{size: size}
+}
+
+// Record appends an event, dropping the oldest once the history is full
+func (h *History) Record(kind, pipeline, detail string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.events = append(h.events, HistoryEvent{
+		Time:     time.Now(),
+		Kind:     kind,
+		Pipeline: pipeline,
+		Detail:   detail,
+	})
+	if len(h.events) > h.size {
+		h.events = h.events[len(h.events)-h.size:]
+	}
+}
+
+// Events returns a copy of the history
+func (h *History) Events() []HistoryEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HistoryEvent(nil), h.events...)
+}
+
+// Watch records every status transition from transitions
+func (h *History) Watch(transitions <-chan Transition) {
+	for t := range transitions {
+		h.Record("status", t.Pipeline, fmt.Sprintf("%s -> %s", t.From, t.To))
+	}
+}
+
+// ServeHTTP lists the history
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Events())
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sphero macro executive command codes, from the Orbotix macro
+// documentation
+const (
+	macroEnd              = 0x00
+	macroSetStabilization = 0x03
+	macroSetHeading       = 0x04
+	macroRoll             = 0x05
+	macroSetRGB           = 0x07
+	macroSetBackLED       = 0x08
+	macroDelay            = 0x0B
+	macroSetRotationRate  = 0x13
+	macroFade             = 0x14
+	macroLoopStart        = 0x1E
+	macroLoopEnd          = 0x1F
+)
+
+// Sphero virtual device commands for the macro executive
+const (
+	didSphero             = 0x02
+	cidRunMacro           = 0x50
+	cidSaveTemporaryMacro = 0x51
+	cidAbortMacro         = 0x55
+
+	// TemporaryMacroID is the RAM slot uploaded macros run from
+	TemporaryMacroID = 0xFF
+
+	// the whole macro has to fit in one packet, whose DLEN is a byte
+	maxMacroSize = 0xFE - 1
+
+	// how often an uploaded pattern repeats before the display replays it
+	macroPatternLoops = 0xFF
+)
+
+// Macro builds a program for the Sphero macro executive, so animations
+// run on the robot instead of being streamed over BLE
+type Macro struct {
+	cmds  []byte
+	loops int
+}
+
+func NewMacro() *Macro {
+	return &Macro{}
+}
+
+// SetRGB sets the main LED
+func (m *Macro) SetRGB(c Color) *Macro {
+	return m.emit(macroSetRGB, c.Red, c.Green, c.Blue, 0)
+}
+
+// Fade fades the main LED to c over d
+func (m *Macro) Fade(c Color, d time.Duration) *Macro {
+	for _, ms := range splitMillis(d) {
+		m.emit(macroFade, c.Red, c.Green, c.Blue, byte(ms>>8), byte(ms))
+	}
+	return m
+}
+
+// Delay pauses the macro for d
+func (m *Macro) Delay(d time.Duration) *Macro {
+	for _, ms := range splitMillis(d) {
+		m.emit(macroDelay, byte(ms>>8), byte(ms))
+	}
+	return m
+}
+
+// Roll drives at speed towards heading, in degrees
+func (m *Macro) Roll(speed uint8, heading uint16) *Macro {
+	return m.emit(macroRoll, speed, byte(heading>>8), byte(heading), 0)
+}
+
+// Stop stops rolling
+func (m *Macro) Stop() *Macro {
+	return m.Roll(0, 0)
+}
+
+// SetHeading sets the current heading as the new zero
+func (m *Macro) SetHeading(heading uint16) *Macro {
+	return m.emit(macroSetHeading, byte(heading>>8), byte(heading), 0)
+}
+
+// SetBackLED sets the brightness of the tail light
+func (m *Macro) SetBackLED(brightness uint8) *Macro {
+	return m.emit(macroSetBackLED, brightness, 0)
+}
+
+// SetStabilization turns the stabilization control loop on or off
+func (m *Macro) SetStabilization(on bool) *Macro {
+	flag := byte(0)
+	if on {
+		flag = 1
+	}
+	return m.emit(macroSetStabilization, flag, 0)
+}
+
+// SetRotationRate sets how quickly heading changes are applied
+func (m *Macro) SetRotationRate(rate uint8) *Macro {
+	return m.emit(macroSetRotationRate, rate)
+}
+
+// Loop repeats the commands added by body count times
+func (m *Macro) Loop(count uint8, body func(m *Macro)) *Macro {
+	if count == 0 {
+		return m
+	}
+	m.emit(macroLoopStart, count)
+	m.loops++
+	body(m)
+	m.loops--
+	return m.emit(macroLoopEnd)
+}
+
+// Encode returns the macro definition: id, flags, commands and End
+func (m *Macro) Encode(id byte) ([]byte, error) {
+	if m.loops != 0 {
+		return nil, fmt.Errorf("macro has unterminated loops")
+	}
+
+	buf := make([]byte, 0, len(m.cmds)+3)
+	buf = append(buf, id, 0x00)
+	buf = append(buf, m.cmds...)
+	buf = append(buf, macroEnd)
+
+	if len(buf) > maxMacroSize {
+		return nil, fmt.Errorf("macro is %d bytes, at most %d fit in a packet", len(buf), maxMacroSize)
+	}
+	return buf, nil
+}
+
+func (m *Macro) emit(cmd ...byte) *Macro {
+	m.cmds = append(m.cmds, cmd...)
+	return m
+}
+
+// splitMillis breaks d into chunks that fit a 16 bit millisecond field
+func splitMillis(d time.Duration) []uint16 {
+	ms := d.Milliseconds()
+	var chunks []uint16
+	for ms > 0xFFFF {
+		chunks = append(chunks, 0xFFFF)
+		ms -= 0xFFFF
+	}
+	return append(chunks, uint16(ms))
+}
+
+// MacroFromPattern compiles a pattern to a macro that plays it loops
+// times. With fade set, each step fades into its color instead of
+// jumping to it.
+func MacroFromPattern(p Pattern, loops uint8, fade bool) *Macro {
+	return NewMacro().Loop(loops, func(m *Macro) {
+		for _, step := range p {
+			c, dur := step.Split()
+			if fade {
+				m.Fade(c, dur)
+			} else {
+				m.SetRGB(c).Delay(dur)
+			}
+		}
+	})
+}
+
+// UploadMacro stores a macro, encoded for the temporary macro slot, on
+// the robot
+func UploadMacro(d *bb8Light, def []byte) error {
+	return d.command(didSphero, cidSaveTemporaryMacro, def)
+}
+
+// RunMacro starts the macro with the given id
+func RunMacro(d *bb8Light, id byte) error {
+	return d.command(didSphero, cidRunMacro, []byte{id})
+}
+
+// AbortMacro stops whatever macro is running
+func AbortMacro(d *bb8Light) error {
+	return d.command(didSphero, cidAbortMacro, nil)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/logiraptor/gobot-ci/spherov1"
+)
+
+// unhex turns a hex string with optional spaces into bytes
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMacroCommands(t *testing.T) {
+	red := Color{Red: 0xFF}
+	tests := []struct {
+		name  string
+		build func(m *Macro)
+		want  string
+	}{
+		{"set rgb", func(m *Macro) { m.SetRGB(Color{1, 2, 3}) }, "07 01 02 03 00"},
+		{"fade", func(m *Macro) { m.Fade(red, 1500*time.Millisecond) }, "14 ff 00 00 05 dc"},
+		{"long fade", func(m *Macro) { m.Fade(red, 70*time.Second) }, "14 ff 00 00 ff ff 14 ff 00 00 11 71"},
+		{"delay", func(m *Macro) { m.Delay(500 * time.Millisecond) }, "0b 01 f4"},
+		{"roll", func(m *Macro) { m.Roll(0x80, 270) }, "05 80 01 0e 00"},
+		{"stop", func(m *Macro) { m.Stop() }, "05 00 00 00 00"},
+		{"heading", func(m *Macro) { m.SetHeading(90) }, "04 00 5a 00"},
+		{"back led", func(m *Macro) { m.SetBackLED(0x7F) }, "08 7f 00"},
+		{"stabilization on", func(m *Macro) { m.SetStabilization(true) }, "03 01 00"},
+		{"stabilization off", func(m *Macro) { m.SetStabilization(false) }, "03 00 00"},
+		{"rotation rate", func(m *Macro) { m.SetRotationRate(0xC8) }, "13 c8"},
+		{"loop", func(m *Macro) { m.Loop(3, func(m *Macro) { m.Delay(time.Second) }) }, "1e 03 0b 03 e8 1f"},
+		{"empty loop", func(m *Macro) { m.Loop(0, func(m *Macro) { m.Delay(time.Second) }) }, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMacro()
+			tt.build(m)
+			got, err := m.Encode(0x20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := unhex(t, "20 00 "+tt.want+" 00")
+			if !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestMacroTooBig(t *testing.T) {
+	m := NewMacro()
+	for i := 0; i < 60; i++ {
+		m.SetRGB(Color{})
+	}
+	if _, err := m.Encode(TemporaryMacroID); err == nil {
+		t.Error("encoded a macro that doesn't fit a packet")
+	}
+}
+
+func TestMacroFromPattern(t *testing.T) {
+	p := Pattern{
+		{DurationMillis: 500, R: 0xFF},
+		{DurationMillis: 250, B: 0xFF},
+	}
+
+	got, err := MacroFromPattern(p, 2, false).Encode(TemporaryMacroID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := unhex(t, "ff 00 1e 02 07 ff 00 00 00 0b 01 f4 07 00 00 ff 00 0b 00 fa 1f 00")
+	if !bytes.Equal(got, want) {
+		t.Errorf("steps: got % x, want % x", got, want)
+	}
+
+	got, err = MacroFromPattern(p, 1, true).Encode(TemporaryMacroID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = unhex(t, "ff 00 1e 01 14 ff 00 00 01 f4 14 00 00 ff 00 fa 1f 00")
+	if !bytes.Equal(got, want) {
+		t.Errorf("fades: got % x, want % x", got, want)
+	}
+}
+
+func TestMacroUploadPacket(t *testing.T) {
+	p := Pattern{
+		{DurationMillis: 500, R: 0xFF},
+		{DurationMillis: 250, B: 0xFF},
+	}
+	def, err := MacroFromPattern(p, 2, false).Encode(TemporaryMacroID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := []struct {
+		name string
+		cid  byte
+		seq  byte
+		body []byte
+		want string
+	}{
+		{"save", cidSaveTemporaryMacro, 7, def, "ff ff 02 51 07 17 ff 00 1e 02 07 ff 00 00 00 0b 01 f4 07 00 00 ff 00 0b 00 fa 1f 00 3f"},
+		{"run", cidRunMacro, 8, []byte{TemporaryMacroID}, "ff ff 02 50 08 02 ff a4"},
+		{"abort", cidAbortMacro, 9, nil, "ff ff 02 55 09 01 9e"},
+	}
+	for _, tt := range packets {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := spherov1.Packet{Kind: spherov1.Command, Answer: true, DeviceID: didSphero, CommandID: tt.cid, Seq: tt.seq, Data: tt.body}.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.want); !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
@@ -2,19 +2,91 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"gobot.io/x/gobot"
-	"gobot.io/x/gobot/platforms/sphero/bb8"
 )
 
-var bb8Address = "BB-E186"
+var bb8Name = "BB-E186"
 
 func main() {
-	adp := NewGobotAdapter()
-	worker := NewBgConn(adp)
+	cmd, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		cfg := loadConfigFlags(cmd, args)
+		mux := newServer(cfg)
+		log.Println("listening on", cfg.Listen)
+		log.Fatalln(http.ListenAndServe(cfg.Listen, mux))
+	case "agent":
+		// serve the robot locally and apply events relayed from the public relay
+		cfg := loadConfigFlags(cmd, args)
+		mux := newServer(cfg)
+		agent, err := NewAgent(cfg.Relay, mux)
+		if err != nil {
+			log.Fatalln("Error configuring agent", err)
+		}
+		go agent.Run()
+		log.Println("listening on", cfg.Listen)
+		log.Fatalln(http.ListenAndServe(cfg.Listen, mux))
+	case "relay":
+		cfg := loadConfigFlags(cmd, args)
+		relay, err := NewRelay(cfg.Relay)
+		if err != nil {
+			log.Fatalln("Error configuring relay", err)
+		}
+		log.Println("relay listening on", cfg.Listen)
+		log.Fatalln(http.ListenAndServe(cfg.Listen, relay))
+	case "ack":
+		if err := runAck(args); err != nil {
+			log.Fatalln("Error acknowledging", err)
+		}
+	case "decode":
+		if err := runDecode(args); err != nil {
+			log.Fatalln("Error decoding", err)
+		}
+	default:
+		log.Fatalln("unknown command", cmd, "- expected serve, agent, relay, ack or decode")
+	}
+}
+
+func loadConfigFlags(cmd string, args []string) Config {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON config file")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalln("Error loading config", err)
+	}
+	return cfg
+}
+
+// newServer connects to the robot and wires every integration into one
+// handler
+func newServer(cfg Config) *http.ServeMux {
+	discovery := NewDiscovery(cfg.Discovery)
+	adapters := NewAdapterPool(cfg.Adapters)
+	queue := NewCommandQueue(cfg.Queue)
+	light, err := newLight(cfg, discovery, adapters, queue)
+	if err != nil {
+		log.Fatalln("Error configuring light", err)
+	}
+	power, err := NewPowerPolicy(cfg.Power)
+	if err != nil {
+		log.Fatalln("Error configuring power policy", err)
+	}
+	worker := NewBgConn(light, queue, power)
 	go worker.worker()
 
 	p := NewPlan()
@@ -37,20 +109,92 @@ func main() {
 		B:              255,
 	})
 
-	go func() {
-		for {
-			if p.Empty() {
-				worker.colors <- Color{}
-			}
+	registry := NewStatusRegistry()
+	alerts := NewAlertTracker(cfg.Alerts)
+
+	prober, err := NewProber(cfg.Probes, registry)
+	if err != nil {
+		log.Fatalln("Error configuring probes", err)
+	}
+	prober.Start()
+
+	poller, err := NewPoller(cfg.Pollers, registry)
+	if err != nil {
+		log.Fatalln("Error configuring pollers", err)
+	}
+	poller.Start()
 
-			currentColor, dur := p.Pop()
-			log.Println("popped", currentColor, dur)
-			worker.colors <- currentColor
-			<-time.After(dur)
+	history := NewHistory(500)
+	go history.Watch(registry.Transitions())
+	go worker.Watch(registry.Transitions())
+
+	motion := NewChoreographer(cfg.Motion, func() (Mover, bool) {
+		adp, ok := light.(*gobotAdapter)
+		if !ok {
+			return nil, false
 		}
-	}()
+		return adp.Mover()
+	})
+	go motion.Watch(registry.Transitions())
 
-	http.ListenAndServe(":3000", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// hooks have to be in place before the display wakes the light
+	if adp, ok := light.(*gobotAdapter); ok {
+		adp.OnConnect(NewTapDetector(cfg.Tap, registry, history, motion.Playing).Connected)
+	}
+
+	// firing alerts win over the pipeline status whenever the plan runs dry
+	escalator, err := NewEscalator(cfg.Escalation, registry, motion)
+	if err != nil {
+		log.Fatalln("Error configuring escalation", err)
+	}
+	go escalator.Run()
+
+	display := NewDisplay(p, alerts, escalator)
+	display.Watch(registry.Changed())
+	display.Watch(alerts.Changed())
+	display.Watch(escalator.Changed())
+	if player, ok := light.(PatternPlayer); ok && cfg.Robot.Macros {
+		display.Offload(player)
+	}
+	go display.Run(worker.colors)
+
+	switch light := light.(type) {
+	case *gobotAdapter:
+		if bolt, ok := light.driver.(*SpheroV2Driver); ok && bolt.model == SpheroBolt {
+			go NewMatrixRenderer(cfg.Matrix, registry, bolt, light.Running, queue).Run()
+		}
+	case *SerialLight:
+		go light.WatchSegments(registry)
+	}
+
+	events := NewCloudEventsHandler(cfg.CloudEvents, registry, p)
+	events.Choreograph(motion)
+
+	mux := http.NewServeMux()
+	mux.Handle("/events", events)
+	mux.Handle("/motion", motion)
+	mux.Handle("/motion/safety", motion.Supervisor())
+	mux.Handle("/status", registry)
+	mux.Handle("/history", history)
+	mux.Handle("/ble/scan", discovery)
+	mux.Handle("/ble/adapters", adapters)
+	mux.Handle("/queue", queue)
+	mux.Handle("/power", power)
+	mux.Handle("/acks", AckHandler(registry, history))
+	mux.Handle("/alerts", alerts)
+	mux.Handle("/alerts/alertmanager", AlertmanagerHandler(alerts))
+	mux.Handle("/alerts/grafana", GrafanaHandler(alerts))
+	mux.Handle("/probes", prober)
+
+	reports := NewReports(registry)
+	mux.Handle("/reports", reports)
+	mux.Handle("/reports/", reports)
+	mux.Handle("/", planHandler(p))
+	return mux
+}
+
+func planHandler(p *Plan) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Got request", r.Method, r.URL.Path)
 
 		var i Interval
@@ -68,17 +212,80 @@ func main() {
 
 		log.Println("pushing", i)
 		p.Push(i)
-	}))
+	}
+}
+
+// Light is anything bgconn can connect to and color
+type Light interface {
+	Start() error
+	Stop() error
+	Running() bool
+	SetRGB(r, g, b uint8) error
+}
+
+// newLight picks the serial LED strip or BLE bulb when one is configured,
+// and the robot otherwise. Everything sent to the robot goes through queue.
+func newLight(cfg Config, discovery *Discovery, adapters *AdapterPool, queue *CommandQueue) (Light, error) {
+	if cfg.Serial.Port != "" {
+		return NewSerialLight(cfg.Serial)
+	}
+	if cfg.Bulb.Profile != "" {
+		return NewBulbAdapter(cfg.Bulb, discovery, adapters)
+	}
+	return NewGobotAdapter(cfg.Robot, discovery, adapters, queue)
+}
+
+// lightDriver is a gobot driver for a robot with a main RGB LED
+type lightDriver interface {
+	gobot.Driver
+	SetRGB(r, g, b uint8) error
+}
 
+// gattDriver is a driver that declares the BLE services it uses
+type gattDriver interface {
+	GATTRequirements() []GATTRequirement
 }
 
-func NewGobotAdapter() *gobotAdapter {
-	bleAdaptor := NewClientAdaptor(bb8Address)
-	bb8 := bb8.NewDriver(bleAdaptor)
+func NewGobotAdapter(cfg RobotConfig, discovery *Discovery, adapters *AdapterPool, queue *CommandQueue) (*gobotAdapter, error) {
+	filter := cfg.DeviceFilter
+	if filter == (DeviceFilter{}) {
+		filter.Name = bb8Name
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	bleAdaptor := NewClientAdaptor(filter, discovery, adapters)
+	bleAdaptor.AdapterName = cfg.Adapter
+	bleAdaptor.Configure(cfg.Writes)
+	if err := bleAdaptor.Trace(cfg.Trace); err != nil {
+		return nil, err
+	}
+
+	var driver lightDriver
+	switch cfg.Model {
+	case "", "bb8":
+		driver = newBB8Light(bleAdaptor, cfg.Writes.Confirm)
+		bleAdaptor.Require(ollieGATT...)
+	case "mini":
+		driver = NewSpheroMiniDriver(bleAdaptor)
+	case "bolt":
+		driver = NewSpheroBoltDriver(bleAdaptor)
+	default:
+		return nil, fmt.Errorf("unknown robot model %q", cfg.Model)
+	}
+
+	if d, ok := driver.(gattDriver); ok {
+		bleAdaptor.Require(d.GATTRequirements()...)
+	}
+	adp := newGobotAdapter("bbBot", bleAdaptor, driver)
+	adp.queue = queue
+	return adp, nil
+}
 
-	robot := gobot.NewRobot("bbBot",
-		[]gobot.Connection{bleAdaptor},
-		[]gobot.Device{bb8},
+func newGobotAdapter(name string, conn gobot.Connection, driver lightDriver) *gobotAdapter {
+	robot := gobot.NewRobot(name,
+		[]gobot.Connection{conn},
+		[]gobot.Device{driver},
 	)
 
 	m := gobot.NewMaster()
@@ -86,13 +293,28 @@ func NewGobotAdapter() *gobotAdapter {
 
 	return &gobotAdapter{
 		m:      m,
-		driver: bb8,
+		driver: driver,
 	}
 }
 
 type gobotAdapter struct {
-	m      *gobot.Master
-	driver *bb8.BB8Driver
+	m         *gobot.Master
+	driver    lightDriver
+	queue     *CommandQueue
+	connected []func(lightDriver)
+}
+
+// OnConnect calls f with the driver every time the robot connects
+func (x *gobotAdapter) OnConnect(f func(lightDriver)) {
+	x.connected = append(x.connected, f)
+}
+
+// Connected runs the OnConnect hooks. gobot's Start only returns once the
+// robot stops, so liveLoop calls it once the robot is running.
+func (x *gobotAdapter) Connected() {
+	for _, f := range x.connected {
+		f(x.driver)
+	}
 }
 
 func (x *gobotAdapter) Start() error {
@@ -113,30 +335,137 @@ func (x *gobotAdapter) Stop() error {
 	return err
 }
 
-func (x *gobotAdapter) SetRGB(r, g, b uint8) {
+func (x *gobotAdapter) Running() bool {
+	return x.m.Running()
+}
+
+// Mover returns the driver when it can roll and the robot is connected.
+// Motion goes through the command queue.
+func (x *gobotAdapter) Mover() (Mover, bool) {
+	m, ok := x.driver.(locatingMover)
+	if !ok || !x.m.Running() {
+		return nil, false
+	}
+	return queuedMover{m, x.queue}, true
+}
+
+func (x *gobotAdapter) SetRGB(r, g, b uint8) error {
 	log.Println("setting color over ble", r, g, b)
-	x.driver.SetRGB(r, g, b)
+	return x.driver.SetRGB(r, g, b)
+}
+
+// Sleep puts the robot to sleep when its driver can
+func (x *gobotAdapter) Sleep() error {
+	s, ok := x.driver.(sleeper)
+	if !ok {
+		return errors.New("robot can't be put to sleep")
+	}
+	return s.Sleep()
+}
+
+// PlayPattern uploads p as a macro so the robot animates it by itself
+func (x *gobotAdapter) PlayPattern(p Pattern) error {
+	bb, ok := x.driver.(*bb8Light)
+	if !ok {
+		return errors.New("macros need a v1 Sphero robot")
+	}
+	if !x.m.Running() {
+		return errors.New("robot is not connected")
+	}
+
+	def, err := MacroFromPattern(p, macroPatternLoops, false).Encode(TemporaryMacroID)
+	if err != nil {
+		return err
+	}
+	log.Println("uploading pattern macro with", len(p), "steps")
+	x.queue.Push(Command{Run: func() error { return UploadMacro(bb, def) }})
+	x.queue.Push(Command{Run: func() error { return RunMacro(bb, TemporaryMacroID) }})
+	return nil
 }
 
+// StopPattern aborts the pattern macro
+func (x *gobotAdapter) StopPattern() {
+	if bb, ok := x.driver.(*bb8Light); ok && x.m.Running() {
+		x.queue.Push(Command{Run: func() error { return AbortMacro(bb) }})
+	}
+}
+
+// startPoll is how often liveLoop checks whether the light has started
+const startPoll = 50 * time.Millisecond
+
 type bgconn struct {
 	colors chan Color
-	abs    *gobotAdapter
+	wake   chan struct{}
+	abs    Light
+	queue  *CommandQueue
+	power  *PowerPolicy
 }
 
-func NewBgConn(abs *gobotAdapter) *bgconn {
+func NewBgConn(abs Light, queue *CommandQueue, power *PowerPolicy) *bgconn {
 	return &bgconn{
 		colors: make(chan Color),
+		wake:   make(chan struct{}, 1),
 		abs:    abs,
+		queue:  queue,
+		power:  power,
 	}
 }
 
+// sleeper is a light that can be put to sleep
+type sleeper interface {
+	Sleep() error
+}
+
+// connectWatcher is a light with work to do once it is running
+type connectWatcher interface {
+	Connected()
+}
+
 func (c *bgconn) worker() {
-	for color := range c.colors {
-		c.liveLoop(color)
+	var color Color
+	for {
+		select {
+		case color = <-c.colors:
+		case <-c.wake:
+			log.Println("connecting to light ahead of activity")
+		}
+		for {
+			var lost bool
+			color, lost = c.liveLoop(color)
+			if !lost {
+				break
+			}
+			log.Println("lost connection to light, reconnecting")
+		}
+	}
+}
+
+// Wake connects to the light, or keeps it from idling, ahead of a color
+func (c *bgconn) Wake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch wakes the light when pipelines change to a status the power
+// policy wakes on
+func (c *bgconn) Watch(transitions <-chan Transition) {
+	for t := range transitions {
+		if c.power.Wakes(t.To) {
+			c.Wake()
+		}
 	}
 }
 
-func (c *bgconn) liveLoop(startingColor Color) {
+// liveLoop connects to the light and keeps it colored until the power
+// policy lets it go. When the connection is lost it returns the color to
+// reconnect with.
+func (c *bgconn) liveLoop(startingColor Color) (Color, bool) {
+	c.power.set("connecting")
+	state := "disconnected"
+	defer func() { c.power.set(state) }()
+
 	abort := make(chan struct{})
 	go func() {
 		err := c.abs.Start()
@@ -145,37 +474,127 @@ func (c *bgconn) liveLoop(startingColor Color) {
 			close(abort)
 		}
 	}()
-	// Poll until bluetooth is running
-	for !c.abs.m.Running() {
+	// gobot's Start only returns once it stops, so check on the light
+	// until it is running
+	poll := time.NewTicker(startPoll)
+	for !c.abs.Running() {
+		select {
+		case <-abort:
+			poll.Stop()
+			return startingColor, false
+		case <-poll.C:
+		}
 	}
+	poll.Stop()
 	defer c.abs.Stop()
+	c.power.set("connected")
+	if w, ok := c.abs.(connectWatcher); ok {
+		w.Connected()
+	}
+
+	// send commands until the loop ends, before the light stops
+	stop := make(chan struct{})
+	lost := make(chan error, 1)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		lost <- c.queue.Run(stop)
+	}()
+	defer func() {
+		close(stop)
+		<-sent
+	}()
 
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(c.power.Refresh())
+	defer ticker.Stop()
+
+	// blackSince is when the light went black, and the timeout checks on
+	// it once it has lingered; the ticker checks again after that
+	var blackSince time.Time
 	var timeout <-chan time.Time
+	idleFrom := func(t time.Time) {
+		blackSince = t
+		timeout = time.After(c.power.Linger())
+	}
 
 	currentColor := startingColor
 
-	c.abs.SetRGB(currentColor.Red, currentColor.Green, currentColor.Blue)
+	setColor := func() {
+		color := currentColor
+		c.queue.Push(Command{Key: "color", Run: func() error {
+			return c.abs.SetRGB(color.Red, color.Green, color.Blue)
+		}})
+	}
+
+	// idle lets the light go, putting it to sleep first, when the power
+	// policy says so. The sleep goes through the queue behind whatever is
+	// still waiting, and has been written by the time idle returns.
+	idle := func() bool {
+		if blackSince.IsZero() {
+			return false
+		}
+		disconnect, sleep := c.power.Idle(time.Now(), time.Since(blackSince))
+		if sleep {
+			if s, ok := c.abs.(sleeper); ok {
+				log.Println("putting light to sleep after", time.Since(blackSince).Round(time.Second), "idle")
+				slept := make(chan error, 1)
+				c.queue.Push(Command{Run: func() error {
+					err := s.Sleep()
+					slept <- err
+					return err
+				}})
+				select {
+				case err := <-slept:
+					if err != nil {
+						log.Println("error putting light to sleep", err)
+					} else {
+						state = "asleep"
+					}
+				case err := <-lost:
+					// the loop still has to see the connection went
+					lost <- err
+				}
+			}
+		}
+		return disconnect
+	}
+
+	setColor()
+	if currentColor == (Color{}) {
+		idleFrom(time.Now())
+	}
 
 	for {
 		select {
 		case color := <-c.colors:
 			currentColor = color
-			c.abs.SetRGB(currentColor.Red, currentColor.Green, currentColor.Blue)
+			setColor()
 
 			if currentColor == (Color{}) {
-				if timeout == nil {
-					timeout = time.After(30 * time.Second)
+				if blackSince.IsZero() {
+					idleFrom(time.Now())
 				}
 			} else {
-				timeout = nil
+				blackSince, timeout = time.Time{}, nil
+			}
+		case <-c.wake:
+			if !blackSince.IsZero() {
+				idleFrom(time.Now())
 			}
 		case <-ticker.C:
-			c.abs.SetRGB(currentColor.Red, currentColor.Green, currentColor.Blue)
+			if idle() {
+				return currentColor, false
+			}
+			setColor()
+		case <-lost:
+			return currentColor, true
 		case <-timeout:
-			return
+			timeout = nil
+			if idle() {
+				return currentColor, false
+			}
 		case <-abort:
-			return
+			return currentColor, false
 		}
 	}
 }
@@ -198,9 +617,9 @@ type Interval struct {
 }
 
 type Color struct {
-	Red   uint8
-	Green uint8
-	Blue  uint8
+	Red   uint8 `json:"r"`
+	Green uint8 `json:"g"`
+	Blue  uint8 `json:"b"`
 }
 
 func (p *Plan) Push(interval Interval) {
@@ -212,7 +631,11 @@ func (p *Plan) Empty() bool {
 }
 
 func (p *Plan) Pop() (Color, time.Duration) {
-	interval := <-p.Intervals
+	return (<-p.Intervals).Split()
+}
+
+// Split returns the color and duration of an interval
+func (interval Interval) Split() (Color, time.Duration) {
 	c := Color{
 		Red:   interval.R,
 		Green: interval.G,
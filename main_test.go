@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// sleepyLight starts after a delay and keeps running until stopped, like
+// gobot, and records what was done to it
+type sleepyLight struct {
+	delay time.Duration
+
+	mu      sync.Mutex
+	running bool
+	checks  int
+	stopped chan struct{}
+	ops     []string
+}
+
+func (l *sleepyLight) do(op string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.running {
+		op += " while stopped"
+	}
+	l.ops = append(l.ops, op)
+}
+
+func (l *sleepyLight) Start() error {
+	time.Sleep(l.delay)
+	l.mu.Lock()
+	l.running = true
+	l.stopped = make(chan struct{})
+	stopped := l.stopped
+	l.mu.Unlock()
+	<-stopped
+	return nil
+}
+
+func (l *sleepyLight) Stop() error {
+	l.do("stop")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+	close(l.stopped)
+	return nil
+}
+
+func (l *sleepyLight) Running() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.checks++
+	return l.running
+}
+
+func (l *sleepyLight) SetRGB(r, g, b uint8) error {
+	l.do("color")
+	return nil
+}
+
+func (l *sleepyLight) Sleep() error {
+	l.do("sleep")
+	return nil
+}
+
+func TestLiveLoopSleepsThroughQueue(t *testing.T) {
+	light := &sleepyLight{delay: 200 * time.Millisecond}
+	queue := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+	power, err := NewPowerPolicy(PowerConfig{
+		Refresh:    Duration(10 * time.Millisecond),
+		Linger:     Duration(time.Hour),
+		SleepAfter: Duration(20 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewBgConn(light, queue, power)
+
+	done := make(chan bool)
+	go func() {
+		_, lost := c.liveLoop(Color{})
+		done <- lost
+	}()
+	select {
+	case lost := <-done:
+		if lost {
+			t.Error("lost the connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the light never went to sleep")
+	}
+
+	light.mu.Lock()
+	defer light.mu.Unlock()
+	// the refresh may send the color again before the light idles
+	n := len(light.ops)
+	if n < 3 || light.ops[n-2] != "sleep" || light.ops[n-1] != "stop" {
+		t.Fatalf("got %q, want colors, then sleep and stop", light.ops)
+	}
+	for _, op := range light.ops[:n-2] {
+		if op != "color" {
+			t.Fatalf("got %q, want colors, then sleep and stop", light.ops)
+		}
+	}
+	if s := queue.Stats(); s.Sent != n-1 {
+		t.Errorf("the queue sent %d commands, want the colors and the sleep", s.Sent)
+	}
+
+	// waiting for the start checks at the ticker's pace, not in a spin
+	if max := int(light.delay/startPoll) + 20; light.checks > max {
+		t.Errorf("checked whether the light runs %d times while starting", light.checks)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const matrixSize = 8
+
+// Frame is one image on the BOLT's 8x8 LED matrix, indexed [y][x]
+type Frame [matrixSize][matrixSize]Color
+
+// String renders the frame as an ASCII grid, '#' for lit pixels
+func (f Frame) String() string {
+	var sb strings.Builder
+	for y := range f {
+		for x := range f[y] {
+			if f[y][x] == (Color{}) {
+				sb.WriteByte('.')
+			} else {
+				sb.WriteByte('#')
+			}
+		}
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// font5x7 holds the printable ASCII characters from ' ' to '_' as five
+// columns each, least significant bit at the top
+var font5x7 = [][5]byte{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, {0x00, 0x00, 0x5F, 0x00, 0x00}, {0x00, 0x07, 0x00, 0x07, 0x00}, {0x14, 0x7F, 0x14, 0x7F, 0x14},
+	{0x24, 0x2A, 0x7F, 0x2A, 0x12}, {0x23, 0x13, 0x08, 0x64, 0x62}, {0x36, 0x49, 0x55, 0x22, 0x50}, {0x00, 0x05, 0x03, 0x00, 0x00},
+	{0x00, 0x1C, 0x22, 0x41, 0x00}, {0x00, 0x41, 0x22, 0x1C, 0x00}, {0x08, 0x2A, 0x1C, 0x2A, 0x08}, {0x08, 0x08, 0x3E, 0x08, 0x08},
+	{0x00, 0x50, 0x30, 0x00, 0x00}, {0x08, 0x08, 0x08, 0x08, 0x08}, {0x00, 0x60, 0x60, 0x00, 0x00}, {0x20, 0x10, 0x08, 0x04, 0x02},
+	{0x3E, 0x51, 0x49, 0x45, 0x3E}, {0x00, 0x42, 0x7F, 0x40, 0x00}, {0x42, 0x61, 0x51, 0x49, 0x46}, {0x21, 0x41, 0x45, 0x4B, 0x31},
+	{0x18, 0x14, 0x12, 0x7F, 0x10}, {0x27, 0x45, 0x45, 0x45, 0x39}, {0x3C, 0x4A, 0x49, 0x49, 0x30}, {0x01, 0x71, 0x09, 0x05, 0x03},
+	{0x36, 0x49, 0x49, 0x49, 0x36}, {0x06, 0x49, 0x49, 0x29, 0x1E}, {0x00, 0x36, 0x36, 0x00, 0x00}, {0x00, 0x56, 0x36, 0x00, 0x00},
+	{0x00, 0x08, 0x14, 0x22, 0x41}, {0x14, 0x14, 0x14, 0x14, 0x14}, {0x41, 0x22, 0x14, 0x08, 0x00}, {0x02, 0x01, 0x51, 0x09, 0x06},
+	{0x32, 0x49, 0x79, 0x41, 0x3E}, {0x7E, 0x11, 0x11, 0x11, 0x7E}, {0x7F, 0x49, 0x49, 0x49, 0x36}, {0x3E, 0x41, 0x41, 0x41, 0x22},
+	{0x7F, 0x41, 0x41, 0x22, 0x1C}, {0x7F, 0x49, 0x49, 0x49, 0x41}, {0x7F, 0x09, 0x09, 0x01, 0x01}, {0x3E, 0x41, 0x41, 0x51, 0x32},
+	{0x7F, 0x08, 0x08, 0x08, 0x7F}, {0x00, 0x41, 0x7F, 0x41, 0x00}, {0x20, 0x40, 0x41, 0x3F, 0x01}, {0x7F, 0x08, 0x14, 0x22, 0x41},
+	{0x7F, 0x40, 0x40, 0x40, 0x40}, {0x7F, 0x02, 0x04, 0x02, 0x7F}, {0x7F, 0x04, 0x08, 0x10, 0x7F}, {0x3E, 0x41, 0x41, 0x41, 0x3E},
+	{0x7F, 0x09, 0x09, 0x09, 0x06}, {0x3E, 0x41, 0x51, 0x21, 0x5E}, {0x7F, 0x09, 0x19, 0x29, 0x46}, {0x46, 0x49, 0x49, 0x49, 0x31},
+	{0x01, 0x01, 0x7F, 0x01, 0x01}, {0x3F, 0x40, 0x40, 0x40, 0x3F}, {0x1F, 0x20, 0x40, 0x20, 0x1F}, {0x7F, 0x20, 0x18, 0x20, 0x7F},
+	{0x63, 0x14, 0x08, 0x14, 0x63}, {0x03, 0x04, 0x78, 0x04, 0x03}, {0x61, 0x51, 0x49, 0x45, 0x43}, {0x00, 0x00, 0x7F, 0x41, 0x41},
+	{0x02, 0x04, 0x08, 0x10, 0x20}, {0x41, 0x41, 0x7F, 0x00, 0x00}, {0x04, 0x02, 0x01, 0x02, 0x04}, {0x40, 0x40, 0x40, 0x40, 0x40},
+}
+
+// glyph returns the font columns for r. Lower case is shown as upper case
+// and anything else without a glyph as '?'.
+func glyph(r rune) [5]byte {
+	if r >= 'a' && r <= 'z' {
+		r -= 'a' - 'A'
+	}
+	if r < ' ' || int(r-' ') >= len(font5x7) {
+		r = '?'
+	}
+	return font5x7[r-' ']
+}
+
+var icons = map[string][matrixSize]string{
+	"check": {
+		"........",
+		".......#",
+		"......##",
+		"#....##.",
+		"##..##..",
+		".####...",
+		"..##....",
+		"........",
+	},
+	"cross": {
+		"#......#",
+		".#....#.",
+		"..#..#..",
+		"...##...",
+		"...##...",
+		"..#..#..",
+		".#....#.",
+		"#......#",
+	},
+	"hourglass": {
+		"########",
+		".######.",
+		"..####..",
+		"...##...",
+		"...##...",
+		"..#..#..",
+		".#....#.",
+		"########",
+	},
+	"flame": {
+		"...#....",
+		"...##...",
+		"..###.#.",
+		"..#####.",
+		".######.",
+		".##..##.",
+		".##..##.",
+		"..####..",
+	},
+}
+
+// Icon draws the named icon in c. ok is false for unknown icons.
+func Icon(name string, c Color) (f Frame, ok bool) {
+	rows, ok := icons[name]
+	if !ok {
+		return f, false
+	}
+	for y, row := range rows {
+		for x, px := range row {
+			if px == '#' {
+				f[y][x] = c
+			}
+		}
+	}
+	return f, true
+}
+
+// ScrollText returns the frames of text scrolling right to left, from
+// entering at the right edge to leaving at the left edge
+func ScrollText(text string, c Color) []Frame {
+	columns := make([]byte, matrixSize)
+	for _, r := range text {
+		g := glyph(r)
+		columns = append(columns, g[:]...)
+		columns = append(columns, 0)
+	}
+	columns = append(columns, make([]byte, matrixSize)...)
+
+	frames := make([]Frame, 0, len(columns)-matrixSize+1)
+	for offset := 0; offset+matrixSize <= len(columns); offset++ {
+		var f Frame
+		for x := 0; x < matrixSize; x++ {
+			col := columns[offset+x]
+			for y := 0; y < 7; y++ {
+				if col&(1<<y) != 0 {
+					f[y][x] = c
+				}
+			}
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// matrixWriter is the LED matrix of a Sphero BOLT
+type matrixWriter interface {
+	MatrixFill(c Color) error
+	MatrixPixel(x, y uint8, c Color) error
+}
+
+// MatrixContent is what the matrix shows for a build state. Text may
+// contain {pipeline}, which is replaced with the pipeline's name.
+type MatrixContent struct {
+	Icon  string `json:"icon,omitempty"`
+	Text  string `json:"text,omitempty"`
+	Color *Color `json:"color,omitempty"`
+}
+
+// MatrixConfig maps build states to matrix content. Budget caps the BLE
+// writes per second spent on the matrix.
+type MatrixConfig struct {
+	States map[string]MatrixContent `json:"states"`
+	Budget int                      `json:"budget"`
+	Frame  Duration                 `json:"frame"`
+}
+
+func DefaultMatrixConfig() MatrixConfig {
+	return MatrixConfig{
+		States: map[string]MatrixContent{
+			"success":  {Icon: "check"},
+			"running":  {Icon: "hourglass"},
+			"degraded": {Icon: "flame"},
+			"failure":  {Icon: "cross", Text: "{pipeline}"},
+		},
+		Budget: 20,
+		Frame:  Duration(150 * time.Millisecond),
+	}
+}
+
+// Frames renders the content for a pipeline. Icons are shown for a few
+// frames before any text scrolls past.
+func (mc MatrixContent) Frames(ps PipelineStatus) []Frame {
+	c := ps.Status.Color()
+	if mc.Color != nil {
+		c = *mc.Color
+	}
+
+	var frames []Frame
+	if icon, ok := Icon(mc.Icon, c); ok {
+		for i := 0; i < 10; i++ {
+			frames = append(frames, icon)
+		}
+	}
+	if mc.Text != "" {
+		frames = append(frames, ScrollText(strings.ReplaceAll(mc.Text, "{pipeline}", ps.Pipeline), c)...)
+	}
+	return frames
+}
+
+// MatrixRenderer keeps the BOLT's matrix showing the most severe pipeline
+type MatrixRenderer struct {
+	cfg      MatrixConfig
+	registry *StatusRegistry
+	matrix   matrixWriter
+	ready    func() bool
+	queue    *CommandQueue
+
+	mu     sync.Mutex
+	target Frame
+	shown  *Frame
+	fill   bool
+	spent  time.Time
+	timer  *time.Timer
+}
+
+// NewMatrixRenderer draws on matrix through queue while ready reports the
+// robot is connected
+func NewMatrixRenderer(cfg MatrixConfig, registry *StatusRegistry, matrix matrixWriter, ready func() bool, queue *CommandQueue) *MatrixRenderer {
+	if cfg.Budget <= 0 {
+		cfg.Budget = 20
+	}
+	return &MatrixRenderer{
+		cfg:      cfg,
+		registry: registry,
+		matrix:   matrix,
+		ready:    ready,
+		queue:    queue,
+	}
+}
+
+// Run loops the frames for the current state, starting over whenever the
+// registry changes
+func (m *MatrixRenderer) Run() {
+	changed := m.registry.Changed()
+	frameTime := m.cfg.Frame.Or(150 * time.Millisecond)
+
+	for {
+		var frames []Frame
+		if ps, ok := m.registry.Worst(); ok {
+			frames = m.cfg.States[ps.Status.String()].Frames(ps)
+		}
+		if len(frames) == 0 {
+			frames = []Frame{{}}
+		}
+
+	play:
+		for {
+			for _, f := range frames {
+				m.show(f)
+
+				select {
+				case <-changed:
+					break play
+				case <-time.After(frameTime):
+				}
+			}
+		}
+	}
+}
+
+// show makes f the frame to draw. It is drawn one write at a time, each
+// its own command on the queue, so other commands to the robot don't wait
+// behind a whole frame; newer frames take over from one still being
+// drawn. A fresh connection gets a full redraw.
+func (m *MatrixRenderer) show(f Frame) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.ready() {
+		m.shown = nil
+		return
+	}
+	m.target = f
+	switch {
+	case m.shown == nil || changedPixels(*m.shown, f) > matrixSize*matrixSize/2:
+		m.fill = true
+	case changedPixels(*m.shown, f) == 0 && !m.fill:
+		return
+	}
+	m.next()
+}
+
+// next queues a write once the budget allows it. The wait is on a timer
+// rather than in the queue, and there is only ever one timer and one
+// queued write. Callers hold m.mu.
+func (m *MatrixRenderer) next() {
+	wait := time.Until(m.spent.Add(time.Second / time.Duration(m.cfg.Budget)))
+	if wait <= 0 {
+		m.queue.Push(Command{Key: "matrix", Run: m.step})
+		return
+	}
+	if m.timer == nil {
+		m.timer = time.AfterFunc(wait, func() {
+			m.queue.Push(Command{Key: "matrix", Run: m.step})
+		})
+		return
+	}
+	m.timer.Reset(wait)
+}
+
+// step makes one write toward the target: a fill with its most common
+// color when much of the frame changes, and then the pixels that differ
+// from what is shown
+func (m *MatrixRenderer) step() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.spent) < time.Second/time.Duration(m.cfg.Budget) {
+		m.next()
+		return nil
+	}
+
+	var shown Frame
+	var err error
+	switch {
+	case m.fill || m.shown == nil:
+		bg := dominantColor(m.target)
+		for y := range shown {
+			for x := range shown[y] {
+				shown[y][x] = bg
+			}
+		}
+		err = m.matrix.MatrixFill(bg)
+	default:
+		shown = *m.shown
+		x, y, ok := firstChange(shown, m.target)
+		if !ok {
+			return nil
+		}
+		shown[y][x] = m.target[y][x]
+		err = m.matrix.MatrixPixel(uint8(x), uint8(y), shown[y][x])
+	}
+	m.spent = time.Now()
+
+	if err != nil {
+		m.shown = nil
+		return errors.Wrap(err, "can't draw matrix frame")
+	}
+	m.shown, m.fill = &shown, false
+	if _, _, ok := firstChange(shown, m.target); ok {
+		m.next()
+	}
+	return nil
+}
+
+func firstChange(a, b Frame) (int, int, bool) {
+	for y := range a {
+		for x := range a[y] {
+			if a[y][x] != b[y][x] {
+				return x, y, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+func changedPixels(a, b Frame) int {
+	n := 0
+	for y := range a {
+		for x := range a[y] {
+			if a[y][x] != b[y][x] {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func dominantColor(f Frame) Color {
+	counts := make(map[Color]int)
+	best := Color{}
+	for y := range f {
+		for x := range f[y] {
+			c := f[y][x]
+			counts[c]++
+			if counts[c] > counts[best] {
+				best = c
+			}
+		}
+	}
+	return best
+}
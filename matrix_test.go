@@ -0,0 +1,271 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grid joins snapshot rows the way Frame.String prints them
+func grid(rows ...string) string {
+	return strings.Join(rows, "\n") + "\n"
+}
+
+func TestIconSnapshots(t *testing.T) {
+	snapshots := map[string]string{
+		"check": grid(
+			"........",
+			".......#",
+			"......##",
+			"#....##.",
+			"##..##..",
+			".####...",
+			"..##....",
+			"........",
+		),
+		"cross": grid(
+			"#......#",
+			".#....#.",
+			"..#..#..",
+			"...##...",
+			"...##...",
+			"..#..#..",
+			".#....#.",
+			"#......#",
+		),
+		"hourglass": grid(
+			"########",
+			".######.",
+			"..####..",
+			"...##...",
+			"...##...",
+			"..#..#..",
+			".#....#.",
+			"########",
+		),
+		"flame": grid(
+			"...#....",
+			"...##...",
+			"..###.#.",
+			"..#####.",
+			".######.",
+			".##..##.",
+			".##..##.",
+			"..####..",
+		),
+	}
+	for name, want := range snapshots {
+		t.Run(name, func(t *testing.T) {
+			f, ok := Icon(name, Color{Green: 255})
+			if !ok {
+				t.Fatal("unknown icon")
+			}
+			if got := f.String(); got != want {
+				t.Errorf("got\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+
+	if _, ok := Icon("rocket", Color{}); ok {
+		t.Error("drew an unknown icon")
+	}
+}
+
+func TestScrollTextSnapshots(t *testing.T) {
+	frames := ScrollText("Hi!", Color{Red: 255})
+
+	// 8 blank columns, 6 per character and 8 more blank columns, 8 wide
+	if len(frames) != 8+3*6+8-8+1 {
+		t.Fatalf("got %d frames", len(frames))
+	}
+
+	snapshots := []struct {
+		frame int
+		want  string
+	}{
+		{0, grid(
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+		)},
+		{4, grid(
+			"....#...",
+			"....#...",
+			"....#...",
+			"....####",
+			"....#...",
+			"....#...",
+			"....#...",
+			"........",
+		)},
+		{8, grid(
+			"#...#..#",
+			"#...#...",
+			"#...#...",
+			"#####...",
+			"#...#...",
+			"#...#...",
+			"#...#..#",
+			"........",
+		)},
+		{14, grid(
+			".###....",
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			".###....",
+			"........",
+		)},
+		{20, grid(
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			"..#.....",
+			"........",
+			"..#.....",
+			"........",
+		)},
+		{26, grid(
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+			"........",
+		)},
+	}
+	for _, s := range snapshots {
+		if got := frames[s.frame].String(); got != s.want {
+			t.Errorf("frame %d: got\n%s\nwant\n%s", s.frame, got, s.want)
+		}
+	}
+}
+
+func TestMatrixContentFrames(t *testing.T) {
+	mc := MatrixContent{Icon: "cross", Text: "{pipeline}"}
+	frames := mc.Frames(PipelineStatus{Pipeline: "ci", Status: StatusFailure})
+
+	icon, _ := Icon("cross", StatusFailure.Color())
+	text := ScrollText("ci", StatusFailure.Color())
+	if len(frames) != 10+len(text) {
+		t.Fatalf("got %d frames, want %d", len(frames), 10+len(text))
+	}
+	if frames[0] != icon || frames[9] != icon || frames[10] != text[0] {
+		t.Error("icon isn't shown before the pipeline name")
+	}
+	if frames[0][0][0] != StatusFailure.Color() {
+		t.Error("icon isn't drawn in the status color")
+	}
+}
+
+// matrixRecorder counts matrix writes
+type matrixRecorder struct {
+	mu            sync.Mutex
+	fills, pixels int
+}
+
+func (m *matrixRecorder) MatrixFill(c Color) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fills++
+	return nil
+}
+
+func (m *matrixRecorder) MatrixPixel(x, y uint8, c Color) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pixels++
+	return nil
+}
+
+func (m *matrixRecorder) counts() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fills, m.pixels
+}
+
+// waitForWrites waits until the recorder has seen exactly fills and
+// pixels, and nothing more arrives
+func waitForWrites(t *testing.T, rec *matrixRecorder, fills, pixels int) {
+	t.Helper()
+	waitFor(t, "the frame to be drawn", func() bool {
+		f, p := rec.counts()
+		return f >= fills && p >= pixels
+	})
+	time.Sleep(20 * time.Millisecond)
+	if f, p := rec.counts(); f != fills || p != pixels {
+		t.Errorf("%d fills and %d pixels, want %d and %d", f, p, fills, pixels)
+	}
+}
+
+func TestMatrixRendererDraws(t *testing.T) {
+	rec := &matrixRecorder{}
+	ready := true
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+	m := NewMatrixRenderer(MatrixConfig{Budget: 1000}, NewStatusRegistry(), rec, func() bool { return ready }, q)
+	defer runQueue(q)()
+
+	check, _ := Icon("check", Color{Green: 255})
+	m.show(check)
+	waitForWrites(t, rec, 1, 16)
+
+	// one pixel off only redraws that pixel
+	next := check
+	next[0][0] = Color{Green: 255}
+	m.show(next)
+	waitForWrites(t, rec, 1, 17)
+
+	// a reconnect redraws everything
+	ready = false
+	m.show(next)
+	ready = true
+	m.show(next)
+	waitForWrites(t, rec, 2, 34)
+}
+
+func TestMatrixWritesShareTheQueue(t *testing.T) {
+	rec := &matrixRecorder{}
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+	m := NewMatrixRenderer(MatrixConfig{Budget: 100}, NewStatusRegistry(), rec, func() bool { return true }, q)
+	defer runQueue(q)()
+
+	// every write is its own command, so a color set mid-frame goes out
+	// before the frame is finished
+	check, _ := Icon("check", Color{Green: 255})
+	m.show(check)
+	waitFor(t, "the frame to start", func() bool {
+		f, _ := rec.counts()
+		return f == 1
+	})
+
+	colored := make(chan int, 1)
+	q.Push(Command{Key: "color", Run: func() error {
+		_, p := rec.counts()
+		colored <- p
+		return nil
+	}})
+	select {
+	case p := <-colored:
+		if p >= 16 {
+			t.Errorf("color waited for all %d pixels", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("color never sent")
+	}
+
+	waitForWrites(t, rec, 1, 16)
+	if s := q.Stats(); s.Sent != 1+16+1 {
+		t.Errorf("queue sent %d commands, want one per write and the color", s.Sent)
+	}
+}
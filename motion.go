@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Mover is a robot that can roll, such as the ollie driver behind BB-8
+type Mover interface {
+	Roll(speed uint8, heading uint16)
+	SetRotationRate(speed uint8)
+	SetStabilization(state bool)
+	Stop()
+}
+
+// MotionStep rolls at Speed towards Heading, in degrees, for Duration.
+// At speed 0 the robot turns on the spot to face Heading.
+type MotionStep struct {
+	Speed    uint8    `json:"speed"`
+	Heading  uint16   `json:"heading"`
+	Duration Duration `json:"duration"`
+}
+
+// Choreography is a named sequence of motion steps. RotationRate sets how
+// quickly heading changes are applied; 0 keeps the robot's default.
+type Choreography struct {
+	RotationRate uint8        `json:"rotationRate,omitempty"`
+	Steps        []MotionStep `json:"steps"`
+}
+
+func step(speed uint8, heading uint16, d time.Duration) MotionStep {
+	return MotionStep{Speed: speed, Heading: heading, Duration: Duration(d)}
+}
+
+// choreographies are the built in choreographies, by name
+var choreographies = map[string]Choreography{
+	// a full turn on the spot
+	"spin": {
+		RotationRate: 0xFF,
+		Steps: []MotionStep{
+			step(0, 90, 200*time.Millisecond),
+			step(0, 180, 200*time.Millisecond),
+			step(0, 270, 200*time.Millisecond),
+			step(0, 0, 200*time.Millisecond),
+		},
+	},
+	// turning left and right a few times
+	"wiggle": {
+		RotationRate: 0xC0,
+		Steps: []MotionStep{
+			step(0, 30, 150*time.Millisecond),
+			step(0, 330, 150*time.Millisecond),
+			step(0, 30, 150*time.Millisecond),
+			step(0, 330, 150*time.Millisecond),
+			step(0, 0, 150*time.Millisecond),
+		},
+	},
+	// a short lurch forward and back
+	"nod": {
+		Steps: []MotionStep{
+			step(40, 0, 150*time.Millisecond),
+			step(40, 180, 150*time.Millisecond),
+			step(0, 0, 200*time.Millisecond),
+		},
+	},
+}
+
+// MotionConfig controls the choreographies. Nothing moves unless Enabled
+// is set, and no step rolls faster than MaxSpeed. Recovery plays when a
+// failing pipeline goes green and Failure when a pipeline starts failing;
+// Pipelines limits both to pipelines matching one of its wildcards.
+// Safety configures the supervisor watching the robot while it moves.
+type MotionConfig struct {
+	Enabled        bool                    `json:"enabled"`
+	MaxSpeed       uint8                   `json:"maxSpeed"`
+	Pipelines      []string                `json:"pipelines,omitempty"`
+	Recovery       string                  `json:"recovery"`
+	Failure        string                  `json:"failure"`
+	Choreographies map[string]Choreography `json:"choreographies,omitempty"`
+	Safety         SafetyConfig            `json:"safety"`
+}
+
+func DefaultMotionConfig() MotionConfig {
+	return MotionConfig{
+		MaxSpeed: 50,
+		Recovery: "spin",
+		Failure:  "wiggle",
+		Safety:   DefaultSafetyConfig(),
+	}
+}
+
+// queuedMover sends motion through the robot's command queue, so it keeps
+// its order and pace among the colors and everything else sent to the
+// robot
+type queuedMover struct {
+	locatingMover
+	queue *CommandQueue
+}
+
+func (m queuedMover) push(f func()) {
+	m.queue.Push(Command{Run: func() error {
+		f()
+		return nil
+	}})
+}
+
+func (m queuedMover) Roll(speed uint8, heading uint16) {
+	m.push(func() { m.locatingMover.Roll(speed, heading) })
+}
+
+func (m queuedMover) SetRotationRate(speed uint8) {
+	m.push(func() { m.locatingMover.SetRotationRate(speed) })
+}
+
+func (m queuedMover) SetStabilization(state bool) {
+	m.push(func() { m.locatingMover.SetStabilization(state) })
+}
+
+// Stop goes ahead of any queued motion, which it drops, and is still sent
+// if the robot only comes back later
+func (m queuedMover) Stop() {
+	m.queue.Interrupt(Command{Key: "stop", Run: func() error {
+		m.locatingMover.Stop()
+		return nil
+	}})
+}
+
+// Choreographer plays choreographies on the robot, one at a time
+type Choreographer struct {
+	cfg   MotionConfig
+	mover func() (Mover, bool)
+	guard *Supervisor
+
+	mu      sync.Mutex
+	playing bool
+}
+
+// NewChoreographer creates a choreographer. mover returns the robot when
+// it is connected and able to move.
+func NewChoreographer(cfg MotionConfig, mover func() (Mover, bool)) *Choreographer {
+	return &Choreographer{
+		cfg:   cfg,
+		mover: mover,
+		guard: NewSupervisor(cfg.Safety),
+	}
+}
+
+func (c *Choreographer) choreography(name string) (Choreography, bool) {
+	if ch, ok := c.cfg.Choreographies[name]; ok {
+		return ch, true
+	}
+	ch, ok := choreographies[name]
+	return ch, ok
+}
+
+// Play runs the named choreography and waits for it to finish. The robot
+// is always stopped at the end, and the supervisor watches it throughout.
+// A choreography asked for while another one plays is skipped.
+func (c *Choreographer) Play(name string) error {
+	if !c.cfg.Enabled {
+		return fmt.Errorf("motion is disabled")
+	}
+	ch, ok := c.choreography(name)
+	if !ok {
+		return fmt.Errorf("unknown choreography %q", name)
+	}
+	m, ok := c.mover()
+	if !ok {
+		return fmt.Errorf("no robot to move")
+	}
+
+	c.mu.Lock()
+	if c.playing {
+		c.mu.Unlock()
+		return fmt.Errorf("already playing a choreography")
+	}
+	c.playing = true
+	c.mu.Unlock()
+
+	m, err := c.guard.Begin(m)
+	if err != nil {
+		c.mu.Lock()
+		c.playing = false
+		c.mu.Unlock()
+		return err
+	}
+
+	defer func() {
+		m.Stop()
+		c.guard.End()
+		c.mu.Lock()
+		c.playing = false
+		c.mu.Unlock()
+	}()
+
+	log.Println("playing choreography", name)
+	m.SetStabilization(true)
+	if ch.RotationRate != 0 {
+		m.SetRotationRate(ch.RotationRate)
+	}
+	for _, s := range ch.Steps {
+		speed := s.Speed
+		if speed > c.cfg.MaxSpeed {
+			speed = c.cfg.MaxSpeed
+		}
+		m.Roll(speed, s.Heading%360)
+		time.Sleep(time.Duration(s.Duration))
+	}
+	return nil
+}
+
+// Playing reports whether a choreography is running
+func (c *Choreographer) Playing() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.playing
+}
+
+// Supervisor returns the safety supervisor watching the robot
+func (c *Choreographer) Supervisor() *Supervisor {
+	return c.guard
+}
+
+// Watch plays the recovery and failure choreographies as pipelines change
+func (c *Choreographer) Watch(transitions <-chan Transition) {
+	for t := range transitions {
+		if !c.cfg.Enabled || !c.watches(t.Pipeline) {
+			continue
+		}
+
+		var name string
+		switch {
+		case t.From == StatusFailure && t.To == StatusSuccess:
+			name = c.cfg.Recovery
+		case t.To == StatusFailure:
+			name = c.cfg.Failure
+		}
+		if name == "" {
+			continue
+		}
+
+		if err := c.Play(name); err != nil {
+			log.Println("error playing choreography", name, err)
+		}
+	}
+}
+
+func (c *Choreographer) watches(pipeline string) bool {
+	if len(c.cfg.Pipelines) == 0 {
+		return true
+	}
+	for _, pattern := range c.cfg.Pipelines {
+		if matchWildcard(pattern, pipeline) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP plays the choreography named by ?name= on POST
+func (c *Choreographer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := c.Play(r.URL.Query().Get("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+// rollingRobot moves 10cm towards the heading on every roll and reports
+// where it ended up
+type rollingRobot struct {
+	quietRobot
+
+	mu    sync.Mutex
+	pos   ollie.Point2D
+	rolls []string
+}
+
+func (r *rollingRobot) Roll(speed uint8, heading uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rolls = append(r.rolls, fmt.Sprintf("%d@%d", speed, heading))
+	if speed > 0 {
+		rad := float64(heading) * math.Pi / 180
+		r.pos.X += int16(math.Round(10 * math.Sin(rad)))
+		r.pos.Y += int16(math.Round(10 * math.Cos(rad)))
+	}
+}
+
+func (r *rollingRobot) GetLocatorData(f func(p ollie.Point2D)) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+	go f(pos)
+}
+
+func (r *rollingRobot) played() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.rolls...)
+}
+
+// testChoreographer plays on robot with the test safety timings
+func testChoreographer(cfg MotionConfig, robot Mover) *Choreographer {
+	safety := testSafetyConfig()
+	safety.ReturnHome, safety.HomeSpeed = cfg.Safety.ReturnHome, cfg.Safety.HomeSpeed
+	cfg.Enabled, cfg.Safety = true, safety
+	return NewChoreographer(cfg, func() (Mover, bool) { return robot, true })
+}
+
+func TestChoreographyClampsSpeedAndHeading(t *testing.T) {
+	tests := []struct {
+		name  string
+		step  MotionStep
+		max   uint8
+		wants string
+	}{
+		{"within limits", step(20, 90, time.Millisecond), 50, "20@90"},
+		{"too fast", step(200, 90, time.Millisecond), 50, "50@90"},
+		{"at the limit", step(50, 0, time.Millisecond), 50, "50@0"},
+		{"heading past a full turn", step(10, 450, time.Millisecond), 50, "10@90"},
+		{"turning on the spot", step(0, 720, time.Millisecond), 50, "0@0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			robot := &rollingRobot{}
+			c := testChoreographer(MotionConfig{
+				MaxSpeed:       tt.max,
+				Choreographies: map[string]Choreography{"test": {Steps: []MotionStep{tt.step}}},
+			}, robot)
+
+			if err := c.Play("test"); err != nil {
+				t.Fatal(err)
+			}
+			if rolls := robot.played(); len(rolls) != 1 || rolls[0] != tt.wants {
+				t.Errorf("rolled %q, want %s", rolls, tt.wants)
+			}
+		})
+	}
+}
+
+func TestChoreographyReturnsHome(t *testing.T) {
+	robot := &rollingRobot{}
+	c := testChoreographer(MotionConfig{
+		MaxSpeed: 50,
+		Safety:   SafetyConfig{ReturnHome: true, HomeSpeed: 20},
+		Choreographies: map[string]Choreography{"out": {Steps: []MotionStep{
+			step(40, 0, time.Millisecond),
+			step(40, 90, time.Millisecond),
+		}}},
+	}, robot)
+
+	if err := c.Play("out"); err != nil {
+		t.Fatal(err)
+	}
+
+	rolls := robot.played()
+	if len(rolls) < 3 || rolls[0] != "40@0" || rolls[1] != "40@90" {
+		t.Fatalf("rolled %q, want the steps and then the way home", rolls)
+	}
+	// from (10, 10) home is to the south west
+	if rolls[2] != "20@225" {
+		t.Errorf("headed home with %s, want 20@225", rolls[2])
+	}
+	robot.mu.Lock()
+	pos := robot.pos
+	robot.mu.Unlock()
+	if d := distance(ollie.Point2D{}, pos); d > homeTolerance {
+		t.Errorf("ended %vcm from home at %v", d, pos)
+	}
+	robot.quietRobot.mu.Lock()
+	stops := robot.stops
+	robot.quietRobot.mu.Unlock()
+	if stops == 0 {
+		t.Error("robot wasn't stopped")
+	}
+	if c.Playing() {
+		t.Error("still playing")
+	}
+}
+
+func TestChoreographyRefusals(t *testing.T) {
+	robot := &rollingRobot{}
+	c := testChoreographer(MotionConfig{}, robot)
+
+	if err := c.Play("no such dance"); err == nil {
+		t.Error("played an unknown choreography")
+	}
+
+	c.cfg.Enabled = false
+	if err := c.Play("spin"); err == nil {
+		t.Error("played with motion disabled")
+	}
+
+	c.cfg.Enabled = true
+	c.guard.trip("test")
+	if err := c.Play("spin"); err == nil {
+		t.Error("played after an emergency stop")
+	}
+	if rolls := robot.played(); len(rolls) != 0 {
+		t.Errorf("rolled %q", rolls)
+	}
+}
+
+func TestHeadingTo(t *testing.T) {
+	tests := []struct {
+		to   ollie.Point2D
+		want uint16
+	}{
+		{ollie.Point2D{X: 0, Y: 10}, 0},
+		{ollie.Point2D{X: 10, Y: 0}, 90},
+		{ollie.Point2D{X: 0, Y: -10}, 180},
+		{ollie.Point2D{X: -10, Y: 0}, 270},
+		{ollie.Point2D{X: 10, Y: 10}, 45},
+	}
+	for _, tt := range tests {
+		if got := headingTo(ollie.Point2D{}, tt.to); got != tt.want {
+			t.Errorf("heading to %v: got %d, want %d", tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestQueuedMoverStopsFirst(t *testing.T) {
+	robot := &rollingRobot{}
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+	m := queuedMover{robot, q}
+
+	// a trip while disconnected still stops the robot once it is back
+	m.Stop()
+	stop := runQueue(q)
+	defer stop()
+	m.Roll(20, 0)
+	waitFor(t, "the stop and the roll", func() bool { return q.Stats().Sent == 2 })
+
+	robot.quietRobot.mu.Lock()
+	defer robot.quietRobot.mu.Unlock()
+	if robot.stops != 1 {
+		t.Errorf("stopped %d times, want once", robot.stops)
+	}
+}
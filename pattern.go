@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Pattern is a sequence of intervals that loops while the plan is idle
+type Pattern []Interval
+
+// PatternStyle names one of the built-in ways to animate a color
+type PatternStyle string
+
+const (
+	StyleSteady PatternStyle = "steady"
+	StyleBlink  PatternStyle = "blink"
+	StylePulse  PatternStyle = "pulse"
+	StyleStrobe PatternStyle = "strobe"
+)
+
+// Pattern animates c in this style
+func (s PatternStyle) Pattern(c Color) Pattern {
+	switch s {
+	case StyleBlink:
+		return Blink(c, time.Second)
+	case StylePulse:
+		return Pulse(c)
+	case StyleStrobe:
+		return Blink(c, 200*time.Millisecond)
+	}
+	return Steady(c)
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *PatternStyle) UnmarshalText(text []byte) error {
+	switch style := PatternStyle(text); style {
+	case StyleSteady, StyleBlink, StylePulse, StyleStrobe:
+		*s = style
+		return nil
+	}
+	return fmt.Errorf("unknown pattern %q", text)
+}
+
+// Steady shows c, refreshing it once a minute
+func Steady(c Color) Pattern {
+	return Pattern{c.For(time.Minute)}
+}
+
+// Blink alternates between c and off, once per period
+func Blink(c Color, period time.Duration) Pattern {
+	return Pattern{c.For(period / 2), Color{}.For(period / 2)}
+}
+
+// Pulse ramps the brightness of c up and down
+func Pulse(c Color) Pattern {
+	levels := []float64{0.2, 0.4, 0.6, 0.8, 1, 0.8, 0.6, 0.4}
+	p := make(Pattern, len(levels))
+	for i, level := range levels {
+		p[i] = c.Scale(level).For(150 * time.Millisecond)
+	}
+	return p
+}
+
+// For returns an interval showing c for d
+func (c Color) For(d time.Duration) Interval {
+	return Interval{
+		DurationMillis: d.Milliseconds(),
+		R:              c.Red,
+		G:              c.Green,
+		B:              c.Blue,
+	}
+}
+
+// Scale dims c by f, which should be between 0 and 1
+func (c Color) Scale(f float64) Color {
+	return Color{
+		Red:   uint8(float64(c.Red) * f),
+		Green: uint8(float64(c.Green) * f),
+		Blue:  uint8(float64(c.Blue) * f),
+	}
+}
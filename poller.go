@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxPollBackoff = 10 * time.Minute
+
+// PollerConfig describes one pipeline to poll from a CI provider's REST
+// API. Repo is "owner/name" for GitHub and the project path or ID for
+// GitLab; Job is the slash separated job path for Jenkins. BaseURL
+// overrides the provider's public API for self-hosted instances.
+type PollerConfig struct {
+	Name     string   `json:"name"`
+	Provider string   `json:"provider"`
+	BaseURL  string   `json:"baseURL,omitempty"`
+	Repo     string   `json:"repo,omitempty"`
+	Branch   string   `json:"branch,omitempty"`
+	Job      string   `json:"job,omitempty"`
+	User     string   `json:"user,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// ciProvider knows how to ask one CI system for the latest run of a
+// pipeline. ok is false when the run has no meaningful status.
+type ciProvider interface {
+	request(cfg PollerConfig) (*http.Request, error)
+	parse(body []byte) (status Status, ok bool, err error)
+}
+
+var ciProviders = map[string]ciProvider{
+	"github":  githubActions{},
+	"gitlab":  gitlabPipelines{},
+	"jenkins": jenkinsJobs{},
+}
+
+type pollTarget struct {
+	cfg      PollerConfig
+	provider ciProvider
+
+	etag         string
+	lastModified string
+	failures     int
+}
+
+func (t *pollTarget) pipeline() string {
+	if t.cfg.Name != "" {
+		return t.cfg.Name
+	}
+	if t.cfg.Job != "" {
+		return t.cfg.Provider + ":" + t.cfg.Job
+	}
+	return t.cfg.Provider + ":" + t.cfg.Repo + "@" + t.cfg.Branch
+}
+
+// Poller periodically queries CI providers and feeds the latest run of
+// each configured pipeline into the status registry. It is the way in for
+// robots that can't receive webhooks.
+type Poller struct {
+	registry *StatusRegistry
+	client   *http.Client
+	targets  []*pollTarget
+	stop     chan struct{}
+}
+
+func NewPoller(cfgs []PollerConfig, registry *StatusRegistry) (*Poller, error) {
+	p := &Poller{
+		registry: registry,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		stop:     make(chan struct{}),
+	}
+
+	for _, cfg := range cfgs {
+		provider, ok := ciProviders[cfg.Provider]
+		if !ok {
+			return nil, fmt.Errorf("unknown CI provider %q", cfg.Provider)
+		}
+		if cfg.Provider == "jenkins" && cfg.BaseURL == "" {
+			return nil, fmt.Errorf("jenkins poller %s needs a baseURL", cfg.Job)
+		}
+		p.targets = append(p.targets, &pollTarget{cfg: cfg, provider: provider})
+	}
+	return p, nil
+}
+
+// Start polls every target on its own interval until Stop is called
+func (p *Poller) Start() {
+	for _, t := range p.targets {
+		go p.loop(t)
+	}
+}
+
+func (p *Poller) Stop() { close(p.stop) }
+
+func (p *Poller) loop(t *pollTarget) {
+	for {
+		wait := p.poll(t)
+
+		select {
+		case <-time.After(wait):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// poll checks a target once and returns how long to wait before the next
+// check, honoring rate limits and backing off on errors
+func (p *Poller) poll(t *pollTarget) time.Duration {
+	interval := t.cfg.Interval.Or(time.Minute)
+
+	req, err := t.provider.request(t.cfg)
+	if err != nil {
+		log.Println("poller", t.pipeline(), "can't build request", err)
+		return maxPollBackoff
+	}
+	if t.etag != "" {
+		req.Header.Set("If-None-Match", t.etag)
+	}
+	if t.lastModified != "" {
+		req.Header.Set("If-Modified-Since", t.lastModified)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return t.backoff(interval, err)
+	}
+	defer resp.Body.Close()
+
+	if wait, limited := rateLimitWait(resp); limited {
+		// a limit without a usable reset time backs off like an error,
+		// and no limit polls faster than the interval
+		if wait <= 0 {
+			wait = t.backoff(interval, fmt.Errorf("rate limited with %s", resp.Status))
+		}
+		if wait < interval {
+			wait = interval
+		}
+		log.Println("poller", t.pipeline(), "rate limited for", wait)
+		return wait
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		t.failures = 0
+		return interval
+	case resp.StatusCode != http.StatusOK:
+		return t.backoff(interval, fmt.Errorf("got status %s", resp.Status))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return t.backoff(interval, err)
+	}
+	status, ok, err := t.provider.parse(body)
+	if err != nil {
+		return t.backoff(interval, err)
+	}
+
+	t.failures = 0
+	t.etag = resp.Header.Get("ETag")
+	t.lastModified = resp.Header.Get("Last-Modified")
+	if ok {
+		p.registry.Set(t.pipeline(), status, "poll:"+t.cfg.Provider)
+	}
+	return interval
+}
+
+// backoff doubles the wait after every consecutive failure, with jitter
+func (t *pollTarget) backoff(interval time.Duration, err error) time.Duration {
+	t.failures++
+	log.Println("poller", t.pipeline(), "failed", t.failures, "times:", err)
+
+	wait := interval
+	for i := 1; i < t.failures && wait < maxPollBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxPollBackoff {
+		wait = maxPollBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// rateLimitWait reads the rate limit headers used by GitHub and GitLab
+// and the standard Retry-After header. The wait is zero or less when the
+// response is limited but says nothing useful about when it ends.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusForbidden {
+		return 0, false
+	}
+
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if secs, err := strconv.Atoi(s); err == nil {
+			return time.Duration(secs) * time.Second, true
+		}
+		if at, err := http.ParseTime(s); err == nil {
+			return time.Until(at), true
+		}
+	}
+
+	for _, prefix := range []string{"X-RateLimit-", "RateLimit-"} {
+		if resp.Header.Get(prefix+"Remaining") != "0" {
+			continue
+		}
+		if reset, err := strconv.ParseInt(resp.Header.Get(prefix+"Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0)) + time.Second, true
+		}
+		return time.Minute, true
+	}
+
+	return 0, resp.StatusCode == http.StatusTooManyRequests
+}
+
+type githubActions struct{}
+
+func (githubActions) request(cfg PollerConfig) (*http.Request, error) {
+	base := firstNonEmpty(cfg.BaseURL, "https://api.github.com")
+	q := url.Values{"per_page": {"1"}}
+	if cfg.Branch != "" {
+		q.Set("branch", cfg.Branch)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, base+"/repos/"+cfg.Repo+"/actions/runs?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	return req, nil
+}
+
+func (githubActions) parse(body []byte) (Status, bool, error) {
+	var runs struct {
+		WorkflowRuns []struct {
+			Status     string `json:"status"`
+			Conclusion string `json:"conclusion"`
+		} `json:"workflow_runs"`
+	}
+	if err := json.Unmarshal(body, &runs); err != nil {
+		return StatusUnknown, false, err
+	}
+	if len(runs.WorkflowRuns) == 0 {
+		return StatusUnknown, false, nil
+	}
+
+	run := runs.WorkflowRuns[0]
+	if run.Status != "completed" {
+		return StatusRunning, true, nil
+	}
+	switch run.Conclusion {
+	case "success", "neutral", "skipped":
+		return StatusSuccess, true, nil
+	case "failure", "timed_out", "startup_failure":
+		return StatusFailure, true, nil
+	}
+	return StatusUnknown, false, nil
+}
+
+type gitlabPipelines struct{}
+
+func (gitlabPipelines) request(cfg PollerConfig) (*http.Request, error) {
+	base := firstNonEmpty(cfg.BaseURL, "https://gitlab.com")
+	q := url.Values{"per_page": {"1"}}
+	if cfg.Branch != "" {
+		q.Set("ref", cfg.Branch)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, base+"/api/v4/projects/"+url.PathEscape(cfg.Repo)+"/pipelines?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", cfg.Token)
+	}
+	return req, nil
+}
+
+func (gitlabPipelines) parse(body []byte) (Status, bool, error) {
+	var pipelines []struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &pipelines); err != nil {
+		return StatusUnknown, false, err
+	}
+	if len(pipelines) == 0 {
+		return StatusUnknown, false, nil
+	}
+
+	switch pipelines[0].Status {
+	case "created", "waiting_for_resource", "preparing", "pending", "running":
+		return StatusRunning, true, nil
+	case "success":
+		return StatusSuccess, true, nil
+	case "failed":
+		return StatusFailure, true, nil
+	}
+	return StatusUnknown, false, nil
+}
+
+type jenkinsJobs struct{}
+
+func (jenkinsJobs) request(cfg PollerConfig) (*http.Request, error) {
+	var path strings.Builder
+	for _, part := range strings.Split(strings.Trim(cfg.Job, "/"), "/") {
+		path.WriteString("/job/" + url.PathEscape(part))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(cfg.BaseURL, "/")+path.String()+"/lastBuild/api/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.User != "" {
+		req.SetBasicAuth(cfg.User, cfg.Token)
+	}
+	return req, nil
+}
+
+func (jenkinsJobs) parse(body []byte) (Status, bool, error) {
+	var build struct {
+		Building bool   `json:"building"`
+		Result   string `json:"result"`
+	}
+	if err := json.Unmarshal(body, &build); err != nil {
+		return StatusUnknown, false, err
+	}
+
+	if build.Building {
+		return StatusRunning, true, nil
+	}
+	switch build.Result {
+	case "SUCCESS":
+		return StatusSuccess, true, nil
+	case "UNSTABLE":
+		return StatusDegraded, true, nil
+	case "FAILURE":
+		return StatusFailure, true, nil
+	}
+	return StatusUnknown, false, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Trimmed responses recorded from each provider's API
+const (
+	githubRunsSuccess  = `{"total_count":1,"workflow_runs":[{"id":1,"status":"completed","conclusion":"success"}]}`
+	githubRunsRunning  = `{"total_count":1,"workflow_runs":[{"id":2,"status":"in_progress","conclusion":null}]}`
+	gitlabPipelineList = `[{"id":7,"ref":"main","status":"failed"}]`
+	jenkinsBuild       = `{"building":false,"result":"UNSTABLE","number":12}`
+)
+
+// stubCI answers polls with the next recorded response
+type stubCI struct {
+	t         *testing.T
+	responses []func(w http.ResponseWriter, r *http.Request)
+	requests  []*http.Request
+}
+
+func (s *stubCI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests = append(s.requests, r)
+	if len(s.requests) > len(s.responses) {
+		s.t.Errorf("unexpected poll %d", len(s.requests))
+		http.Error(w, "no more responses", http.StatusInternalServerError)
+		return
+	}
+	s.responses[len(s.requests)-1](w, r)
+}
+
+func respond(status int, body string, headers ...string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+func newTestPoller(t *testing.T, cfg PollerConfig, stub *stubCI) (*Poller, *pollTarget) {
+	t.Helper()
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+
+	cfg.BaseURL = srv.URL
+	p, err := NewPoller([]PollerConfig{cfg}, NewStatusRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, p.targets[0]
+}
+
+func TestPollerProviders(t *testing.T) {
+	tests := []struct {
+		cfg  PollerConfig
+		body string
+		want Status
+	}{
+		{PollerConfig{Provider: "github", Repo: "o/r", Branch: "main"}, githubRunsSuccess, StatusSuccess},
+		{PollerConfig{Provider: "github", Repo: "o/r"}, githubRunsRunning, StatusRunning},
+		{PollerConfig{Provider: "gitlab", Repo: "group/project"}, gitlabPipelineList, StatusFailure},
+		{PollerConfig{Provider: "jenkins", Job: "folder/job"}, jenkinsBuild, StatusDegraded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Provider, func(t *testing.T) {
+			stub := &stubCI{t: t, responses: []func(http.ResponseWriter, *http.Request){respond(http.StatusOK, tt.body)}}
+			p, target := newTestPoller(t, tt.cfg, stub)
+
+			p.poll(target)
+			ps, ok := p.registry.Get(target.pipeline())
+			if !ok || ps.Status != tt.want {
+				t.Fatalf("got %+v, want %s", ps, tt.want)
+			}
+		})
+	}
+}
+
+func TestPollerETag(t *testing.T) {
+	stub := &stubCI{t: t, responses: []func(http.ResponseWriter, *http.Request){
+		respond(http.StatusOK, githubRunsSuccess, "ETag", `"v1"`),
+		respond(http.StatusNotModified, ""),
+	}}
+	interval := time.Minute
+	p, target := newTestPoller(t, PollerConfig{Provider: "github", Repo: "o/r", Interval: Duration(interval)}, stub)
+
+	if wait := p.poll(target); wait != interval {
+		t.Errorf("first poll waits %s, want %s", wait, interval)
+	}
+	if wait := p.poll(target); wait != interval {
+		t.Errorf("not modified poll waits %s, want %s", wait, interval)
+	}
+	if got := stub.requests[1].Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("second poll sent If-None-Match %q", got)
+	}
+	if ps, _ := p.registry.Get(target.pipeline()); ps.Status != StatusSuccess {
+		t.Errorf("not modified changed status to %s", ps.Status)
+	}
+}
+
+func TestPollerRateLimits(t *testing.T) {
+	interval := time.Minute
+	past := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		resp    func(http.ResponseWriter, *http.Request)
+		min     time.Duration
+		max     time.Duration
+		failure bool
+	}{
+		{"retry after seconds", respond(http.StatusTooManyRequests, "", "Retry-After", "120"), 2 * time.Minute, 2 * time.Minute, false},
+		{"short retry after", respond(http.StatusTooManyRequests, "", "Retry-After", "1"), interval, interval, false},
+		{"retry after in the past", respond(http.StatusTooManyRequests, "", "Retry-After", past.UTC().Format(http.TimeFormat)), interval, interval, true},
+		{"reset passed", respond(http.StatusForbidden, "", "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", strconv.FormatInt(past.Unix(), 10)), interval, interval, true},
+		{"reset ahead", respond(http.StatusForbidden, "", "X-RateLimit-Remaining", "0", "X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(5*time.Minute).Unix(), 10)), 4 * time.Minute, 6 * time.Minute, false},
+		{"no headers", respond(http.StatusTooManyRequests, ""), interval, interval, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubCI{t: t, responses: []func(http.ResponseWriter, *http.Request){tt.resp}}
+			p, target := newTestPoller(t, PollerConfig{Provider: "github", Repo: "o/r", Interval: Duration(interval)}, stub)
+
+			wait := p.poll(target)
+			if wait < tt.min || wait > tt.max {
+				t.Errorf("waits %s, want %s to %s", wait, tt.min, tt.max)
+			}
+			if failed := target.failures > 0; failed != tt.failure {
+				t.Errorf("counted as failure: %v, want %v", failed, tt.failure)
+			}
+		})
+	}
+}
+
+func TestPollerRateLimitBacksOff(t *testing.T) {
+	interval := time.Minute
+	limited := respond(http.StatusTooManyRequests, "")
+	stub := &stubCI{t: t, responses: []func(http.ResponseWriter, *http.Request){limited, limited, limited, limited}}
+	p, target := newTestPoller(t, PollerConfig{Provider: "github", Repo: "o/r", Interval: Duration(interval)}, stub)
+
+	var wait time.Duration
+	for range stub.responses {
+		wait = p.poll(target)
+	}
+	// the fourth failure in a row waits 8 intervals, less up to half jitter
+	if wait < 4*interval {
+		t.Errorf("still waiting %s after repeated limits", wait)
+	}
+}
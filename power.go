@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PowerConfig decides how long the light stays connected. Refresh sends
+// the current color again that often, which also keeps the link alive.
+// Once the light has been black for Linger it is disconnected, unless it
+// is working hours, when it stays connected so the next color doesn't
+// wait for a scan. After SleepAfter of black the robot is put to sleep
+// and disconnected even in working hours; zero leaves sleeping to the
+// robot. A pipeline changing to one of the Wake statuses connects ahead
+// of its color.
+type PowerConfig struct {
+	Refresh      Duration      `json:"refresh"`
+	Linger       Duration      `json:"linger"`
+	SleepAfter   Duration      `json:"sleepAfter"`
+	WorkingHours *WorkingHours `json:"workingHours,omitempty"`
+	Wake         []Status      `json:"wake"`
+}
+
+func DefaultPowerConfig() PowerConfig {
+	return PowerConfig{
+		Refresh: Duration(time.Minute),
+		Linger:  Duration(30 * time.Second),
+		Wake:    []Status{StatusRunning},
+	}
+}
+
+// WorkingHours is a daily span such as 09:00 to 18:00 on Days, which are
+// weekday names like "mon" and default to Monday to Friday. Spans ending
+// before they start run past midnight, and ones ending when they start
+// last all day. Location defaults to local time.
+type WorkingHours struct {
+	Days     []string `json:"days"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Location string   `json:"location"`
+}
+
+// PowerPolicy applies a PowerConfig and reports what the light is doing
+type PowerPolicy struct {
+	cfg   PowerConfig
+	days  map[time.Weekday]bool
+	start time.Duration
+	end   time.Duration
+	loc   *time.Location
+
+	mu    sync.Mutex
+	state string
+	since time.Time
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func NewPowerPolicy(cfg PowerConfig) (*PowerPolicy, error) {
+	p := &PowerPolicy{cfg: cfg, state: "disconnected", since: time.Now()}
+	hours := cfg.WorkingHours
+	if hours == nil {
+		return p, nil
+	}
+
+	var err error
+	if p.start, err = parseClock(hours.Start); err != nil {
+		return nil, errors.Wrap(err, "bad working hours start")
+	}
+	if p.end, err = parseClock(hours.End); err != nil {
+		return nil, errors.Wrap(err, "bad working hours end")
+	}
+	p.loc = time.Local
+	if hours.Location != "" {
+		if p.loc, err = time.LoadLocation(hours.Location); err != nil {
+			return nil, errors.Wrap(err, "bad working hours location")
+		}
+	}
+
+	days := hours.Days
+	if len(days) == 0 {
+		days = []string{"mon", "tue", "wed", "thu", "fri"}
+	}
+	p.days = make(map[time.Weekday]bool)
+	for _, day := range days {
+		key := strings.ToLower(day)
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		wd, ok := weekdays[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown working day %q", day)
+		}
+		p.days[wd] = true
+	}
+	return p, nil
+}
+
+// parseClock turns "15:04" into the time since midnight
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Refresh is how often the color is sent again
+func (p *PowerPolicy) Refresh() time.Duration {
+	return p.cfg.Refresh.Or(time.Minute)
+}
+
+// Linger is how long a black light stays connected outside working hours
+func (p *PowerPolicy) Linger() time.Duration {
+	return p.cfg.Linger.Or(30 * time.Second)
+}
+
+// WorkingHours reports whether the light should stay connected at now
+func (p *PowerPolicy) WorkingHours(now time.Time) bool {
+	if p.days == nil {
+		return false
+	}
+	now = now.In(p.loc)
+	day := now.Weekday()
+	clock := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, p.loc))
+	if p.start == p.end {
+		return p.days[day]
+	}
+	if p.start < p.end {
+		return p.days[day] && clock >= p.start && clock < p.end
+	}
+	// past midnight the span belongs to the day before
+	yesterday := (day + 6) % 7
+	return p.days[day] && clock >= p.start || p.days[yesterday] && clock < p.end
+}
+
+// Idle says what to do with a light that has been black for idle: sleep
+// puts it to sleep first, and disconnect lets it go
+func (p *PowerPolicy) Idle(now time.Time, idle time.Duration) (disconnect, sleep bool) {
+	if p.cfg.SleepAfter > 0 && idle >= time.Duration(p.cfg.SleepAfter) {
+		return true, true
+	}
+	if idle >= p.Linger() && !p.WorkingHours(now) {
+		return true, false
+	}
+	return false, false
+}
+
+// Wakes reports whether a pipeline changing to status should connect
+func (p *PowerPolicy) Wakes(status Status) bool {
+	for _, s := range p.cfg.Wake {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// set records what the light is doing
+func (p *PowerPolicy) set(state string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state != state {
+		p.state, p.since = state, time.Now()
+	}
+}
+
+// ServeHTTP shows the light's power state
+func (p *PowerPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p.mu.Lock()
+	state := struct {
+		State        string      `json:"state"`
+		Since        time.Time   `json:"since"`
+		WorkingHours bool        `json:"workingHours"`
+		Config       PowerConfig `json:"config"`
+	}{p.state, p.since, p.WorkingHours(time.Now()), p.cfg}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const probeHistorySize = 20
+
+// ProbeConfig describes one uptime check. HTTP probes set URL, TCP probes
+// set Address. A result slower than Latency counts as degraded.
+type ProbeConfig struct {
+	Name         string   `json:"name"`
+	URL          string   `json:"url,omitempty"`
+	Address      string   `json:"address,omitempty"`
+	ExpectStatus int      `json:"expectStatus,omitempty"`
+	ExpectBody   string   `json:"expectBody,omitempty"`
+	Latency      Duration `json:"latency,omitempty"`
+	Interval     Duration `json:"interval,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+
+	// Threshold is how many consecutive results must agree before the
+	// reported status changes, to suppress flapping
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// ProbeResult is the outcome of a single check
+type ProbeResult struct {
+	Status    Status        `json:"status"`
+	Latency   time.Duration `json:"latency"`
+	Error     string        `json:"error,omitempty"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// ProbeState is what the probe-results API reports for a probe
+type ProbeState struct {
+	Name    string        `json:"name"`
+	Target  string        `json:"target"`
+	Status  Status        `json:"status"`
+	Results []ProbeResult `json:"results"`
+}
+
+type probe struct {
+	cfg    ProbeConfig
+	client *http.Client
+
+	status    Status
+	candidate Status
+	streak    int
+	results   []ProbeResult
+}
+
+func (p *probe) pipeline() string { return "probe:" + p.cfg.Name }
+
+func (p *probe) target() string {
+	if p.cfg.URL != "" {
+		return p.cfg.URL
+	}
+	return p.cfg.Address
+}
+
+// Prober periodically runs the configured probes and feeds their status
+// into the registry
+type Prober struct {
+	registry *StatusRegistry
+
+	mu     sync.Mutex
+	probes []*probe
+	stop   chan struct{}
+}
+
+func NewProber(cfgs []ProbeConfig, registry *StatusRegistry) (*Prober, error) {
+	pr := &Prober{
+		registry: registry,
+		stop:     make(chan struct{}),
+	}
+
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("probe without a name")
+		}
+		if (cfg.URL == "") == (cfg.Address == "") {
+			return nil, fmt.Errorf("probe %s needs exactly one of url or address", cfg.Name)
+		}
+		if cfg.ExpectStatus == 0 {
+			cfg.ExpectStatus = http.StatusOK
+		}
+		if cfg.Threshold <= 0 {
+			cfg.Threshold = 2
+		}
+		pr.probes = append(pr.probes, &probe{
+			cfg:    cfg,
+			client: &http.Client{Timeout: cfg.Timeout.Or(10 * time.Second)},
+		})
+	}
+	return pr, nil
+}
+
+// Start runs every probe on its own interval until Stop is called
+func (pr *Prober) Start() {
+	for _, p := range pr.probes {
+		go pr.loop(p)
+	}
+}
+
+func (pr *Prober) Stop() { close(pr.stop) }
+
+func (pr *Prober) loop(p *probe) {
+	ticker := time.NewTicker(p.cfg.Interval.Or(time.Minute))
+	defer ticker.Stop()
+
+	for {
+		pr.record(p, p.check())
+
+		select {
+		case <-ticker.C:
+		case <-pr.stop:
+			return
+		}
+	}
+}
+
+func (p *probe) check() ProbeResult {
+	start := time.Now()
+	var err error
+	if p.cfg.URL != "" {
+		err = p.checkHTTP()
+	} else {
+		err = p.checkTCP()
+	}
+
+	res := ProbeResult{
+		Status:    StatusSuccess,
+		Latency:   time.Since(start),
+		CheckedAt: start,
+	}
+	switch {
+	case err != nil:
+		res.Status = StatusFailure
+		res.Error = err.Error()
+	case p.cfg.Latency > 0 && res.Latency > time.Duration(p.cfg.Latency):
+		res.Status = StatusDegraded
+		res.Error = fmt.Sprintf("latency %s over %s", res.Latency, time.Duration(p.cfg.Latency))
+	}
+	return res
+}
+
+func (p *probe) checkHTTP() error {
+	resp, err := p.client.Get(p.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != p.cfg.ExpectStatus {
+		return fmt.Errorf("got status %d, want %d", resp.StatusCode, p.cfg.ExpectStatus)
+	}
+	if p.cfg.ExpectBody == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), p.cfg.ExpectBody) {
+		return fmt.Errorf("body does not contain %q", p.cfg.ExpectBody)
+	}
+	return nil
+}
+
+func (p *probe) checkTCP() error {
+	conn, err := net.DialTimeout("tcp", p.cfg.Address, p.client.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// record keeps the result and, once Threshold results in a row agree,
+// moves the probe to the new status
+func (pr *Prober) record(p *probe, res ProbeResult) {
+	pr.mu.Lock()
+	p.results = append(p.results, res)
+	if len(p.results) > probeHistorySize {
+		p.results = p.results[len(p.results)-probeHistorySize:]
+	}
+
+	if res.Status != p.candidate {
+		p.candidate = res.Status
+		p.streak = 0
+	}
+	p.streak++
+
+	changed := false
+	if p.status == StatusUnknown || (p.candidate != p.status && p.streak >= p.cfg.Threshold) {
+		changed = p.status != p.candidate
+		p.status = p.candidate
+	}
+	status := p.status
+	pr.mu.Unlock()
+
+	if res.Error != "" {
+		log.Println("probe", p.cfg.Name, res.Status, res.Error)
+	}
+	if changed {
+		pr.registry.Set(p.pipeline(), status, "probe")
+	}
+}
+
+// States returns the current state and recent results of every probe
+func (pr *Prober) States() []ProbeState {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	states := make([]ProbeState, 0, len(pr.probes))
+	for _, p := range pr.probes {
+		states = append(states, ProbeState{
+			Name:    p.cfg.Name,
+			Target:  p.target(),
+			Status:  p.status,
+			Results: append([]ProbeResult(nil), p.results...),
+		})
+	}
+	return states
+}
+
+// ServeHTTP lists probe results
+func (pr *Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pr.States())
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestProbe(t *testing.T, cfg ProbeConfig) (*Prober, *probe) {
+	t.Helper()
+	if cfg.Name == "" {
+		cfg.Name = "test"
+	}
+	pr, err := NewProber([]ProbeConfig{cfg}, NewStatusRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pr, pr.probes[0]
+}
+
+func TestProbeHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			fmt.Fprint(w, "all systems go")
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, "all systems go")
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		cfg  ProbeConfig
+		want Status
+	}{
+		{"ok", ProbeConfig{URL: srv.URL + "/ok"}, StatusSuccess},
+		{"missing", ProbeConfig{URL: srv.URL + "/missing"}, StatusFailure},
+		{"expected status", ProbeConfig{URL: srv.URL + "/teapot", ExpectStatus: http.StatusTeapot}, StatusSuccess},
+		{"body", ProbeConfig{URL: srv.URL + "/ok", ExpectBody: "systems go"}, StatusSuccess},
+		{"wrong body", ProbeConfig{URL: srv.URL + "/ok", ExpectBody: "on fire"}, StatusFailure},
+		{"slow", ProbeConfig{URL: srv.URL + "/slow", Latency: Duration(10 * time.Millisecond)}, StatusDegraded},
+		{"slow within latency", ProbeConfig{URL: srv.URL + "/slow", Latency: Duration(5 * time.Second)}, StatusSuccess},
+		{"timeout", ProbeConfig{URL: srv.URL + "/slow", Timeout: Duration(10 * time.Millisecond)}, StatusFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, p := newTestProbe(t, tt.cfg)
+			if res := p.check(); res.Status != tt.want {
+				t.Errorf("got %s (%s), want %s", res.Status, res.Error, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	_, p := newTestProbe(t, ProbeConfig{Address: addr})
+	if res := p.check(); res.Status != StatusSuccess {
+		t.Errorf("open port: got %s (%s)", res.Status, res.Error)
+	}
+
+	l.Close()
+	if res := p.check(); res.Status != StatusFailure {
+		t.Errorf("closed port: got %s", res.Status)
+	}
+}
+
+func TestProbeFlapSuppression(t *testing.T) {
+	pr, p := newTestProbe(t, ProbeConfig{Address: "localhost:1", Threshold: 3})
+	result := func(s Status) ProbeResult { return ProbeResult{Status: s} }
+
+	steps := []struct {
+		result Status
+		want   Status
+	}{
+		// the first result sets the status right away
+		{StatusSuccess, StatusSuccess},
+		{StatusFailure, StatusSuccess},
+		{StatusSuccess, StatusSuccess},
+		{StatusFailure, StatusSuccess},
+		{StatusFailure, StatusSuccess},
+		{StatusFailure, StatusFailure},
+		{StatusSuccess, StatusFailure},
+	}
+	for i, step := range steps {
+		pr.record(p, result(step.result))
+		if got := pr.States()[0].Status; got != step.want {
+			t.Fatalf("step %d: got %s, want %s", i, got, step.want)
+		}
+	}
+
+	if ps, ok := pr.registry.Get(p.pipeline()); !ok || ps.Status != StatusFailure {
+		t.Errorf("registry has %+v, want failure", ps)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// QueueConfig paces commands to a device. Interval is the least time
+// between two commands.
+type QueueConfig struct {
+	Interval Duration `json:"interval"`
+}
+
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		Interval: Duration(50 * time.Millisecond),
+	}
+}
+
+// Command is something to send to a device. A command with a Key replaces
+// a queued command with the same key, because only the latest one
+// matters, such as a color. Commands without a key, such as motion, run
+// in order and belong to the connection they were queued on: they are
+// dropped while the queue isn't running rather than sent after a
+// reconnect.
+type Command struct {
+	Key string
+	Run func() error
+}
+
+type queuedCommand struct {
+	Command
+	queued  time.Time
+	retries int
+}
+
+// timeoutRetries is how often a keyed command that timed out is tried again
+const timeoutRetries = 2
+
+// QueueStats counts what went through a CommandQueue. Write is how long
+// commands took to run and Wait how long they were queued.
+type QueueStats struct {
+	Pending   int      `json:"pending"`
+	Sent      int      `json:"sent"`
+	Coalesced int      `json:"coalesced"`
+	Dropped   int      `json:"dropped"`
+	Failed    int      `json:"failed"`
+	LastWrite Duration `json:"lastWrite"`
+	MaxWrite  Duration `json:"maxWrite"`
+	AvgWrite  Duration `json:"avgWrite"`
+	LastWait  Duration `json:"lastWait"`
+}
+
+// CommandQueue sends commands to one device, dropping superseded ones and
+// keeping at least the configured interval between them
+type CommandQueue struct {
+	cfg QueueConfig
+
+	mu      sync.Mutex
+	running bool
+	pending []*queuedCommand
+	wake    chan struct{}
+	stats   QueueStats
+}
+
+func NewCommandQueue(cfg QueueConfig) *CommandQueue {
+	return &CommandQueue{
+		cfg:  cfg,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Push queues a command without waiting for it to run
+func (q *CommandQueue) Push(c Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if c.Key == "" && !q.running {
+		log.Println("dropping command queued while disconnected")
+		q.stats.Dropped++
+		return
+	}
+	if c.Key != "" {
+		for _, p := range q.pending {
+			if p.Key == c.Key {
+				p.Run = c.Run
+				q.stats.Coalesced++
+				return
+			}
+		}
+	}
+	q.pending = append(q.pending, &queuedCommand{Command: c, queued: time.Now()})
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Interrupt puts a keyed command such as an emergency stop ahead of
+// everything queued and drops the queued commands without a key, such as
+// motion that would undo it. Like other keyed commands it is kept while
+// the queue isn't running.
+func (q *CommandQueue) Interrupt(c Command) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := []*queuedCommand{{Command: c, queued: time.Now()}}
+	dropped := 0
+	for _, p := range q.pending {
+		switch p.Key {
+		case "":
+			dropped++
+		case c.Key:
+			q.stats.Coalesced++
+		default:
+			kept = append(kept, p)
+		}
+	}
+	if dropped > 0 {
+		log.Println("interrupting", dropped, "queued commands")
+		q.stats.Dropped += dropped
+	}
+	q.pending = kept
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *CommandQueue) pop() *queuedCommand {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	cmd := q.pending[0]
+	q.pending = q.pending[1:]
+	return cmd
+}
+
+// retry queues a keyed command again after its write timed out, unless a
+// newer command with the same key is already waiting. The write may have
+// arrived, which does no harm when only the latest command counts.
+// Commands without a key are never repeated.
+func (q *CommandQueue) retry(cmd *queuedCommand) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if cmd.Key == "" || cmd.retries >= timeoutRetries {
+		return
+	}
+	for _, p := range q.pending {
+		if p.Key == cmd.Key {
+			return
+		}
+	}
+	cmd.retries++
+	q.pending = append([]*queuedCommand{cmd}, q.pending...)
+}
+
+// setRunning marks the queue running or stopped. Commands without a key
+// still waiting when it stops are dropped.
+func (q *CommandQueue) setRunning(running bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running = running
+	if running {
+		return
+	}
+
+	var kept []*queuedCommand
+	for _, p := range q.pending {
+		if p.Key != "" {
+			kept = append(kept, p)
+		}
+	}
+	if n := len(q.pending) - len(kept); n > 0 {
+		log.Println("dropping", n, "queued commands")
+		q.stats.Dropped += n
+	}
+	q.pending = kept
+}
+
+// Run sends queued commands until stop is closed. It returns early with
+// the error of a command that found the device disconnected; other
+// errors are logged.
+func (q *CommandQueue) Run(stop <-chan struct{}) error {
+	q.setRunning(true)
+	defer q.setRunning(false)
+
+	var last time.Time
+	for {
+		if wait := q.cfg.Interval.Or(50*time.Millisecond) - time.Since(last); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return nil
+			}
+		}
+
+		cmd := q.pop()
+		if cmd == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-stop:
+				return nil
+			}
+		}
+
+		start := time.Now()
+		err := cmd.Run()
+		last = time.Now()
+		q.record(cmd, start, last, err)
+
+		if err != nil {
+			log.Println("error sending command", err)
+			if connectionLost(err) {
+				return err
+			}
+			if errors.Is(err, ErrTimeout) {
+				q.retry(cmd)
+			}
+		}
+	}
+}
+
+func (q *CommandQueue) record(cmd *queuedCommand, start, end time.Time, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err != nil {
+		q.stats.Failed++
+	} else {
+		q.stats.Sent++
+	}
+	write := Duration(end.Sub(start))
+	q.stats.LastWrite = write
+	q.stats.LastWait = Duration(start.Sub(cmd.queued))
+	if write > q.stats.MaxWrite {
+		q.stats.MaxWrite = write
+	}
+	if q.stats.AvgWrite == 0 {
+		q.stats.AvgWrite = write
+	} else {
+		q.stats.AvgWrite = (q.stats.AvgWrite*7 + write) / 8
+	}
+	if write > Duration(time.Second) {
+		log.Println("slow command took", time.Duration(write))
+	}
+}
+
+// Stats returns the counters so far
+func (q *CommandQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := q.stats
+	stats.Pending = len(q.pending)
+	return stats
+}
+
+// ServeHTTP shows the queue's counters and latencies
+func (q *CommandQueue) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.Stats())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// runQueue runs q until the returned stop function is called. Commands
+// without a key can be pushed once it returns.
+func runQueue(q *CommandQueue) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		q.Run(done)
+		close(finished)
+	}()
+	for {
+		q.mu.Lock()
+		running := q.running
+		q.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// waitFor polls until ok or a second has passed
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueRetriesOnlyKeyedTimeouts(t *testing.T) {
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+
+	var mu sync.Mutex
+	runs := map[string]int{}
+	timeout := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			runs[name]++
+			return &BLEError{Op: "write", Err: ErrTimeout}
+		}
+	}
+	stop := runQueue(q)
+	defer stop()
+	q.Push(Command{Key: "color", Run: timeout("color")})
+	q.Push(Command{Run: timeout("roll")})
+	waitFor(t, "the queue to give up", func() bool {
+		s := q.Stats()
+		return s.Pending == 0 && s.Failed == 2+timeoutRetries
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if runs["color"] != 1+timeoutRetries {
+		t.Errorf("color ran %d times, want %d", runs["color"], 1+timeoutRetries)
+	}
+	if runs["roll"] != 1 {
+		t.Errorf("roll ran %d times, a command without a key must not repeat", runs["roll"])
+	}
+}
+
+func TestQueueRetryYieldsToNewerCommand(t *testing.T) {
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+
+	var mu sync.Mutex
+	var sent []string
+	q.Push(Command{Key: "color", Run: func() error {
+		mu.Lock()
+		sent = append(sent, "red")
+		mu.Unlock()
+		// green is queued while red is being written
+		q.Push(Command{Key: "color", Run: func() error {
+			mu.Lock()
+			sent = append(sent, "green")
+			mu.Unlock()
+			return nil
+		}})
+		return &BLEError{Op: "write", Err: ErrTimeout}
+	}})
+
+	stop := runQueue(q)
+	defer stop()
+	waitFor(t, "green", func() bool { return q.Stats().Sent == 1 })
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 2 || sent[1] != "green" {
+		t.Errorf("sent %v, want red then green", sent)
+	}
+}
+
+func TestQueueKeepsOrderAndInterval(t *testing.T) {
+	interval := 20 * time.Millisecond
+	q := NewCommandQueue(QueueConfig{Interval: Duration(interval)})
+
+	stop := runQueue(q)
+	var mu sync.Mutex
+	var order []int
+	var times []time.Time
+	for i := 0; i < 4; i++ {
+		i := i
+		q.Push(Command{Run: func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+			times = append(times, time.Now())
+			return nil
+		}})
+	}
+	waitFor(t, "every command", func() bool { return q.Stats().Sent == 4 })
+	stop()
+
+	for i, n := range order {
+		if n != i {
+			t.Fatalf("ran %v, want the order they were queued in", order)
+		}
+	}
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval {
+			t.Errorf("commands %d and %d only %v apart", i-1, i, gap)
+		}
+	}
+}
+
+func TestQueueDropsUnkeyedCommandsWhenStopped(t *testing.T) {
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Hour)})
+	nothing := func() error { return nil }
+
+	// the second roll is still waiting out the interval when the
+	// connection goes
+	stop := runQueue(q)
+	q.Push(Command{Run: nothing})
+	q.Push(Command{Run: nothing})
+	waitFor(t, "the first roll", func() bool { return q.Stats().Sent == 1 })
+	stop()
+	if s := q.Stats(); s.Dropped != 1 || s.Pending != 0 {
+		t.Errorf("%d dropped and %d pending, want the second roll dropped", s.Dropped, s.Pending)
+	}
+
+	// queued while disconnected, such as a roll from a choreography that
+	// was cut short
+	q.Push(Command{Key: "color", Run: nothing})
+	q.Push(Command{Run: nothing})
+	if s := q.Stats(); s.Dropped != 2 || s.Pending != 1 {
+		t.Errorf("%d dropped and %d pending, want the roll dropped and the color kept", s.Dropped, s.Pending)
+	}
+
+	stop = runQueue(q)
+	waitFor(t, "the color", func() bool { return q.Stats().Sent == 2 })
+	stop()
+}
+
+func TestQueueInterruptGoesFirst(t *testing.T) {
+	q := NewCommandQueue(QueueConfig{Interval: Duration(time.Hour)})
+	var mu sync.Mutex
+	var ran []string
+	record := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			ran = append(ran, name)
+			return nil
+		}
+	}
+
+	// everything after the first roll waits out the interval
+	stop := runQueue(q)
+	q.Push(Command{Run: record("roll 1")})
+	waitFor(t, "the first roll", func() bool { return q.Stats().Sent == 1 })
+	q.Push(Command{Run: record("roll 2")})
+	q.Push(Command{Key: "color", Run: record("color")})
+	q.Push(Command{Run: record("roll 3")})
+	q.Interrupt(Command{Key: "stop", Run: record("stop")})
+	if s := q.Stats(); s.Dropped != 2 || s.Pending != 2 {
+		t.Errorf("%d dropped and %d pending, want the rolls dropped", s.Dropped, s.Pending)
+	}
+
+	// the stop survives the connection going
+	stop()
+	q.Interrupt(Command{Key: "stop", Run: record("stop")})
+	if s := q.Stats(); s.Pending != 2 || s.Dropped != 2 || s.Coalesced != 1 {
+		t.Errorf("%+v, want the stop once and the color", s)
+	}
+
+	q.cfg.Interval = Duration(time.Millisecond)
+	stop = runQueue(q)
+	waitFor(t, "the stop and the color", func() bool { return q.Stats().Sent == 3 })
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"roll 1", "stop", "color"}; strings.Join(ran, ",") != strings.Join(want, ",") {
+		t.Errorf("ran %q, want %q", ran, want)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	relayEventsPath = "/relay/events"
+	relayMaxWait    = 30 * time.Second
+	relaySenderHdr  = "X-Relay-Sender"
+	relaySignature  = "X-Hub-Signature-256"
+)
+
+// relayPaths are the webhook endpoints the relay accepts and the agent
+// applies. Paths ending in a slash cover everything under them, except
+// the root, which only means the Interval endpoint. Everything else, such
+// as motion and the emergency stop, is only reachable on the local
+// server.
+var relayPaths = []string{"/", "/events", "/alerts/", "/reports/"}
+
+// RelayConfig configures the split deployment. The relay runs somewhere
+// webhooks can reach and buffers the ones from Senders; the agent runs
+// next to the robot and dials out to URL with Token to collect them.
+// Bodies over MaxBody are refused, and the agent skips events older than
+// MaxAge, such as a full buffer left over from before it restarted.
+type RelayConfig struct {
+	URL     string        `json:"url,omitempty"`
+	Token   string        `json:"token"`
+	Buffer  int           `json:"buffer,omitempty"`
+	Senders []RelaySender `json:"senders,omitempty"`
+	MaxBody int64         `json:"maxBody,omitempty"`
+	MaxAge  Duration      `json:"maxAge,omitempty"`
+}
+
+// RelaySender is a webhook sender allowed to post to the relay. It either
+// sends the secret as a bearer token or signs the body with it the way
+// GitHub does, as "sha256=" and the hex HMAC in X-Hub-Signature-256.
+type RelaySender struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+}
+
+// RelayEvent is an HTTP request captured by the relay
+type RelayEvent struct {
+	Seq        uint64      `json:"seq"`
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"receivedAt"`
+}
+
+// relayBatch is the long-poll response. Epoch changes whenever the relay
+// restarts and its sequence numbers start over; First is the oldest
+// sequence number still buffered. Now is the relay's clock, so event ages
+// don't depend on the agent's.
+type relayBatch struct {
+	Epoch  int64        `json:"epoch"`
+	First  uint64       `json:"first"`
+	Now    time.Time    `json:"now"`
+	Events []RelayEvent `json:"events"`
+}
+
+// headers that belong to the hop between the sender and the relay
+var relayDroppedHeaders = []string{"Authorization", "Cookie", "Connection", "Content-Length", "Transfer-Encoding", "Keep-Alive", "Upgrade"}
+
+// Relay accepts webhooks from known senders and buffers them for the
+// agent
+type Relay struct {
+	token   string
+	senders []RelaySender
+	maxBody int64
+	size    int
+	epoch   int64
+
+	mu     sync.Mutex
+	events []RelayEvent
+	seq    uint64
+	added  chan struct{}
+}
+
+func NewRelay(cfg RelayConfig) (*Relay, error) {
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("relay needs a token")
+	}
+	if len(cfg.Senders) == 0 {
+		return nil, fmt.Errorf("relay needs at least one sender")
+	}
+	for _, s := range cfg.Senders {
+		if s.Name == "" || s.Secret == "" {
+			return nil, fmt.Errorf("relay senders need a name and secret")
+		}
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 1000
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 1 << 20
+	}
+	return &Relay{
+		token:   cfg.Token,
+		senders: cfg.Senders,
+		maxBody: cfg.MaxBody,
+		size:    cfg.Buffer,
+		epoch:   time.Now().UnixNano(),
+		added:   make(chan struct{}),
+	}, nil
+}
+
+// relayAllowed reports whether a webhook may go through the relay
+func relayAllowed(method, p string) bool {
+	if method != http.MethodPost {
+		return false
+	}
+	for _, allowed := range relayPaths {
+		if p == allowed || allowed != "/" && strings.HasSuffix(allowed, "/") && strings.HasPrefix(p, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rl *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == relayEventsPath {
+		rl.serveEvents(w, r)
+		return
+	}
+	if !relayAllowed(r.Method, r.URL.Path) || path.Clean(r.URL.Path) != r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, rl.maxBody))
+	if err != nil {
+		http.Error(w, "Error reading request", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sender, ok := rl.authenticate(r, body)
+	if !ok {
+		log.Println("relay refused unauthenticated", r.Method, r.URL.Path)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	header := r.Header.Clone()
+	for _, h := range relayDroppedHeaders {
+		header.Del(h)
+	}
+	header.Set(relaySenderHdr, sender)
+
+	rl.mu.Lock()
+	rl.seq++
+	rl.events = append(rl.events, RelayEvent{
+		Seq:        rl.seq,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Header:     header,
+		Body:       body,
+		ReceivedAt: time.Now(),
+	})
+	if len(rl.events) > rl.size {
+		log.Println("relay buffer full, dropping event", rl.events[0].Seq)
+		rl.events = rl.events[len(rl.events)-rl.size:]
+	}
+	close(rl.added)
+	rl.added = make(chan struct{})
+	rl.mu.Unlock()
+
+	log.Println("relayed", r.Method, r.URL.Path, "from", sender)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authenticate finds the sender whose secret is the bearer token or signs
+// the body
+func (rl *Relay) authenticate(r *http.Request, body []byte) (string, bool) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	sig, _ := hex.DecodeString(strings.TrimPrefix(r.Header.Get(relaySignature), "sha256="))
+
+	for _, s := range rl.senders {
+		if bearer != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(s.Secret)) == 1 {
+			return s.Name, true
+		}
+		if len(sig) > 0 {
+			mac := hmac.New(sha256.New, []byte(s.Secret))
+			mac.Write(body)
+			if hmac.Equal(sig, mac.Sum(nil)) {
+				return s.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// serveEvents long-polls for events after the given sequence number
+func (rl *Relay) serveEvents(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(rl.token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	after, _ := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	if epoch, _ := strconv.ParseInt(r.URL.Query().Get("epoch"), 10, 64); epoch != rl.epoch {
+		after = 0
+	}
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil || wait > relayMaxWait {
+		wait = relayMaxWait
+	}
+
+	timeout := time.After(wait)
+	for {
+		batch, added := rl.since(after)
+		if len(batch.Events) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batch)
+			return
+		}
+
+		select {
+		case <-added:
+		case <-timeout:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(batch)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (rl *Relay) since(after uint64) (relayBatch, <-chan struct{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	batch := relayBatch{Epoch: rl.epoch, First: rl.seq + 1, Now: time.Now()}
+	if len(rl.events) > 0 {
+		batch.First = rl.events[0].Seq
+	}
+	for _, e := range rl.events {
+		if e.Seq > after {
+			batch.Events = append(batch.Events, e)
+		}
+	}
+	return batch, rl.added
+}
+
+// Agent dials out to a relay and replays the buffered events against the
+// local handler, in order. The relay keeps events while the link is
+// down, so reconnecting picks up where the agent left off.
+type Agent struct {
+	url     string
+	token   string
+	maxAge  time.Duration
+	handler http.Handler
+	client  *http.Client
+
+	epoch int64
+	seq   uint64
+}
+
+func NewAgent(cfg RelayConfig, handler http.Handler) (*Agent, error) {
+	if cfg.URL == "" || cfg.Token == "" {
+		return nil, fmt.Errorf("agent needs a relay url and token")
+	}
+	return &Agent{
+		url:     strings.TrimSuffix(cfg.URL, "/") + relayEventsPath,
+		token:   cfg.Token,
+		maxAge:  cfg.MaxAge.Or(10 * time.Minute),
+		handler: handler,
+		client:  &http.Client{Timeout: relayMaxWait + 10*time.Second},
+	}, nil
+}
+
+// Run polls the relay forever, backing off while it is unreachable
+func (a *Agent) Run() {
+	backoff := time.Second
+	for {
+		err := a.poll()
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+
+		log.Println("relay link down, retrying in", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+func (a *Agent) poll() error {
+	url := fmt.Sprintf("%s?after=%d&epoch=%d&wait=%s", a.url, a.seq, a.epoch, relayMaxWait)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("relay returned %s", resp.Status)
+	}
+
+	var batch relayBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return err
+	}
+
+	if batch.Epoch != a.epoch {
+		if a.epoch != 0 {
+			log.Println("relay restarted, starting from its oldest event")
+		}
+		a.epoch, a.seq = batch.Epoch, 0
+	} else if batch.First > a.seq+1 {
+		log.Println("relay dropped events", a.seq+1, "to", batch.First-1)
+	}
+
+	for _, e := range batch.Events {
+		if age := batch.Now.Sub(e.ReceivedAt); age > a.maxAge {
+			log.Println("skipping relayed event", e.Seq, "received", age.Round(time.Second), "ago")
+		} else {
+			a.apply(e)
+		}
+		a.seq = e.Seq
+	}
+	return nil
+}
+
+// apply replays an event against the local handler. The relay only takes
+// webhooks, but the agent checks again rather than trust it.
+func (a *Agent) apply(e RelayEvent) {
+	u, err := url.ParseRequestURI(e.Path)
+	if err == nil && (!relayAllowed(e.Method, u.Path) || path.Clean(u.Path) != u.Path) {
+		err = fmt.Errorf("%s %s isn't a webhook", e.Method, u.Path)
+	}
+	if err != nil {
+		log.Println("Error replaying relayed event", e.Seq, err)
+		return
+	}
+	req, err := http.NewRequest(e.Method, u.String(), bytes.NewReader(e.Body))
+	if err != nil {
+		log.Println("Error replaying relayed event", e.Seq, err)
+		return
+	}
+	req.Header = e.Header
+
+	rec := &statusRecorder{header: make(http.Header), status: http.StatusOK}
+	a.handler.ServeHTTP(rec, req)
+	log.Println("applied relayed event", e.Seq, e.Method, e.Path, rec.status)
+}
+
+// statusRecorder is a ResponseWriter that only remembers the status code
+type statusRecorder struct {
+	header http.Header
+	status int
+}
+
+func (r *statusRecorder) Header() http.Header         { return r.header }
+func (r *statusRecorder) Write(b []byte) (int, error) { return len(b), nil }
+func (r *statusRecorder) WriteHeader(status int)      { r.status = status }
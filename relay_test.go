@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRelay(t *testing.T) *Relay {
+	t.Helper()
+	rl, err := NewRelay(RelayConfig{
+		Token:   "agent-token",
+		Senders: []RelaySender{{Name: "ci", Secret: "ci-secret"}},
+		MaxBody: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rl
+}
+
+func TestRelayRefusesRequests(t *testing.T) {
+	rl := newTestRelay(t)
+	mac := hmac.New(sha256.New, []byte("ci-secret"))
+	mac.Write([]byte(`{}`))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header []string
+		want   int
+	}{
+		{"bearer", http.MethodPost, "/events", `{}`, []string{"Authorization", "Bearer ci-secret"}, http.StatusAccepted},
+		{"signed", http.MethodPost, "/alerts/grafana", `{}`, []string{relaySignature, signature}, http.StatusAccepted},
+		{"bad signature", http.MethodPost, "/events", `{"x":1}`, []string{relaySignature, signature}, http.StatusUnauthorized},
+		{"no auth", http.MethodPost, "/events", `{}`, nil, http.StatusUnauthorized},
+		{"agent token", http.MethodPost, "/events", `{}`, []string{"Authorization", "Bearer agent-token"}, http.StatusUnauthorized},
+		{"interval", http.MethodPost, "/", `{}`, []string{"Authorization", "Bearer ci-secret"}, http.StatusAccepted},
+		{"status", http.MethodPost, "/status", `{}`, []string{"Authorization", "Bearer ci-secret"}, http.StatusNotFound},
+		{"motion", http.MethodPost, "/motion", `{}`, []string{"Authorization", "Bearer ci-secret"}, http.StatusNotFound},
+		{"emergency stop", http.MethodDelete, "/motion/safety", ``, []string{"Authorization", "Bearer ci-secret"}, http.StatusNotFound},
+		{"escape", http.MethodPost, "/alerts/../motion", `{}`, []string{"Authorization", "Bearer ci-secret"}, http.StatusNotFound},
+		{"too big", http.MethodPost, "/events", strings.Repeat("x", 65), []string{"Authorization", "Bearer ci-secret"}, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.URL.Path = tt.path
+			for i := 0; i+1 < len(tt.header); i += 2 {
+				req.Header.Set(tt.header[i], tt.header[i+1])
+			}
+			w := httptest.NewRecorder()
+			rl.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentSkipsStaleEvents(t *testing.T) {
+	rl := newTestRelay(t)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer ci-secret")
+		rl.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// the first two sat in the buffer while the agent was away
+	rl.mu.Lock()
+	rl.events[0].ReceivedAt = time.Now().Add(-time.Hour)
+	rl.events[1].ReceivedAt = time.Now().Add(-time.Hour)
+	rl.mu.Unlock()
+
+	srv := httptest.NewServer(rl)
+	defer srv.Close()
+
+	var applied []string
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		applied = append(applied, r.URL.Path+" from "+r.Header.Get(relaySenderHdr))
+	})
+	agent, err := NewAgent(RelayConfig{URL: srv.URL, Token: "agent-token", MaxAge: Duration(time.Minute)}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 1 || applied[0] != "/events from ci" {
+		t.Errorf("applied %v, want only the fresh event", applied)
+	}
+	if agent.seq != 3 {
+		t.Errorf("agent at %d, want 3", agent.seq)
+	}
+}
+
+func TestAgentRefusesLocalOnlyPaths(t *testing.T) {
+	var applied int
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { applied++ })
+	agent, err := NewAgent(RelayConfig{URL: "http://relay", Token: "agent-token"}, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agent.apply(RelayEvent{Seq: 1, Method: http.MethodDelete, Path: "/motion/safety"})
+	agent.apply(RelayEvent{Seq: 2, Method: http.MethodPost, Path: "/events/../motion"})
+	agent.apply(RelayEvent{Seq: 3, Method: http.MethodPost, Path: "/reports/junit?pipeline=build"})
+	if applied != 1 {
+		t.Errorf("applied %d events, want only the report", applied)
+	}
+}
+
+func TestRelayedIntervalReachesPlan(t *testing.T) {
+	rl := newTestRelay(t)
+	srv := httptest.NewServer(rl)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(`{"duration":500,"r":255}`))
+	req.Header.Set("Authorization", "Bearer ci-secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("relay got %s, want 202", resp.Status)
+	}
+
+	plan := NewPlan()
+	mux := http.NewServeMux()
+	mux.Handle("/", planHandler(plan))
+	agent, err := NewAgent(RelayConfig{URL: srv.URL, Token: "agent-token"}, mux)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if plan.Empty() {
+		t.Fatal("relayed interval never reached the plan")
+	}
+	if c, d := plan.Pop(); c != (Color{Red: 255}) || d != 500*time.Millisecond {
+		t.Errorf("plan got %v for %v, want red for 500ms", c, d)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReplayMismatch is returned by a ReplayConnector for a write the trace
+// doesn't have next
+var ErrReplayMismatch = errors.New("write doesn't match trace")
+
+// ReplayConnector is a fake BLE connection that plays a recorded trace
+// back to a driver, so a bug seen on a real device can be reproduced
+// without it. Writes have to come in the recorded order; each one returns
+// the recorded error, if any, and then delivers the notifications that
+// followed it to subscribers. Reads answer with what was read at that
+// point of the trace.
+type ReplayConnector struct {
+	name string
+
+	mu         sync.Mutex
+	records    []TraceRecord
+	pos        int
+	notified   int
+	subs       map[string][]func([]byte, error)
+	mismatches []string
+}
+
+func NewReplayConnector(records []TraceRecord) *ReplayConnector {
+	return &ReplayConnector{
+		name:    "replay",
+		records: records,
+		subs:    make(map[string][]func([]byte, error)),
+	}
+}
+
+func (r *ReplayConnector) Connect() error { return nil }
+
+func (r *ReplayConnector) Reconnect() error        { return r.Connect() }
+func (r *ReplayConnector) Disconnect() error       { return nil }
+func (r *ReplayConnector) Finalize() error         { return nil }
+func (r *ReplayConnector) Name() string            { return r.name }
+func (r *ReplayConnector) SetName(n string)        { r.name = n }
+func (r *ReplayConnector) Address() string         { return "replay" }
+func (r *ReplayConnector) WithoutResponses(_ bool) {}
+
+// replayTimeout bounds waits for replies; replayed notifications arrive
+// straight after the write they followed
+const replayTimeout = time.Second
+
+func (r *ReplayConnector) timeout() time.Duration { return replayTimeout }
+
+// listen subscribes f to the notifications; subscriptions to a replay
+// never end
+func (r *ReplayConnector) listen(cUUID string, f func([]byte)) {
+	r.Subscribe(cUUID, func(data []byte, _ error) { f(data) })
+}
+
+// ReadCharacteristic returns the next recorded read of the characteristic
+// before the next write
+func (r *ReplayConnector) ReadCharacteristic(cUUID string) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := convertUUID(cUUID)
+	for i := r.pos; i < len(r.records) && r.records[i].Op != TraceWrite; i++ {
+		rec := r.records[i]
+		if rec.Op == TraceRead && rec.Characteristic == key {
+			return rec.Data, recordedErr(rec)
+		}
+	}
+	return nil, nil
+}
+
+// WriteCharacteristic checks the write against the trace
+func (r *ReplayConnector) WriteCharacteristic(cUUID string, data []byte) error {
+	r.mu.Lock()
+	key := convertUUID(cUUID)
+
+	next := r.pos
+	for next < len(r.records) && r.records[next].Op != TraceWrite {
+		next++
+	}
+	if next == len(r.records) {
+		err := r.mismatch("unexpected write of %x to %s after the end of the trace", data, key)
+		r.mu.Unlock()
+		return err
+	}
+	rec := r.records[next]
+	if rec.Characteristic != key || !bytes.Equal(rec.Data, data) {
+		err := r.mismatch("write of %x to %s, expected %x to %s", data, key, []byte(rec.Data), rec.Characteristic)
+		r.mu.Unlock()
+		return err
+	}
+	r.pos = next + 1
+	r.mu.Unlock()
+
+	r.notify()
+	return recordedErr(rec)
+}
+
+// Subscribe adds a subscriber for replayed notifications and delivers
+// the ones due so far
+func (r *ReplayConnector) Subscribe(cUUID string, f func([]byte, error)) error {
+	r.mu.Lock()
+	key := convertUUID(cUUID)
+	r.subs[key] = append(r.subs[key], f)
+	r.mu.Unlock()
+
+	r.notify()
+	return nil
+}
+
+// notify delivers the notifications up to the next write, once
+func (r *ReplayConnector) notify() {
+	r.mu.Lock()
+	var pending []TraceRecord
+	i := r.pos
+	if r.notified > i {
+		i = r.notified
+	}
+	for ; i < len(r.records) && r.records[i].Op != TraceWrite; i++ {
+		if r.records[i].Op == TraceNotify {
+			pending = append(pending, r.records[i])
+		}
+	}
+	r.notified = i
+	subs := make(map[string][]func([]byte, error), len(r.subs))
+	for k, v := range r.subs {
+		subs[k] = v
+	}
+	r.mu.Unlock()
+
+	for _, rec := range pending {
+		for _, f := range subs[rec.Characteristic] {
+			f(rec.Data, nil)
+		}
+	}
+}
+
+func (r *ReplayConnector) mismatch(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	r.mismatches = append(r.mismatches, msg)
+	return errors.Wrap(ErrReplayMismatch, msg)
+}
+
+// Done reports writes that didn't match the trace and recorded writes
+// that never happened
+func (r *ReplayConnector) Done() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.mismatches) > 0 {
+		return fmt.Errorf("%d writes didn't match the trace, first: %s", len(r.mismatches), r.mismatches[0])
+	}
+	left := 0
+	for _, rec := range r.records[r.pos:] {
+		if rec.Op == TraceWrite {
+			left++
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d recorded writes never happened", left)
+	}
+	return nil
+}
+
+func recordedErr(rec TraceRecord) error {
+	if rec.Err == "" {
+		return nil
+	}
+	return errors.New(rec.Err)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/logiraptor/gobot-ci/spherov1"
+	"github.com/pkg/errors"
+)
+
+func loadTestTrace(t *testing.T, path string) []TraceRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	recs, err := LoadTrace(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recs
+}
+
+// testdata/bb8.jsonl is a BB-8 confirming a red, turning down a green,
+// rolling and going to sleep
+func TestBB8Replay(t *testing.T) {
+	replay := NewReplayConnector(loadTestTrace(t, "testdata/bb8.jsonl"))
+	d := newBB8Light(replay, true)
+
+	if err := d.SetRGB(0xFF, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetRGB(0, 0xFF, 0); err == nil {
+		t.Error("the robot rejected green, but SetRGB succeeded")
+	}
+
+	// the gobot driver writes its own sequence numbers, which get replaced
+	// by the next one in line
+	roll := spherov1.Packet{Kind: spherov1.Command, Answer: true, DeviceID: 0x02, CommandID: 0x30, Data: []byte{0x40, 0x00, 0x5a, 0x01}}
+	buf, err := roll.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.link.WriteCharacteristic(ollieCommandsCharacteristic, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Sleep(); err != nil {
+		t.Fatal(err)
+	}
+	if err := replay.Done(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBB8ReplayMismatch(t *testing.T) {
+	replay := NewReplayConnector(loadTestTrace(t, "testdata/bb8.jsonl"))
+	d := newBB8Light(replay, false)
+
+	if err := d.SetRGB(0, 0, 0xFF); !errors.Is(err, ErrReplayMismatch) {
+		t.Errorf("got %v for a color the trace doesn't have", err)
+	}
+	if err := replay.Done(); err == nil {
+		t.Error("Done didn't report the mismatch")
+	}
+}
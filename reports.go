@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	reportHistorySize = 20
+	reportMaxBody     = 10 << 20
+)
+
+// TestReport is the outcome of every test case in an uploaded report
+type TestReport struct {
+	Passed  []string
+	Failed  []string
+	Skipped []string
+}
+
+// ReportSummary is what we keep of each uploaded report
+type ReportSummary struct {
+	Pipeline     string    `json:"pipeline"`
+	Format       string    `json:"format"`
+	Passed       int       `json:"passed"`
+	Failed       int       `json:"failed"`
+	Skipped      int       `json:"skipped"`
+	PassRatio    float64   `json:"passRatio"`
+	Failing      []string  `json:"failing,omitempty"`
+	NewlyFailing []string  `json:"newlyFailing,omitempty"`
+	ReceivedAt   time.Time `json:"receivedAt"`
+}
+
+// Status is success when nothing failed
+func (s ReportSummary) Status() Status {
+	if s.Failed > 0 {
+		return StatusFailure
+	}
+	return StatusSuccess
+}
+
+// Color goes from red at a 0% pass ratio to green at 100%
+func (s ReportSummary) Color() Color {
+	return Color{
+		Red:   uint8(255 * (1 - s.PassRatio)),
+		Green: uint8(255 * s.PassRatio),
+	}
+}
+
+// Pattern blinks when tests started failing since the previous report
+func (s ReportSummary) Pattern() Pattern {
+	if len(s.NewlyFailing) > 0 {
+		return Blink(s.Color(), time.Second)
+	}
+	return Steady(s.Color())
+}
+
+// Reports stores report summaries per pipeline and shows the latest one
+// through the status registry
+type Reports struct {
+	registry *StatusRegistry
+
+	mu      sync.Mutex
+	history map[string][]ReportSummary
+}
+
+func NewReports(registry *StatusRegistry) *Reports {
+	return &Reports{
+		registry: registry,
+		history:  make(map[string][]ReportSummary),
+	}
+}
+
+// Add summarizes a report against the previous one for the pipeline
+func (rs *Reports) Add(pipeline, format string, report TestReport) ReportSummary {
+	s := ReportSummary{
+		Pipeline:   pipeline,
+		Format:     format,
+		Passed:     len(report.Passed),
+		Failed:     len(report.Failed),
+		Skipped:    len(report.Skipped),
+		PassRatio:  1,
+		Failing:    report.Failed,
+		ReceivedAt: time.Now(),
+	}
+	if ran := s.Passed + s.Failed; ran > 0 {
+		s.PassRatio = float64(s.Passed) / float64(ran)
+	}
+
+	rs.mu.Lock()
+	hist := rs.history[pipeline]
+	if len(hist) > 0 {
+		prev := make(map[string]bool)
+		for _, name := range hist[len(hist)-1].Failing {
+			prev[name] = true
+		}
+		for _, name := range s.Failing {
+			if !prev[name] {
+				s.NewlyFailing = append(s.NewlyFailing, name)
+			}
+		}
+	}
+	hist = append(hist, s)
+	if len(hist) > reportHistorySize {
+		hist = hist[len(hist)-reportHistorySize:]
+	}
+	rs.history[pipeline] = hist
+	rs.mu.Unlock()
+
+	log.Printf("report for %s: %d passed, %d failed, %d skipped, %d newly failing",
+		pipeline, s.Passed, s.Failed, s.Skipped, len(s.NewlyFailing))
+	rs.registry.SetPattern("report:"+pipeline, s.Status(), s.Pattern(), "report")
+	return s
+}
+
+// Latest returns the most recent summary of every pipeline
+func (rs *Reports) Latest() []ReportSummary {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	latest := make([]ReportSummary, 0, len(rs.history))
+	for _, hist := range rs.history {
+		latest = append(latest, hist[len(hist)-1])
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].Pipeline < latest[j].Pipeline })
+	return latest
+}
+
+// History returns the kept summaries for a pipeline, oldest first
+func (rs *Reports) History(pipeline string) []ReportSummary {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]ReportSummary(nil), rs.history[pipeline]...)
+}
+
+// ServeHTTP accepts uploads on POST /reports/junit and /reports/tap and
+// lists summaries on GET /reports. Both take an optional pipeline query
+// parameter.
+func (rs *Reports) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pipeline := r.URL.Query().Get("pipeline")
+
+	if r.Method == http.MethodGet && strings.TrimSuffix(r.URL.Path, "/") == "/reports" {
+		w.Header().Set("Content-Type", "application/json")
+		if pipeline != "" {
+			json.NewEncoder(w).Encode(rs.History(pipeline))
+		} else {
+			json.NewEncoder(w).Encode(rs.Latest())
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if pipeline == "" {
+		pipeline = "default"
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, reportMaxBody)
+	var report TestReport
+	var err error
+	format := strings.TrimPrefix(r.URL.Path, "/reports/")
+	switch format {
+	case "junit":
+		report, err = ParseJUnit(r.Body)
+	case "tap":
+		report, err = ParseTAP(r.Body)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Error parsing", format, "report", err)
+		http.Error(w, "Error parsing report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rs.Add(pipeline, format, report))
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Suites []junitSuite `xml:"testsuite"`
+	Cases  []junitCase  `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string    `xml:"name,attr"`
+	Classname string    `xml:"classname,attr"`
+	Failure   *struct{} `xml:"failure"`
+	Error     *struct{} `xml:"error"`
+	Skipped   *struct{} `xml:"skipped"`
+}
+
+// ParseJUnit reads a JUnit XML report rooted at either <testsuites> or
+// <testsuite>
+func ParseJUnit(r io.Reader) (TestReport, error) {
+	var root junitSuite
+	err := xml.NewDecoder(r).Decode(&root)
+	if err != nil {
+		return TestReport{}, err
+	}
+
+	var report TestReport
+	var walk func(s junitSuite)
+	walk = func(s junitSuite) {
+		for _, c := range s.Cases {
+			name := c.Name
+			if c.Classname != "" {
+				name = c.Classname + "." + c.Name
+			}
+			switch {
+			case c.Failure != nil || c.Error != nil:
+				report.Failed = append(report.Failed, name)
+			case c.Skipped != nil:
+				report.Skipped = append(report.Skipped, name)
+			default:
+				report.Passed = append(report.Passed, name)
+			}
+		}
+		for _, child := range s.Suites {
+			walk(child)
+		}
+	}
+	walk(root)
+	return report, nil
+}
+
+var (
+	tapPlanLine = regexp.MustCompile(`^1\.\.(\d+)`)
+	tapTestLine = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*)(?:#\s*(\S+))?`)
+)
+
+// ParseTAP reads a Test Anything Protocol stream. SKIP and TODO tests
+// count as skipped, and tests promised by the plan but never reported
+// count as failed. Indented lines belong to subtests, which their parent
+// test line already sums up, so they are ignored.
+func ParseTAP(r io.Reader) (TestReport, error) {
+	var report TestReport
+	planned, seen := -1, 0
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		if m := tapPlanLine.FindStringSubmatch(line); m != nil {
+			planned, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if strings.HasPrefix(line, "Bail out!") {
+			report.Failed = append(report.Failed, line)
+			continue
+		}
+
+		m := tapTestLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		seen++
+
+		name := strings.TrimSpace(m[3])
+		if name == "" {
+			name = fmt.Sprintf("test %d", seen)
+		}
+
+		switch directive := strings.ToUpper(m[4]); {
+		case strings.HasPrefix(directive, "SKIP"), strings.HasPrefix(directive, "TODO"):
+			report.Skipped = append(report.Skipped, name)
+		case m[1] != "":
+			report.Failed = append(report.Failed, name)
+		default:
+			report.Passed = append(report.Passed, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+
+	if planned < 0 && seen == 0 {
+		return report, fmt.Errorf("no TAP plan or test lines")
+	}
+	for i := seen + 1; i <= planned; i++ {
+		report.Failed = append(report.Failed, fmt.Sprintf("test %d (missing)", i))
+	}
+	return report, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseJUnit(t *testing.T) {
+	cases := map[string]struct {
+		xml  string
+		want TestReport
+	}{
+		"single suite": {
+			xml: `<testsuite name="unit">
+				<testcase classname="pkg" name="passes"/>
+				<testcase classname="pkg" name="fails"><failure message="boom"/></testcase>
+				<testcase classname="pkg" name="errors"><error/></testcase>
+				<testcase name="skipped"><skipped/></testcase>
+			</testsuite>`,
+			want: TestReport{
+				Passed:  []string{"pkg.passes"},
+				Failed:  []string{"pkg.fails", "pkg.errors"},
+				Skipped: []string{"skipped"},
+			},
+		},
+		"nested suites": {
+			xml: `<testsuites>
+				<testsuite name="a"><testcase name="one"/></testsuite>
+				<testsuite name="b">
+					<testsuite name="c"><testcase name="two"><failure/></testcase></testsuite>
+				</testsuite>
+			</testsuites>`,
+			want: TestReport{Passed: []string{"one"}, Failed: []string{"two"}},
+		},
+		"empty": {
+			xml:  `<testsuites/>`,
+			want: TestReport{},
+		},
+	}
+	for name, c := range cases {
+		got, err := ParseJUnit(strings.NewReader(c.xml))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, c.want)
+		}
+	}
+
+	if _, err := ParseJUnit(strings.NewReader("<testsuite>")); err == nil {
+		t.Error("truncated report: no error")
+	}
+}
+
+func TestParseTAP(t *testing.T) {
+	cases := map[string]struct {
+		tap  string
+		want TestReport
+	}{
+		"plan first": {
+			tap: "TAP version 13\n1..4\nok 1 - passes\nnot ok 2 - fails\nok 3 # SKIP no network\nnot ok 4 - later # TODO\n",
+			want: TestReport{
+				Passed:  []string{"passes"},
+				Failed:  []string{"fails"},
+				Skipped: []string{"test 3", "later"},
+			},
+		},
+		"plan last": {
+			tap:  "ok 1 first\nok 2 second\n1..2\n",
+			want: TestReport{Passed: []string{"first", "second"}},
+		},
+		"missing tests": {
+			tap:  "1..3\nok 1 - only\n",
+			want: TestReport{Passed: []string{"only"}, Failed: []string{"test 2 (missing)", "test 3 (missing)"}},
+		},
+		"bail out": {
+			tap:  "1..1\nBail out! database down\n",
+			want: TestReport{Failed: []string{"Bail out! database down", "test 1 (missing)"}},
+		},
+		"subtests": {
+			tap: "TAP version 14\n1..2\n" +
+				"# Subtest: parent\n    1..3\n    ok 1 - child one\n    not ok 2 - child two\n    ok 3 - child three\n" +
+				"not ok 1 - parent\n" +
+				"\tok 1 - tabbed child\n" +
+				"ok 2 - sibling\n",
+			want: TestReport{Passed: []string{"sibling"}, Failed: []string{"parent"}},
+		},
+	}
+	for name, c := range cases {
+		got, err := ParseTAP(strings.NewReader(c.tap))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", name, got, c.want)
+		}
+	}
+
+	if _, err := ParseTAP(strings.NewReader("hello\n")); err == nil {
+		t.Error("not TAP: no error")
+	}
+}
+
+func TestReportsNewlyFailing(t *testing.T) {
+	steps := []struct {
+		failed []string
+		want   []string
+	}{
+		{failed: []string{"a"}, want: nil},
+		{failed: []string{"a", "b"}, want: []string{"b"}},
+		{failed: []string{"b"}, want: nil},
+		{failed: nil, want: nil},
+		{failed: []string{"a", "c"}, want: []string{"a", "c"}},
+	}
+
+	rs := NewReports(NewStatusRegistry())
+	for i, step := range steps {
+		s := rs.Add("build", "tap", TestReport{Passed: []string{"x"}, Failed: step.failed})
+		if !reflect.DeepEqual(s.NewlyFailing, step.want) {
+			t.Errorf("report %d: newly failing %q, want %q", i, s.NewlyFailing, step.want)
+		}
+	}
+
+	// other pipelines have their own history
+	if s := rs.Add("deploy", "tap", TestReport{Failed: []string{"a"}}); s.NewlyFailing != nil {
+		t.Errorf("first deploy report: newly failing %q", s.NewlyFailing)
+	}
+}
+
+func TestReportsBodyLimit(t *testing.T) {
+	rs := NewReports(NewStatusRegistry())
+	body := "1..1\nok 1\n" + strings.Repeat("# padding\n", reportMaxBody/10+1)
+	w := httptest.NewRecorder()
+	rs.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/reports/tap", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("oversized report got %d, want 400", w.Code)
+	}
+	if len(rs.Latest()) != 0 {
+		t.Error("oversized report was kept")
+	}
+}
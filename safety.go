@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+// locatingMover is a robot the supervisor can keep an eye on
+type locatingMover interface {
+	Mover
+	GetLocatorData(f func(p ollie.Point2D))
+	EnableStopOnDisconnect()
+	On(name string, f func(s interface{})) error
+	Event(name string) string
+}
+
+// SafetyConfig bounds where the robot may go. Radius is the geofence
+// around home in centimeters. Without a locator reply for Heartbeat the
+// robot is stopped. With ReturnHome set the robot drives back home at
+// HomeSpeed after every choreography.
+type SafetyConfig struct {
+	Radius     float64  `json:"radius"`
+	Heartbeat  Duration `json:"heartbeat"`
+	Poll       Duration `json:"poll"`
+	ReturnHome bool     `json:"returnHome"`
+	HomeSpeed  uint8    `json:"homeSpeed"`
+}
+
+func DefaultSafetyConfig() SafetyConfig {
+	return SafetyConfig{
+		Radius:     50,
+		Heartbeat:  Duration(time.Second),
+		Poll:       Duration(200 * time.Millisecond),
+		ReturnHome: true,
+		HomeSpeed:  30,
+	}
+}
+
+// how close to home is close enough, in centimeters
+const homeTolerance = 5
+
+// Supervisor watches the robot while it moves. It stops the robot on
+// collisions, when it leaves the geofence, when writes to it fail and
+// when it stops answering, and then refuses to move it until Reset.
+type Supervisor struct {
+	cfg SafetyConfig
+
+	mu       sync.Mutex
+	robot    locatingMover
+	armed    map[locatingMover]bool
+	home     *ollie.Point2D
+	pos      ollie.Point2D
+	seen     time.Time
+	tripped  string
+	watching bool
+	done     chan struct{}
+}
+
+func NewSupervisor(cfg SafetyConfig) *Supervisor {
+	return &Supervisor{
+		cfg:   cfg,
+		armed: make(map[locatingMover]bool),
+	}
+}
+
+// Begin checks the robot is safe to move and starts watching it. The
+// returned Mover ignores Roll once the supervisor has stopped the robot.
+func (s *Supervisor) Begin(m Mover) (Mover, error) {
+	robot, ok := m.(locatingMover)
+	if !ok {
+		return nil, fmt.Errorf("robot can't report its position")
+	}
+
+	s.mu.Lock()
+	if s.tripped != "" {
+		defer s.mu.Unlock()
+		return nil, fmt.Errorf("motion stopped: %s", s.tripped)
+	}
+	s.robot = robot
+	s.arm(robot)
+	s.mu.Unlock()
+
+	pos, err := s.baseline()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.home == nil {
+		log.Println("motion home is", pos.X, pos.Y)
+		s.home = &pos
+	}
+	s.watching = true
+	s.done = make(chan struct{})
+	go s.watch(s.done)
+	s.mu.Unlock()
+
+	return supervisedMover{robot, s}, nil
+}
+
+// End drives the robot home if configured and stops watching it
+func (s *Supervisor) End() {
+	if s.cfg.ReturnHome {
+		s.returnHome()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watching {
+		close(s.done)
+		s.watching = false
+	}
+	if s.robot != nil {
+		s.robot.Stop()
+	}
+}
+
+// Reset clears an emergency stop and forgets home, so the next
+// choreography starts from wherever the robot is now
+func (s *Supervisor) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Println("motion safety reset")
+	s.tripped = ""
+	s.home = nil
+}
+
+// Tripped returns why the robot was stopped, or "" while it may move
+func (s *Supervisor) Tripped() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tripped
+}
+
+// arm enables the robot side safeguards. Collision detection is set up
+// when the robot connects. Event handlers are only added once per driver,
+// since gobot can't remove them.
+func (s *Supervisor) arm(robot locatingMover) {
+	robot.EnableStopOnDisconnect()
+
+	if s.armed[robot] {
+		return
+	}
+	s.armed[robot] = true
+
+	robot.On(ollie.Collision, func(interface{}) {
+		if s.moving() {
+			s.trip("collision")
+		}
+	})
+	robot.On(robot.Event(ollie.Error), func(data interface{}) {
+		if err, ok := data.(error); ok {
+			s.trip("write error: " + err.Error())
+		}
+	})
+}
+
+func (s *Supervisor) moving() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watching
+}
+
+// trip stops the robot and keeps it stopped until Reset
+func (s *Supervisor) trip(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tripped != "" {
+		return
+	}
+	log.Println("emergency stop:", reason)
+	s.tripped = reason
+	if s.robot != nil {
+		s.robot.Stop()
+	}
+}
+
+// baselineAttempts is how often Begin asks for the position before
+// giving up on a choreography
+const baselineAttempts = 3
+
+// baseline finds the robot before it moves. A robot that doesn't answer
+// yet hasn't done anything wrong, so unlike a lost heartbeat while moving
+// this retries and never trips the emergency stop.
+func (s *Supervisor) baseline() (ollie.Point2D, error) {
+	var err error
+	for i := 0; i < baselineAttempts; i++ {
+		var pos ollie.Point2D
+		if pos, err = s.request(); err == nil {
+			return pos, nil
+		}
+		log.Println("robot position unknown, retrying")
+	}
+	return ollie.Point2D{}, err
+}
+
+// locate asks for the robot's position while it moves, stopping it if it
+// doesn't answer within a heartbeat
+func (s *Supervisor) locate() (ollie.Point2D, error) {
+	pos, err := s.request()
+	if err != nil {
+		s.trip("lost heartbeat")
+	}
+	return pos, err
+}
+
+// request asks for the robot's position and waits up to a heartbeat for it
+func (s *Supervisor) request() (ollie.Point2D, error) {
+	s.mu.Lock()
+	robot := s.robot
+	s.mu.Unlock()
+
+	ch := make(chan ollie.Point2D, 1)
+	robot.GetLocatorData(func(p ollie.Point2D) {
+		s.located(p)
+		select {
+		case ch <- p:
+		default:
+		}
+	})
+
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-time.After(s.cfg.Heartbeat.Or(time.Second)):
+		return ollie.Point2D{}, fmt.Errorf("robot didn't report its position")
+	}
+}
+
+func (s *Supervisor) located(p ollie.Point2D) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pos = p
+	s.seen = time.Now()
+}
+
+// watch polls the locator while a choreography plays, enforcing the
+// geofence and heartbeat
+func (s *Supervisor) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(s.cfg.Poll.Or(200 * time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		robot, home, pos, seen := s.robot, s.home, s.pos, s.seen
+		s.mu.Unlock()
+
+		if time.Since(seen) > s.cfg.Heartbeat.Or(time.Second) {
+			s.trip("lost heartbeat")
+		} else if home != nil && distance(*home, pos) > s.cfg.Radius {
+			s.trip(fmt.Sprintf("left the %vcm geofence", s.cfg.Radius))
+		}
+		robot.GetLocatorData(s.located)
+	}
+}
+
+// returnHome drives straight back to home, giving up after a few seconds
+func (s *Supervisor) returnHome() {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		robot, home, tripped := s.robot, s.home, s.tripped
+		s.mu.Unlock()
+		if tripped != "" || home == nil {
+			return
+		}
+
+		pos, err := s.locate()
+		if err != nil {
+			return
+		}
+		if distance(*home, pos) <= homeTolerance {
+			robot.Stop()
+			return
+		}
+
+		robot.Roll(s.cfg.HomeSpeed, headingTo(pos, *home))
+		time.Sleep(s.cfg.Poll.Or(200 * time.Millisecond))
+	}
+	log.Println("gave up returning home")
+}
+
+// ServeHTTP shows the safety state on GET and resets it on DELETE
+func (s *Supervisor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.Lock()
+		state := struct {
+			Tripped  string         `json:"tripped,omitempty"`
+			Home     *ollie.Point2D `json:"home,omitempty"`
+			Position ollie.Point2D  `json:"position"`
+			Seen     time.Time      `json:"seen"`
+		}{s.tripped, s.home, s.pos, s.seen}
+		s.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	case http.MethodDelete:
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// supervisedMover stops rolling once the supervisor trips
+type supervisedMover struct {
+	locatingMover
+	s *Supervisor
+}
+
+func (m supervisedMover) Roll(speed uint8, heading uint16) {
+	if m.s.Tripped() != "" {
+		return
+	}
+	m.locatingMover.Roll(speed, heading)
+}
+
+func distance(a, b ollie.Point2D) float64 {
+	return math.Hypot(float64(b.X)-float64(a.X), float64(b.Y)-float64(a.Y))
+}
+
+// headingTo returns the Sphero heading from one point to another. Heading
+// 0 is along +Y and headings increase clockwise.
+func headingTo(from, to ollie.Point2D) uint16 {
+	deg := math.Atan2(float64(to.X)-float64(from.X), float64(to.Y)-float64(from.Y)) * 180 / math.Pi
+	if deg < 0 {
+		deg += 360
+	}
+	return uint16(deg) % 360
+}
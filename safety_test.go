@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+// quietRobot only reports its position after ignoring the first few requests
+type quietRobot struct {
+	mu       sync.Mutex
+	silent   int
+	requests int
+	stops    int
+}
+
+func (r *quietRobot) GetLocatorData(f func(p ollie.Point2D)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.requests > r.silent {
+		go f(ollie.Point2D{X: 1, Y: 2})
+	}
+}
+
+func (r *quietRobot) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stops++
+}
+
+func (r *quietRobot) Roll(speed uint8, heading uint16)            {}
+func (r *quietRobot) SetRotationRate(speed uint8)                 {}
+func (r *quietRobot) SetStabilization(state bool)                 {}
+func (r *quietRobot) EnableStopOnDisconnect()                     {}
+func (r *quietRobot) On(name string, f func(s interface{})) error { return nil }
+func (r *quietRobot) Event(name string) string                    { return name }
+
+func testSafetyConfig() SafetyConfig {
+	return SafetyConfig{
+		Radius:    50,
+		Heartbeat: Duration(20 * time.Millisecond),
+		Poll:      Duration(5 * time.Millisecond),
+	}
+}
+
+func TestSupervisorRetriesBaseline(t *testing.T) {
+	s := NewSupervisor(testSafetyConfig())
+	if _, err := s.Begin(&quietRobot{silent: baselineAttempts - 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.End()
+
+	if reason := s.Tripped(); reason != "" {
+		t.Errorf("tripped on a late first position: %s", reason)
+	}
+	if s.home == nil || *s.home != (ollie.Point2D{X: 1, Y: 2}) {
+		t.Errorf("home is %v", s.home)
+	}
+}
+
+func TestSupervisorUnknownBaselineDoesNotLatch(t *testing.T) {
+	s := NewSupervisor(testSafetyConfig())
+	robot := &quietRobot{silent: baselineAttempts}
+	if _, err := s.Begin(robot); err == nil {
+		t.Fatal("started without knowing where the robot is")
+	}
+	if reason := s.Tripped(); reason != "" {
+		t.Fatalf("emergency stop latched: %s", reason)
+	}
+
+	// the next choreography tries again and the robot answers this time
+	if _, err := s.Begin(robot); err != nil {
+		t.Fatal(err)
+	}
+	s.End()
+}
+
+func TestSupervisorTripsOnLostHeartbeat(t *testing.T) {
+	s := NewSupervisor(testSafetyConfig())
+	robot := &quietRobot{}
+	if _, err := s.Begin(robot); err != nil {
+		t.Fatal(err)
+	}
+	robot.mu.Lock()
+	robot.silent = 1 << 30
+	robot.mu.Unlock()
+
+	deadline := time.Now().Add(time.Second)
+	for s.Tripped() == "" && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.End()
+	if s.Tripped() != "lost heartbeat" {
+		t.Errorf("tripped %q, want lost heartbeat", s.Tripped())
+	}
+}
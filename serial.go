@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.bug.st/serial"
+)
+
+// SerialLight drives an addressable LED strip through a microcontroller
+// on a USB serial port. The microcontroller reads one command per line
+// and does not answer:
+//
+//	A <r> <g> <b>                set every pixel
+//	P <i> <r> <g> <b>            set pixel i
+//	S <from> <to> <r> <g> <b>    set pixels from through to
+//	B <level>                    set the brightness of the whole strip
+//
+// Pixels are numbered from 0 and every value is decimal. Segments of the
+// strip can be assigned to pipelines; the rest of the strip shows the
+// plan and idle patterns like any other light.
+type SerialLight struct {
+	cfg  SerialConfig
+	open func() (io.WriteCloser, error)
+
+	mu       sync.Mutex
+	port     io.WriteCloser
+	segments map[string]Color
+}
+
+// SerialSegment assigns pixels From through To to a pipeline
+type SerialSegment struct {
+	Pipeline string `json:"pipeline"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+// SerialConfig describes the strip on Port. Brightness is 1 to 255;
+// leaving it out, or 0, means full brightness, since a strip at 0 would
+// show nothing at all.
+type SerialConfig struct {
+	Port       string          `json:"port"`
+	Baud       int             `json:"baud,omitempty"`
+	Pixels     int             `json:"pixels"`
+	Brightness uint8           `json:"brightness,omitempty"`
+	Segments   []SerialSegment `json:"segments,omitempty"`
+}
+
+func NewSerialLight(cfg SerialConfig) (*SerialLight, error) {
+	if cfg.Pixels <= 0 {
+		return nil, fmt.Errorf("serial light needs the number of pixels")
+	}
+	for _, seg := range cfg.Segments {
+		if seg.From < 0 || seg.To < seg.From || seg.To >= cfg.Pixels {
+			return nil, fmt.Errorf("segment %d-%d for %s is outside the strip", seg.From, seg.To, seg.Pipeline)
+		}
+	}
+	if cfg.Baud == 0 {
+		cfg.Baud = 115200
+	}
+	if cfg.Brightness == 0 {
+		cfg.Brightness = 255
+	}
+
+	return &SerialLight{
+		cfg: cfg,
+		open: func() (io.WriteCloser, error) {
+			return serial.Open(cfg.Port, &serial.Mode{BaudRate: cfg.Baud})
+		},
+		segments: make(map[string]Color),
+	}, nil
+}
+
+// Start opens the port and restores the brightness and segments
+func (s *SerialLight) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Println("opening serial port", s.cfg.Port)
+	port, err := s.open()
+	if err != nil {
+		return errors.Wrap(err, "can't open serial port "+s.cfg.Port)
+	}
+	s.port = port
+
+	err = s.send("B %d", s.cfg.Brightness)
+	for _, seg := range s.cfg.Segments {
+		if err == nil {
+			err = s.sendSegment(seg, s.segments[seg.Pipeline])
+		}
+	}
+	return err
+}
+
+// Stop turns the strip off and closes the port
+func (s *SerialLight) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.port == nil {
+		return nil
+	}
+	log.Println("closing serial port", s.cfg.Port)
+	s.send("A 0 0 0")
+	err := s.port.Close()
+	s.port = nil
+	return err
+}
+
+func (s *SerialLight) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.port != nil
+}
+
+// SetRGB colors every pixel that isn't part of a segment
+func (s *SerialLight) SetRGB(r, g, b uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if len(s.cfg.Segments) == 0 {
+		err = s.send("A %d %d %d", r, g, b)
+	} else {
+		for _, gap := range s.gaps() {
+			if err == nil {
+				err = s.send("S %d %d %d %d %d", gap[0], gap[1], r, g, b)
+			}
+		}
+	}
+	return err
+}
+
+// SetPixel colors a single pixel
+func (s *SerialLight) SetPixel(i int, c Color) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.send("P %d %d %d %d", i, c.Red, c.Green, c.Blue)
+}
+
+// SetBrightness changes the brightness of the whole strip
+func (s *SerialLight) SetBrightness(level uint8) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg.Brightness = level
+	return s.send("B %d", level)
+}
+
+// SetSegment colors the segments assigned to pipeline
+func (s *SerialLight) SetSegment(pipeline string, c Color) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.segments[pipeline] = c
+	for _, seg := range s.cfg.Segments {
+		if seg.Pipeline != pipeline {
+			continue
+		}
+		if err := s.sendSegment(seg, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchSegments keeps each segment showing the status of its pipeline
+func (s *SerialLight) WatchSegments(registry *StatusRegistry) {
+	if len(s.cfg.Segments) == 0 {
+		return
+	}
+
+	changed := registry.Changed()
+	for {
+		for _, seg := range s.cfg.Segments {
+			ps, _ := registry.Get(seg.Pipeline)
+			if err := s.SetSegment(seg.Pipeline, ps.Status.Color()); err != nil {
+				log.Println("error setting serial segment", seg.Pipeline, err)
+			}
+		}
+		<-changed
+	}
+}
+
+func (s *SerialLight) sendSegment(seg SerialSegment, c Color) error {
+	return s.send("S %d %d %d %d %d", seg.From, seg.To, c.Red, c.Green, c.Blue)
+}
+
+// send writes one command line. Commands sent while the port is closed
+// are dropped; Start replays the state that matters.
+func (s *SerialLight) send(format string, args ...interface{}) error {
+	if s.port == nil {
+		return nil
+	}
+	_, err := fmt.Fprintf(s.port, format+"\n", args...)
+	return err
+}
+
+// gaps returns the pixel ranges not covered by any segment
+func (s *SerialLight) gaps() [][2]int {
+	covered := make([]bool, s.cfg.Pixels)
+	for _, seg := range s.cfg.Segments {
+		for i := seg.From; i <= seg.To; i++ {
+			covered[i] = true
+		}
+	}
+
+	var gaps [][2]int
+	for i := 0; i < len(covered); i++ {
+		if covered[i] {
+			continue
+		}
+		start := i
+		for i+1 < len(covered) && !covered[i+1] {
+			i++
+		}
+		gaps = append(gaps, [2]int{start, i})
+	}
+	return gaps
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fakePort stands in for the serial port and keeps every line written
+type fakePort struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (p *fakePort) Close() error {
+	p.closed = true
+	return nil
+}
+
+// lines returns the lines written since the last call
+func (p *fakePort) lines() []string {
+	s := strings.TrimSuffix(p.String(), "\n")
+	p.Reset()
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+func newTestSerialLight(t *testing.T, cfg SerialConfig) (*SerialLight, *fakePort) {
+	t.Helper()
+	s, err := NewSerialLight(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := &fakePort{}
+	s.open = func() (io.WriteCloser, error) { return port, nil }
+	return s, port
+}
+
+func expectLines(t *testing.T, port *fakePort, want ...string) {
+	t.Helper()
+	if got := port.lines(); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSerialProtocol(t *testing.T) {
+	s, port := newTestSerialLight(t, SerialConfig{Pixels: 10, Brightness: 128})
+
+	// nothing is sent before the port is open
+	if err := s.SetRGB(1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, port)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	expectLines(t, port, "B 128")
+
+	s.SetRGB(255, 0, 10)
+	expectLines(t, port, "A 255 0 10")
+
+	s.SetPixel(7, Color{Red: 1, Green: 2, Blue: 3})
+	expectLines(t, port, "P 7 1 2 3")
+
+	s.SetBrightness(40)
+	expectLines(t, port, "B 40")
+
+	s.Stop()
+	expectLines(t, port, "A 0 0 0")
+	if !port.closed || s.Running() {
+		t.Error("port still open after Stop")
+	}
+
+	// brightness changes survive a restart
+	s.Start()
+	expectLines(t, port, "B 40")
+}
+
+func TestSerialSegments(t *testing.T) {
+	s, port := newTestSerialLight(t, SerialConfig{
+		Pixels: 10,
+		Segments: []SerialSegment{
+			{Pipeline: "build", From: 0, To: 2},
+			{Pipeline: "deploy", From: 5, To: 6},
+		},
+	})
+	s.Start()
+	expectLines(t, port, "B 255", "S 0 2 0 0 0", "S 5 6 0 0 0")
+
+	s.SetSegment("build", Color{Green: 255})
+	expectLines(t, port, "S 0 2 0 255 0")
+
+	// the plan only colors the pixels between segments
+	s.SetRGB(9, 9, 9)
+	expectLines(t, port, "S 3 4 9 9 9", "S 7 9 9 9 9")
+
+	// segments come back after reconnecting
+	s.Stop()
+	port.lines()
+	s.Start()
+	expectLines(t, port, "B 255", "S 0 2 0 255 0", "S 5 6 0 0 0")
+}
+
+func TestSerialConfigErrors(t *testing.T) {
+	configs := map[string]SerialConfig{
+		"no pixels":        {},
+		"segment past end": {Pixels: 4, Segments: []SerialSegment{{Pipeline: "a", From: 2, To: 4}}},
+		"backwards":        {Pixels: 4, Segments: []SerialSegment{{Pipeline: "a", From: 2, To: 1}}},
+	}
+	for name, cfg := range configs {
+		if _, err := NewSerialLight(cfg); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+// Package spherov1 encodes and decodes Sphero API v1 packets, used by the
+// BB-8, Ollie and SPRK, and names their commands for people reading
+// traces.
+package spherov1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"gobot.io/x/gobot/platforms/sphero"
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+// Packets start with SOP1 and then SOP2, which tells them apart: commands
+// send SOP2Answer to ask for a simple response or SOP2NoAnswer, and from
+// the robot SOP2Answer starts a simple response and SOP2Async an async
+// message.
+const (
+	SOP1         = 0xFF
+	SOP2Answer   = 0xFF
+	SOP2NoAnswer = 0xFE
+	SOP2Async    = 0xFE
+)
+
+// The length counts the data and the checksum, in one byte for commands
+// and simple responses and in two for async messages
+const (
+	MaxData      = 0xFF - 1
+	MaxAsyncData = 0xFFFF - 1
+)
+
+// Kind says what a packet is
+type Kind int
+
+const (
+	Command Kind = iota
+	Response
+	Async
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Command:
+		return "command"
+	case Response:
+		return "response"
+	case Async:
+		return "async"
+	}
+	return fmt.Sprintf("kind(%d)", int(k))
+}
+
+// Packet is a decoded packet. Commands have a device and command ID,
+// responses a response code, and async messages an ID code; Seq is set on
+// commands and responses.
+type Packet struct {
+	Kind      Kind
+	Answer    bool
+	DeviceID  byte
+	CommandID byte
+	Response  byte
+	AsyncID   byte
+	Seq       byte
+	Data      []byte
+}
+
+// checksum is the inverted sum of everything after SOP2
+func checksum(buf []byte) byte {
+	var sum byte
+	for _, b := range buf {
+		sum += b
+	}
+	return ^sum
+}
+
+// Encode frames the packet with its length and checksum. It fails for
+// data longer than the length field can count.
+func (p Packet) Encode() ([]byte, error) {
+	max := MaxData
+	if p.Kind == Async {
+		max = MaxAsyncData
+	}
+	if len(p.Data) > max {
+		return nil, fmt.Errorf("%s data is %d bytes, at most %d fit", p.Kind, len(p.Data), max)
+	}
+
+	n := len(p.Data) + 1
+	var frame []byte
+	switch p.Kind {
+	case Command:
+		sop2 := byte(SOP2NoAnswer)
+		if p.Answer {
+			sop2 = SOP2Answer
+		}
+		frame = []byte{SOP1, sop2, p.DeviceID, p.CommandID, p.Seq, byte(n)}
+	case Response:
+		frame = []byte{SOP1, SOP2Answer, p.Response, p.Seq, byte(n)}
+	case Async:
+		frame = []byte{SOP1, SOP2Async, p.AsyncID, byte(n >> 8), byte(n)}
+	default:
+		return nil, fmt.Errorf("can't encode a packet of %s", p.Kind)
+	}
+	frame = append(frame, p.Data...)
+	return append(frame, checksum(frame[2:])), nil
+}
+
+// DecodeCommand parses a command sent to the robot. It returns the
+// number of bytes used, so a buffer of several packets can be split.
+func DecodeCommand(buf []byte) (Packet, int, error) {
+	p := Packet{Kind: Command}
+	if len(buf) < 7 {
+		return p, 0, fmt.Errorf("command too short")
+	}
+	if buf[0] != SOP1 || (buf[1] != SOP2Answer && buf[1] != SOP2NoAnswer) {
+		return p, 0, fmt.Errorf("command doesn't start with SOP")
+	}
+	p.Answer = buf[1] == SOP2Answer
+	p.DeviceID, p.CommandID, p.Seq = buf[2], buf[3], buf[4]
+	return p.body(buf, 6, int(buf[5]))
+}
+
+// DecodeReply parses a simple response or async message from the robot,
+// returning the number of bytes used like DecodeCommand
+func DecodeReply(buf []byte) (Packet, int, error) {
+	var p Packet
+	if len(buf) < 6 {
+		return p, 0, fmt.Errorf("reply too short")
+	}
+	if buf[0] != SOP1 {
+		return p, 0, fmt.Errorf("reply doesn't start with SOP")
+	}
+	switch buf[1] {
+	case SOP2Answer:
+		p.Kind = Response
+		p.Response, p.Seq = buf[2], buf[3]
+		return p.body(buf, 5, int(buf[4]))
+	case SOP2Async:
+		p.Kind = Async
+		p.AsyncID = buf[2]
+		return p.body(buf, 5, int(binary.BigEndian.Uint16(buf[3:5])))
+	}
+	return p, 0, fmt.Errorf("unknown SOP2 0x%02X", buf[1])
+}
+
+// body takes the data and checks the checksum. dlen counts the data and
+// the checksum and starts at header.
+func (p Packet) body(buf []byte, header, dlen int) (Packet, int, error) {
+	if dlen < 1 {
+		return p, 0, fmt.Errorf("packet length is zero")
+	}
+	end := header + dlen
+	if len(buf) < end {
+		return p, 0, fmt.Errorf("packet wants %d bytes, got %d", end, len(buf))
+	}
+	if checksum(buf[2:end-1]) != buf[end-1] {
+		return p, 0, fmt.Errorf("bad checksum")
+	}
+	p.Data = append([]byte(nil), buf[header:end-1]...)
+	return p, end, nil
+}
+
+// devices names the v1 devices and their commands
+var devices = map[byte]struct {
+	name     string
+	commands map[byte]string
+}{
+	0x00: {"core", map[byte]string{
+		0x01: "ping",
+		0x02: "get-versioning",
+		0x10: "set-device-name",
+		0x11: "get-bluetooth-info",
+		0x12: "set-auto-reconnect",
+		0x13: "get-auto-reconnect",
+		0x20: "get-power-state",
+		0x21: "set-power-notification",
+		0x22: "sleep",
+		0x23: "get-voltage-trip-points",
+		0x24: "set-voltage-trip-points",
+		0x25: "set-inactivity-timeout",
+		0x30: "jump-to-bootloader",
+		0x40: "level-1-diagnostics",
+		0x41: "level-2-diagnostics",
+		0x50: "assign-time",
+		0x51: "poll-packet-times",
+	}},
+	0x02: {"sphero", map[byte]string{
+		0x01: "set-heading",
+		0x02: "set-stabilization",
+		0x03: "set-rotation-rate",
+		0x0F: "self-level",
+		0x11: "set-data-streaming",
+		0x12: "configure-collision-detection",
+		0x13: "configure-locator",
+		0x15: "read-locator",
+		0x20: "set-rgb-led",
+		0x21: "set-back-led",
+		0x22: "get-rgb-led",
+		0x30: "roll",
+		0x31: "boost",
+		0x33: "set-raw-motors",
+		0x34: "set-motion-timeout",
+		0x35: "set-option-flags",
+		0x36: "get-option-flags",
+		0x37: "set-temporary-option-flags",
+		0x38: "get-temporary-option-flags",
+		0x50: "run-macro",
+		0x51: "save-temporary-macro",
+		0x52: "save-macro",
+		0x55: "abort-macro",
+		0x56: "get-macro-status",
+		0x57: "set-macro-parameter",
+	}},
+}
+
+// responses names the simple response codes
+var responses = map[byte]string{
+	0x00: "ok",
+	0x01: "general-error",
+	0x02: "bad-checksum",
+	0x03: "fragment",
+	0x04: "bad-command",
+	0x05: "unsupported",
+	0x06: "bad-message",
+	0x07: "bad-parameter",
+	0x08: "execution-failed",
+	0x09: "bad-device",
+	0x0A: "memory-busy",
+	0x0B: "bad-password",
+	0x31: "power-too-low",
+	0x32: "illegal-page",
+	0x33: "flash-failed",
+	0x34: "main-app-corrupt",
+	0x35: "timeout",
+}
+
+// asyncIDs names the async message ID codes
+var asyncIDs = map[byte]string{
+	0x01: "power-notification",
+	0x02: "level-1-diagnostics",
+	0x03: "sensor-data",
+	0x04: "config-block",
+	0x05: "pre-sleep-warning",
+	0x06: "macro-marker",
+	0x07: "collision",
+	0x08: "orbbasic-print",
+	0x09: "orbbasic-error",
+	0x0A: "orbbasic-error-binary",
+	0x0B: "self-level-result",
+	0x0C: "gyro-axis-limit",
+	0x0D: "souls-data",
+	0x0E: "level-up",
+	0x0F: "shield-damage",
+	0x10: "xp-update",
+	0x11: "boost-update",
+}
+
+func nameOr(names map[byte]string, code byte) string {
+	if name, ok := names[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", code)
+}
+
+// ResponseName names a simple response code
+func ResponseName(code byte) string {
+	return nameOr(responses, code)
+}
+
+// CommandName is "device/command" for a device and command ID
+func CommandName(did, cid byte) string {
+	dev, ok := devices[did]
+	if !ok {
+		return fmt.Sprintf("0x%02X/0x%02X", did, cid)
+	}
+	return dev.name + "/" + nameOr(dev.commands, cid)
+}
+
+func (p Packet) String() string {
+	var b strings.Builder
+	switch p.Kind {
+	case Command:
+		fmt.Fprintf(&b, "command %s seq=%d", CommandName(p.DeviceID, p.CommandID), p.Seq)
+		if !p.Answer {
+			b.WriteString(" no-answer")
+		}
+	case Response:
+		fmt.Fprintf(&b, "response %s seq=%d", nameOr(responses, p.Response), p.Seq)
+	case Async:
+		fmt.Fprintf(&b, "async %s", nameOr(asyncIDs, p.AsyncID))
+	}
+	if len(p.Data) > 0 {
+		fmt.Fprintf(&b, " data=%s", hex.EncodeToString(p.Data))
+	}
+	if fields := p.fields(); fields != "" {
+		b.WriteString(" " + fields)
+	}
+	return b.String()
+}
+
+// fields spells out the data of the packets the robot driver uses
+func (p Packet) fields() string {
+	d := p.Data
+	switch {
+	case p.Kind == Command && p.DeviceID == 0x02 && p.CommandID == 0x20 && len(d) == 4:
+		return fmt.Sprintf("(r=%d g=%d b=%d persist=%d)", d[0], d[1], d[2], d[3])
+	case p.Kind == Command && p.DeviceID == 0x02 && p.CommandID == 0x30 && len(d) == 4:
+		return fmt.Sprintf("(speed=%d heading=%d state=%d)", d[0], binary.BigEndian.Uint16(d[1:3]), d[3])
+	case p.Kind == Command && p.DeviceID == 0x02 && p.CommandID == 0x12 && len(d) == 6:
+		return fmt.Sprintf("(method=%d xt=%d yt=%d xs=%d ys=%d dead=%d)", d[0], d[1], d[2], d[3], d[4], d[5])
+	case p.Kind == Async && p.AsyncID == 0x07:
+		var c sphero.CollisionPacket
+		if binary.Read(bytes.NewReader(d), binary.BigEndian, &c) == nil {
+			return fmt.Sprintf("(x=%d y=%d z=%d axis=%d xmag=%d ymag=%d speed=%d t=%d)",
+				c.X, c.Y, c.Z, c.Axis, c.XMagnitude, c.YMagnitude, c.Speed, c.Timestamp)
+		}
+	case p.Kind == Async && p.AsyncID == 0x01 && len(d) == 1:
+		return fmt.Sprintf("(state=%s)", nameOr(powerStates, d[0]))
+	}
+	return ""
+}
+
+// DescribeResponse spells out a simple response to a known command
+func DescribeResponse(p Packet, did, cid byte) string {
+	d := p.Data
+	switch {
+	case did == 0x02 && cid == 0x15 && len(d) >= 4:
+		return fmt.Sprintf("(x=%d y=%d)", int16(binary.BigEndian.Uint16(d[0:2])), int16(binary.BigEndian.Uint16(d[2:4])))
+	case did == 0x00 && cid == 0x20:
+		var s ollie.PowerStatePacket
+		if binary.Read(bytes.NewReader(d), binary.BigEndian, &s) == nil {
+			return fmt.Sprintf("(state=%s volts=%.2f charges=%d awake=%ds)",
+				nameOr(powerStates, s.PowerState), float64(s.BattVoltage)/100, s.NumCharges, s.TimeSinceChg)
+		}
+	}
+	return ""
+}
+
+var powerStates = map[byte]string{
+	0x01: "charging",
+	0x02: "ok",
+	0x03: "low",
+	0x04: "critical",
+}
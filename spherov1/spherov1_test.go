@@ -0,0 +1,144 @@
+package spherov1
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func unhex(t testing.TB, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+var packets = []struct {
+	name   string
+	packet Packet
+	frame  string
+}{
+	{"set rgb", Packet{Kind: Command, Answer: true, DeviceID: 0x02, CommandID: 0x20, Data: []byte{0xFF, 0, 0, 1}}, "ff ff 02 20 00 05 ff 00 00 01 d8"},
+	{"sleep without answer", Packet{Kind: Command, DeviceID: 0x00, CommandID: 0x22, Seq: 3, Data: []byte{0, 0, 0, 0, 0}}, "ff fe 00 22 03 06 00 00 00 00 00 d4"},
+	{"ping", Packet{Kind: Command, Answer: true, DeviceID: 0x00, CommandID: 0x01, Seq: 9}, "ff ff 00 01 09 01 f4"},
+	{"ok", Packet{Kind: Response, Seq: 0}, "ff ff 00 00 01 fe"},
+	{"unsupported", Packet{Kind: Response, Response: 0x05, Seq: 1}, "ff ff 05 01 01 f8"},
+	{"locator", Packet{Kind: Response, Seq: 4, Data: []byte{0, 10, 0xFF, 0xF6}}, "ff ff 00 04 05 00 0a ff f6 f7"},
+	{"pre-sleep warning", Packet{Kind: Async, AsyncID: 0x05}, "ff fe 05 00 01 f9"},
+}
+
+func TestEncode(t *testing.T) {
+	for _, tt := range packets {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.packet.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := unhex(t, tt.frame); !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tt := range packets {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.packet.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decode := DecodeReply
+			if tt.packet.Kind == Command {
+				decode = DecodeCommand
+			}
+			got, n, err := decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(buf) {
+				t.Errorf("used %d of %d bytes", n, len(buf))
+			}
+			if !reflect.DeepEqual(got, tt.packet) {
+				t.Errorf("got %#v, want %#v", got, tt.packet)
+			}
+		})
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	for _, kind := range []Kind{Command, Response} {
+		p := Packet{Kind: kind, Data: make([]byte, MaxData)}
+		if _, err := p.Encode(); err != nil {
+			t.Errorf("%s with %d bytes: %v", kind, MaxData, err)
+		}
+		p.Data = append(p.Data, 0)
+		if buf, err := p.Encode(); err == nil {
+			t.Errorf("%s with %d bytes encoded with length %d", kind, len(p.Data), buf[len(buf)-len(p.Data)-2])
+		}
+	}
+
+	// async messages have room for more
+	if _, err := (Packet{Kind: Async, Data: make([]byte, MaxData+1)}).Encode(); err != nil {
+		t.Error(err)
+	}
+	if _, err := (Packet{Kind: Kind(7)}).Encode(); err == nil {
+		t.Error("encoded an unknown kind")
+	}
+}
+
+// checkDecoded checks a packet decoded from buf encodes back to the bytes
+// it was decoded from
+func checkDecoded(t *testing.T, buf []byte, p Packet, n int, err error) {
+	if err != nil {
+		if n != 0 {
+			t.Errorf("used %d bytes of a bad packet", n)
+		}
+		return
+	}
+	if n <= 0 || n > len(buf) {
+		t.Fatalf("used %d of %d bytes", n, len(buf))
+	}
+	again, err := p.Encode()
+	if err != nil {
+		t.Fatalf("can't encode %#v: %v", p, err)
+	}
+	if !bytes.Equal(again, buf[:n]) {
+		t.Errorf("% x decoded to %#v, which encodes to % x", buf[:n], p, again)
+	}
+	_ = p.String()
+}
+
+func FuzzDecodeCommand(f *testing.F) {
+	for _, tt := range packets {
+		if tt.packet.Kind == Command {
+			f.Add(unhex(f, tt.frame))
+		}
+	}
+	f.Add([]byte{0xFF, 0xFF, 0x02, 0x20, 0x00, 0x00, 0xDD})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		p, n, err := DecodeCommand(buf)
+		checkDecoded(t, buf, p, n, err)
+	})
+}
+
+func FuzzDecodeReply(f *testing.F) {
+	for _, tt := range packets {
+		if tt.packet.Kind != Command {
+			f.Add(unhex(f, tt.frame))
+		}
+	}
+	f.Add([]byte{0xFF, 0xFE, 0x07, 0xFF, 0xFF, 0x00})
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		p, n, err := DecodeReply(buf)
+		checkDecoded(t, buf, p, n, err)
+		if err == nil {
+			_ = DescribeResponse(p, 0x02, 0x15)
+			_ = DescribeResponse(p, 0x00, 0x20)
+		}
+	})
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/ble"
+)
+
+// Sphero API v2 framing, used by the Sphero Mini and BOLT
+const (
+	v2SOP = 0x8D
+	v2EOP = 0xD8
+	v2ESC = 0xAB
+
+	// escaped bytes are sent as ESC followed by the byte with these bits cleared
+	v2EscapeMask = 0x88
+
+	V2FlagIsResponse              = 0x01
+	V2FlagRequestsResponse        = 0x02
+	V2FlagRequestsErrorResponse   = 0x04
+	V2FlagResetsInactivityTimeout = 0x08
+	V2FlagHasTargetID             = 0x10
+	V2FlagHasSourceID             = 0x20
+)
+
+// Sphero API v2 devices and commands
+const (
+	v2DevicePower = 0x13
+	v2DeviceIO    = 0x1A
+
+	v2CmdSleep = 0x01
+	v2CmdWake  = 0x0D
+
+	v2CmdSetLEDs16           = 0x0E
+	v2CmdSetLEDs32           = 0x1C
+	v2CmdMatrixPixel         = 0x2D
+	v2CmdMatrixFillColor     = 0x2F
+	v2CmdMatrixFillRectangle = 0x3E
+
+	// the BOLT routes commands to one of its two processors
+	v2TargetPrimary   = 0x11
+	v2TargetSecondary = 0x12
+)
+
+const (
+	v2APIService            = "00010001574f4f2053706865726f2121"
+	v2AntiDOSService        = "00020001574f4f2053706865726f2121"
+	v2APICharacteristic     = "00010002574f4f2053706865726f2121"
+	v2AntiDOSCharacteristic = "00020005574f4f2053706865726f2121"
+	v2AntiDOSUnlock         = "usetheforce...band"
+)
+
+// V2Packet is a decoded Sphero API v2 packet. TargetID and SourceID are
+// only sent when the matching flag is set, and ErrorCode only on
+// responses.
+type V2Packet struct {
+	Flags     byte
+	TargetID  byte
+	SourceID  byte
+	DeviceID  byte
+	CommandID byte
+	Seq       byte
+	ErrorCode byte
+	Data      []byte
+}
+
+// Encode frames the packet with its checksum, escaping and delimiters
+func (p V2Packet) Encode() []byte {
+	body := []byte{p.Flags}
+	if p.Flags&V2FlagHasTargetID != 0 {
+		body = append(body, p.TargetID)
+	}
+	if p.Flags&V2FlagHasSourceID != 0 {
+		body = append(body, p.SourceID)
+	}
+	body = append(body, p.DeviceID, p.CommandID, p.Seq)
+	if p.Flags&V2FlagIsResponse != 0 {
+		body = append(body, p.ErrorCode)
+	}
+	body = append(body, p.Data...)
+
+	var sum byte
+	for _, b := range body {
+		sum += b
+	}
+	body = append(body, ^sum)
+
+	frame := []byte{v2SOP}
+	for _, b := range body {
+		switch b {
+		case v2SOP, v2EOP, v2ESC:
+			frame = append(frame, v2ESC, b&^v2EscapeMask)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, v2EOP)
+}
+
+// DecodeV2 parses one framed packet, from SOP to EOP inclusive
+func DecodeV2(frame []byte) (V2Packet, error) {
+	var p V2Packet
+	if len(frame) < 2 || frame[0] != v2SOP || frame[len(frame)-1] != v2EOP {
+		return p, fmt.Errorf("v2 packet is not delimited by SOP and EOP")
+	}
+
+	var body []byte
+	escaped := false
+	for _, b := range frame[1 : len(frame)-1] {
+		switch {
+		case escaped:
+			body = append(body, b|v2EscapeMask)
+			escaped = false
+		case b == v2ESC:
+			escaped = true
+		case b == v2SOP || b == v2EOP:
+			return p, fmt.Errorf("unescaped delimiter 0x%02X inside v2 packet", b)
+		default:
+			body = append(body, b)
+		}
+	}
+	if escaped {
+		return p, fmt.Errorf("v2 packet ends in an escape")
+	}
+
+	var sum byte
+	for _, b := range body {
+		sum += b
+	}
+	if sum != 0xFF {
+		return p, fmt.Errorf("bad v2 checksum")
+	}
+	body = body[:len(body)-1]
+
+	if len(body) < 1 {
+		return p, fmt.Errorf("v2 packet too short")
+	}
+	p.Flags = body[0]
+	rest := body[1:]
+
+	need := 3
+	for _, flag := range []byte{V2FlagHasTargetID, V2FlagHasSourceID, V2FlagIsResponse} {
+		if p.Flags&flag != 0 {
+			need++
+		}
+	}
+	if len(rest) < need {
+		return p, fmt.Errorf("v2 packet too short")
+	}
+
+	if p.Flags&V2FlagHasTargetID != 0 {
+		p.TargetID, rest = rest[0], rest[1:]
+	}
+	if p.Flags&V2FlagHasSourceID != 0 {
+		p.SourceID, rest = rest[0], rest[1:]
+	}
+	p.DeviceID, p.CommandID, p.Seq, rest = rest[0], rest[1], rest[2], rest[3:]
+	if p.Flags&V2FlagIsResponse != 0 {
+		p.ErrorCode, rest = rest[0], rest[1:]
+	}
+	p.Data = rest
+	return p, nil
+}
+
+// SpheroV2Model selects the LED layout of a v2 robot
+type SpheroV2Model int
+
+const (
+	SpheroMini SpheroV2Model = iota
+	SpheroBolt
+)
+
+// SpheroV2Driver is a Gobot driver for robots speaking Sphero API v2
+type SpheroV2Driver struct {
+	name       string
+	connection gobot.Connection
+	model      SpheroV2Model
+
+	mtx   sync.Mutex
+	seq   byte
+	frame []byte
+	gobot.Eventer
+}
+
+const (
+	// V2Response is published with every decoded V2Packet from the robot
+	V2Response = "response"
+
+	// V2Error is published when a packet can't be sent or decoded
+	V2Error = "error"
+)
+
+// NewSpheroMiniDriver creates a driver for a Sphero Mini
+func NewSpheroMiniDriver(a ble.BLEConnector) *SpheroV2Driver {
+	return newSpheroV2Driver(a, SpheroMini, "SpheroMini")
+}
+
+// NewSpheroBoltDriver creates a driver for a Sphero BOLT
+func NewSpheroBoltDriver(a ble.BLEConnector) *SpheroV2Driver {
+	return newSpheroV2Driver(a, SpheroBolt, "SpheroBolt")
+}
+
+func newSpheroV2Driver(a ble.BLEConnector, model SpheroV2Model, name string) *SpheroV2Driver {
+	d := &SpheroV2Driver{
+		name:       gobot.DefaultName(name),
+		connection: a,
+		model:      model,
+		Eventer:    gobot.NewEventer(),
+	}
+	d.AddEvent(V2Response)
+	d.AddEvent(V2Error)
+	return d
+}
+
+// Name returns the name for the Driver
+func (d *SpheroV2Driver) Name() string { return d.name }
+
+// SetName sets the Name for the Driver
+func (d *SpheroV2Driver) SetName(n string) { d.name = n }
+
+// Connection returns the connection to this robot
+func (d *SpheroV2Driver) Connection() gobot.Connection { return d.connection }
+
+// GATTRequirements lists the services the driver uses
+func (d *SpheroV2Driver) GATTRequirements() []GATTRequirement {
+	return []GATTRequirement{
+		{Service: v2APIService, Characteristics: []string{v2APICharacteristic}},
+		{Service: v2AntiDOSService, Characteristics: []string{v2AntiDOSCharacteristic}},
+	}
+}
+
+func (d *SpheroV2Driver) adaptor() ble.BLEConnector {
+	return d.Connection().(ble.BLEConnector)
+}
+
+// Start unlocks the API, subscribes to responses and wakes the robot
+func (d *SpheroV2Driver) Start() (err error) {
+	err = d.adaptor().WriteCharacteristic(v2AntiDOSCharacteristic, []byte(v2AntiDOSUnlock))
+	if err != nil {
+		return err
+	}
+
+	err = d.adaptor().Subscribe(v2APICharacteristic, d.HandleResponses)
+	if err != nil {
+		return err
+	}
+
+	return d.Wake()
+}
+
+// Halt puts the robot to sleep
+func (d *SpheroV2Driver) Halt() (err error) {
+	return d.Sleep()
+}
+
+// Wake wakes the robot from soft sleep
+func (d *SpheroV2Driver) Wake() error {
+	return d.send(v2DevicePower, v2CmdWake, v2TargetPrimary, nil)
+}
+
+// Sleep puts the robot into soft sleep
+func (d *SpheroV2Driver) Sleep() error {
+	return d.send(v2DevicePower, v2CmdSleep, v2TargetPrimary, nil)
+}
+
+// SetRGB sets the main LED. On a BOLT that is the front LED.
+func (d *SpheroV2Driver) SetRGB(r uint8, g uint8, b uint8) error {
+	if d.model == SpheroBolt {
+		return d.setLEDs32(0x07, r, g, b)
+	}
+	return d.setLEDs16(0x0E, r, g, b)
+}
+
+// SetBackLEDOutput sets the brightness of the back LED
+func (d *SpheroV2Driver) SetBackLEDOutput(value uint8) error {
+	if d.model == SpheroBolt {
+		return d.setLEDs32(0x38, value, value, value)
+	}
+	return d.setLEDs16(0x01, value)
+}
+
+// MatrixFill sets every pixel of the BOLT's LED matrix to c
+func (d *SpheroV2Driver) MatrixFill(c Color) error {
+	return d.matrix(v2CmdMatrixFillColor, c.Red, c.Green, c.Blue)
+}
+
+// MatrixPixel sets one pixel of the BOLT's LED matrix
+func (d *SpheroV2Driver) MatrixPixel(x, y uint8, c Color) error {
+	return d.matrix(v2CmdMatrixPixel, x, y, c.Red, c.Green, c.Blue)
+}
+
+// MatrixFillRect sets a rectangle of the BOLT's LED matrix, corners
+// inclusive
+func (d *SpheroV2Driver) MatrixFillRect(x1, y1, x2, y2 uint8, c Color) error {
+	return d.matrix(v2CmdMatrixFillRectangle, x1, y1, x2, y2, c.Red, c.Green, c.Blue)
+}
+
+func (d *SpheroV2Driver) matrix(cmd byte, data ...byte) error {
+	if d.model != SpheroBolt {
+		return fmt.Errorf("only the BOLT has an LED matrix")
+	}
+	return d.send(v2DeviceIO, cmd, v2TargetSecondary, data)
+}
+
+func (d *SpheroV2Driver) setLEDs16(mask uint16, values ...byte) error {
+	data := make([]byte, 2, 2+len(values))
+	binary.BigEndian.PutUint16(data, mask)
+	return d.send(v2DeviceIO, v2CmdSetLEDs16, v2TargetPrimary, append(data, values...))
+}
+
+func (d *SpheroV2Driver) setLEDs32(mask uint32, values ...byte) error {
+	data := make([]byte, 4, 4+len(values))
+	binary.BigEndian.PutUint32(data, mask)
+	return d.send(v2DeviceIO, v2CmdSetLEDs32, v2TargetSecondary, append(data, values...))
+}
+
+func (d *SpheroV2Driver) send(did, cid, target byte, data []byte) error {
+	d.mtx.Lock()
+	p := V2Packet{
+		Flags:     V2FlagRequestsErrorResponse | V2FlagResetsInactivityTimeout,
+		DeviceID:  did,
+		CommandID: cid,
+		Seq:       d.seq,
+		Data:      data,
+	}
+	d.seq++
+	d.mtx.Unlock()
+
+	// only the BOLT has more than one processor to address
+	if d.model == SpheroBolt {
+		p.Flags |= V2FlagHasTargetID
+		p.TargetID = target
+	}
+
+	err := d.adaptor().WriteCharacteristic(v2APICharacteristic, p.Encode())
+	if err != nil {
+		d.Publish(V2Error, err)
+	}
+	return err
+}
+
+// HandleResponses reassembles notifications into packets. A packet can
+// span several notifications, or one notification can carry several.
+func (d *SpheroV2Driver) HandleResponses(data []byte, e error) {
+	if e != nil {
+		d.Publish(V2Error, e)
+		return
+	}
+
+	d.mtx.Lock()
+	var frames [][]byte
+	for _, b := range data {
+		if b == v2SOP {
+			d.frame = d.frame[:0]
+		}
+		d.frame = append(d.frame, b)
+		if b == v2EOP && len(d.frame) > 0 && d.frame[0] == v2SOP {
+			frames = append(frames, append([]byte(nil), d.frame...))
+			d.frame = d.frame[:0]
+		}
+	}
+	d.mtx.Unlock()
+
+	for _, frame := range frames {
+		p, err := DecodeV2(frame)
+		if err != nil {
+			d.Publish(V2Error, err)
+			continue
+		}
+		if p.Flags&V2FlagIsResponse != 0 && p.ErrorCode != 0 {
+			d.Publish(V2Error, fmt.Errorf("command %02X:%02X failed with error code %d", p.DeviceID, p.CommandID, p.ErrorCode))
+		}
+		d.Publish(V2Response, p)
+	}
+}
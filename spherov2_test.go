@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var v2Packets = []struct {
+	name   string
+	packet V2Packet
+	frame  string
+}{
+	{
+		"wake as sent by the Sphero apps",
+		V2Packet{Flags: V2FlagRequestsResponse | V2FlagResetsInactivityTimeout, DeviceID: v2DevicePower, CommandID: v2CmdWake},
+		"8d 0a 13 0d 00 d5 d8",
+	},
+	{
+		"wake",
+		V2Packet{Flags: V2FlagRequestsErrorResponse | V2FlagResetsInactivityTimeout, DeviceID: v2DevicePower, CommandID: v2CmdWake},
+		"8d 0c 13 0d 00 d3 d8",
+	},
+	{
+		"mini main led",
+		V2Packet{Flags: 0x0C, DeviceID: v2DeviceIO, CommandID: v2CmdSetLEDs16, Seq: 1, Data: []byte{0x00, 0x0E, 0xFF, 0x00, 0x00}},
+		"8d 0c 1a 0e 01 00 0e ff 00 00 bd d8",
+	},
+	{
+		"led with primary target",
+		V2Packet{Flags: 0x1C, TargetID: v2TargetPrimary, DeviceID: v2DeviceIO, CommandID: v2CmdSetLEDs32, Seq: 2, Data: []byte{0, 0, 0, 0x07, 0xFF, 0, 0}},
+		"8d 1c 11 1a 1c 02 00 00 00 07 ff 00 00 94 d8",
+	},
+	{
+		"bolt matrix fill",
+		V2Packet{Flags: 0x1C, TargetID: v2TargetSecondary, DeviceID: v2DeviceIO, CommandID: v2CmdMatrixFillColor, Seq: 5, Data: []byte{0x00, 0xFF, 0x00}},
+		"8d 1c 12 1a 2f 05 00 ff 00 84 d8",
+	},
+	{
+		// ESC, EOP and SOP are escaped wherever they turn up; 0xAA is not
+		"escaped sequence number and data",
+		V2Packet{Flags: 0x0C, DeviceID: v2DeviceIO, CommandID: v2CmdSetLEDs16, Seq: v2SOP, Data: []byte{0x00, 0x0E, v2ESC, v2EOP, 0xAA}},
+		"8d 0c 1a 0e ab 05 00 0e ab 23 ab 50 aa 03 d8",
+	},
+	{
+		// the checksum comes out as SOP and has to be escaped too
+		"response with source and target",
+		V2Packet{Flags: 0x39, TargetID: 0x11, SourceID: 0x01, DeviceID: v2DevicePower, CommandID: v2CmdWake, Seq: 7},
+		"8d 39 11 01 13 0d 07 00 ab 05 d8",
+	},
+	{
+		"error response",
+		V2Packet{Flags: V2FlagIsResponse, DeviceID: v2DeviceIO, CommandID: v2CmdSetLEDs16, Seq: 3, ErrorCode: 5},
+		"8d 01 1a 0e 03 05 ce d8",
+	},
+}
+
+func TestV2Encode(t *testing.T) {
+	for _, tt := range v2Packets {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := tt.packet.Encode(), unhex(t, tt.frame); !bytes.Equal(got, want) {
+				t.Errorf("got % x, want % x", got, want)
+			}
+		})
+	}
+}
+
+func TestV2Decode(t *testing.T) {
+	for _, tt := range v2Packets {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeV2(unhex(t, tt.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.packet
+			if len(want.Data) == 0 {
+				want.Data = got.Data[:0]
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestV2DecodeMalformed(t *testing.T) {
+	frames := map[string]string{
+		"empty":               "",
+		"no eop":              "8d 0c 13 0d 00 d3",
+		"no sop":              "0c 13 0d 00 d3 d8",
+		"bad checksum":        "8d 0c 13 0d 00 d4 d8",
+		"trailing escape":     "8d 0c 13 0d 00 d3 ab d8",
+		"unescaped delimiter": "8d 0c 13 8d 0d 00 d3 d8",
+		"too short":           "8d 0c f3 d8",
+		"missing target":      "8d 1c 13 0d c3 d8",
+	}
+	for name, frame := range frames {
+		t.Run(name, func(t *testing.T) {
+			if p, err := DecodeV2(unhex(t, frame)); err == nil {
+				t.Errorf("decoded %+v", p)
+			}
+		})
+	}
+}
+
+// writeRecorder is a BLE connection that keeps every write
+type writeRecorder struct {
+	fakeConnector
+	writes [][]byte
+}
+
+func (w *writeRecorder) WriteCharacteristic(cUUID string, data []byte) error {
+	w.writes = append(w.writes, append([]byte(nil), data...))
+	return nil
+}
+
+func TestV2DriverSequenceAndTarget(t *testing.T) {
+	conn := &writeRecorder{}
+	d := NewSpheroBoltDriver(conn)
+	d.SetRGB(0xFF, 0, 0)
+	d.MatrixFill(Color{Green: 0xFF})
+	d.Wake()
+
+	want := []string{
+		"8d 1c 12 1a 1c 00 00 00 00 07 ff 00 00 95 d8",
+		"8d 1c 12 1a 2f 01 00 ff 00 88 d8",
+		"8d 1c 11 13 0d 02 b0 d8",
+	}
+	if len(conn.writes) != len(want) {
+		t.Fatalf("got %d writes, want %d", len(conn.writes), len(want))
+	}
+	for i, w := range want {
+		if got := conn.writes[i]; !bytes.Equal(got, unhex(t, w)) {
+			t.Errorf("write %d: got % x, want %s", i, got, w)
+		}
+	}
+
+	mini := NewSpheroMiniDriver(&writeRecorder{})
+	if err := mini.MatrixFill(Color{}); err == nil {
+		t.Error("the Mini has no matrix")
+	}
+}
+
+func TestV2HandleResponsesReassembles(t *testing.T) {
+	d := NewSpheroMiniDriver(&writeRecorder{})
+	got := make(chan V2Packet, 2)
+	d.On(V2Response, func(data interface{}) { got <- data.(V2Packet) })
+
+	frame := unhex(t, "8d 01 1a 0e 03 05 ce d8 8d 0a 13 0d 00 d5 d8")
+	d.HandleResponses(frame[:3], nil)
+	d.HandleResponses(frame[3:10], nil)
+	d.HandleResponses(frame[10:], nil)
+
+	// the eventer delivers on its own goroutine
+	for _, want := range []byte{v2CmdSetLEDs16, v2CmdWake} {
+		select {
+		case p := <-got:
+			if p.CommandID != want {
+				t.Errorf("got command %02x, want %02x", p.CommandID, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("packet never arrived")
+		}
+	}
+}
+
+// fakeConnector is a BLE connection that does nothing
+type fakeConnector struct{}
+
+func (fakeConnector) Connect() error                              { return nil }
+func (fakeConnector) Reconnect() error                            { return nil }
+func (fakeConnector) Disconnect() error                           { return nil }
+func (fakeConnector) Finalize() error                             { return nil }
+func (fakeConnector) Name() string                                { return "fake" }
+func (fakeConnector) SetName(string)                              {}
+func (fakeConnector) Address() string                             { return "fake" }
+func (fakeConnector) ReadCharacteristic(string) ([]byte, error)   { return nil, nil }
+func (fakeConnector) WriteCharacteristic(string, []byte) error    { return nil }
+func (fakeConnector) Subscribe(string, func([]byte, error)) error { return nil }
+func (fakeConnector) WithoutResponses(bool)                       {}
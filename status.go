@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Status is the state of a single pipeline
+type Status int
+
+const (
+	StatusUnknown Status = iota
+	StatusSuccess
+	StatusRunning
+	StatusDegraded
+	StatusFailure
+)
+
+var statusNames = map[Status]string{
+	StatusUnknown:  "unknown",
+	StatusSuccess:  "success",
+	StatusRunning:  "running",
+	StatusDegraded: "degraded",
+	StatusFailure:  "failure",
+}
+
+var statusColors = map[Status]Color{
+	StatusUnknown:  {},
+	StatusSuccess:  {Green: 255},
+	StatusRunning:  {Blue: 255},
+	StatusDegraded: {Red: 255, Green: 120},
+	StatusFailure:  {Red: 255},
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+// Color returns the color used to display s
+func (s Status) Color() Color { return statusColors[s] }
+
+// MarshalText implements encoding.TextMarshaler
+func (s Status) MarshalText() ([]byte, error) { return []byte(s.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (s *Status) UnmarshalText(text []byte) error {
+	for status, name := range statusNames {
+		if name == string(text) {
+			*s = status
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown status %q", text)
+}
+
+// PipelineStatus is the last known state of a pipeline
+type PipelineStatus struct {
+	Pipeline string    `json:"pipeline"`
+	Status   Status    `json:"status"`
+	Source   string    `json:"source"`
+	Updated  time.Time `json:"updated"`
+
+	// Since is when the pipeline entered its current status
+	Since time.Time `json:"since"`
+
+	// Pattern overrides the default pattern for Status when set
+	Pattern Pattern `json:"-"`
+
+	// Ack is set when someone took ownership of the current status. It is
+	// cleared when the status changes.
+	Ack *Acknowledgment `json:"ack,omitempty"`
+}
+
+// Acknowledgment records who took ownership of a pipeline's status. With
+// Until set it is a snooze: the pipeline is left out of the display until
+// then, and needs attention again afterwards.
+type Acknowledgment struct {
+	At    time.Time  `json:"at"`
+	By    string     `json:"by,omitempty"`
+	Note  string     `json:"note,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Acknowledged reports whether someone owns the current status
+func (ps PipelineStatus) Acknowledged() bool {
+	return ps.Ack != nil && ps.Ack.Until == nil
+}
+
+// Snoozed reports whether the pipeline is snoozed at now
+func (ps PipelineStatus) Snoozed(now time.Time) bool {
+	return ps.Ack != nil && ps.Ack.Until != nil && now.Before(*ps.Ack.Until)
+}
+
+// AttentionSince is when the pipeline last started needing attention:
+// when it entered its status or when its snooze ran out
+func (ps PipelineStatus) AttentionSince() time.Time {
+	if ps.Ack != nil && ps.Ack.Until != nil && ps.Ack.Until.After(ps.Since) {
+		return *ps.Ack.Until
+	}
+	return ps.Since
+}
+
+// acknowledgedBrightness dims acknowledged pipelines to a calmer steady
+// light
+const acknowledgedBrightness = 0.25
+
+// Transition is a pipeline changing from one status to another. From is
+// StatusUnknown for pipelines we hadn't heard about.
+type Transition struct {
+	Pipeline string
+	From, To Status
+}
+
+// StatusRegistry tracks the status of every pipeline we have heard about.
+// Statuses are ordered by severity, so the aggregate is the worst one.
+type StatusRegistry struct {
+	mu          sync.Mutex
+	pipelines   map[string]PipelineStatus
+	watchers    []chan struct{}
+	transitions []chan Transition
+}
+
+func NewStatusRegistry() *StatusRegistry {
+	return &StatusRegistry{
+		pipelines: make(map[string]PipelineStatus),
+	}
+}
+
+// Set records the status of a pipeline. source names the integration the
+// update came from.
+func (r *StatusRegistry) Set(pipeline string, status Status, source string) {
+	r.SetPattern(pipeline, status, nil, source)
+}
+
+// SetPattern is like Set but shows pattern instead of the status color
+// while this pipeline is the most severe one
+func (r *StatusRegistry) SetPattern(pipeline string, status Status, pattern Pattern, source string) {
+	r.mu.Lock()
+	prev, ok := r.pipelines[pipeline]
+	now := time.Now()
+	ps := PipelineStatus{
+		Pipeline: pipeline,
+		Status:   status,
+		Source:   source,
+		Updated:  now,
+		Since:    now,
+		Pattern:  pattern,
+	}
+	if ok && prev.Status == status {
+		ps.Since = prev.Since
+		ps.Ack = prev.Ack
+	}
+	r.pipelines[pipeline] = ps
+	r.mu.Unlock()
+
+	if ok && prev.Status == status && reflect.DeepEqual(prev.Pattern, pattern) {
+		return
+	}
+	log.Println("pipeline", pipeline, "is now", status, "via", source)
+	r.notify()
+	if !ok || prev.Status != status {
+		r.transition(Transition{Pipeline: pipeline, From: prev.Status, To: status})
+	}
+}
+
+// Acknowledge records ack for the pipeline's current status. ok is false
+// for unknown pipelines and ones that don't need attention. A snooze
+// wakes the display again when it runs out.
+func (r *StatusRegistry) Acknowledge(pipeline string, ack Acknowledgment) (ps PipelineStatus, ok bool) {
+	r.mu.Lock()
+	ps, ok = r.pipelines[pipeline]
+	if !ok || ps.Status < StatusDegraded {
+		r.mu.Unlock()
+		return ps, false
+	}
+	if ack.At.IsZero() {
+		ack.At = time.Now()
+	}
+	ps.Ack = &ack
+	r.pipelines[pipeline] = ps
+	r.mu.Unlock()
+
+	if ack.Until != nil {
+		log.Println("pipeline", pipeline, "snoozed until", ack.Until.Format(time.RFC3339), "by", ack.By)
+		time.AfterFunc(time.Until(*ack.Until), r.notify)
+	} else {
+		log.Println("pipeline", pipeline, "acknowledged while", ps.Status, "by", ack.By)
+	}
+	r.notify()
+	return ps, true
+}
+
+// AcknowledgeWorst acknowledges the most severe pipeline, if it needs
+// attention and isn't acknowledged yet
+func (r *StatusRegistry) AcknowledgeWorst(ack Acknowledgment) (PipelineStatus, bool) {
+	worst, ok := r.Worst()
+	if !ok || worst.Acknowledged() {
+		return worst, false
+	}
+	return r.Acknowledge(worst.Pipeline, ack)
+}
+
+// Unacknowledge clears the acknowledgment or snooze of a pipeline
+func (r *StatusRegistry) Unacknowledge(pipeline string) bool {
+	r.mu.Lock()
+	ps, ok := r.pipelines[pipeline]
+	if !ok || ps.Ack == nil {
+		r.mu.Unlock()
+		return false
+	}
+	ps.Ack = nil
+	r.pipelines[pipeline] = ps
+	r.mu.Unlock()
+
+	log.Println("pipeline", pipeline, "unacknowledged")
+	r.notify()
+	return true
+}
+
+// Remove forgets about a pipeline
+func (r *StatusRegistry) Remove(pipeline string) {
+	r.mu.Lock()
+	_, ok := r.pipelines[pipeline]
+	delete(r.pipelines, pipeline)
+	r.mu.Unlock()
+
+	if ok {
+		r.notify()
+	}
+}
+
+func (r *StatusRegistry) Get(pipeline string) (PipelineStatus, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ps, ok := r.pipelines[pipeline]
+	return ps, ok
+}
+
+// All returns every known pipeline sorted by name
+func (r *StatusRegistry) All() []PipelineStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]PipelineStatus, 0, len(r.pipelines))
+	for _, ps := range r.pipelines {
+		all = append(all, ps)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Pipeline < all[j].Pipeline })
+	return all
+}
+
+// Aggregate returns the most severe status across all pipelines
+func (r *StatusRegistry) Aggregate() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	agg := StatusUnknown
+	for _, ps := range r.pipelines {
+		if ps.Status > agg {
+			agg = ps.Status
+		}
+	}
+	return agg
+}
+
+// Color returns the color for the aggregate status
+func (r *StatusRegistry) Color() Color {
+	return r.Aggregate().Color()
+}
+
+// Worst returns the most severe pipeline, preferring the most recently
+// updated one on ties. Snoozed pipelines are skipped. ok is false when no
+// pipeline is left.
+func (r *StatusRegistry) Worst() (worst PipelineStatus, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for _, ps := range r.pipelines {
+		if ps.Snoozed(now) {
+			continue
+		}
+		if !ok || ps.Status > worst.Status || (ps.Status == worst.Status && ps.Updated.After(worst.Updated)) {
+			worst, ok = ps, true
+		}
+	}
+	return worst, ok
+}
+
+// Pattern shows the most severe pipeline, dimmed once acknowledged
+func (r *StatusRegistry) Pattern() (Pattern, bool) {
+	worst, _ := r.Worst()
+	if worst.Acknowledged() {
+		return Steady(worst.Status.Color().Scale(acknowledgedBrightness)), true
+	}
+	if worst.Pattern != nil {
+		return worst.Pattern, true
+	}
+	return Steady(worst.Status.Color()), true
+}
+
+// Changed returns a channel that fires after any pipeline changes status.
+// Each caller gets its own channel.
+func (r *StatusRegistry) Changed() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	r.watchers = append(r.watchers, ch)
+	return ch
+}
+
+func (r *StatusRegistry) notify() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ch := range r.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Transitions returns a channel of status changes. Each caller gets its
+// own channel; transitions are dropped while it is full.
+func (r *StatusRegistry) Transitions() <-chan Transition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ch := make(chan Transition, 16)
+	r.transitions = append(r.transitions, ch)
+	return ch
+}
+
+func (r *StatusRegistry) transition(t Transition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, ch := range r.transitions {
+		select {
+		case ch <- t:
+		default:
+		}
+	}
+}
+
+// ServeHTTP lists the known pipelines and the aggregate status
+func (r *StatusRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Aggregate Status           `json:"aggregate"`
+		Pipelines []PipelineStatus `json:"pipelines"`
+	}{
+		Aggregate: r.Aggregate(),
+		Pipelines: r.All(),
+	})
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// subscriberBuffer is how many notifications a subscriber may fall behind
+// before new ones are dropped
+const subscriberBuffer = 16
+
+// Subscription delivers a characteristic's notifications to one consumer.
+// Each has its own buffer and goroutine, so a slow consumer only misses
+// its own notifications.
+type Subscription struct {
+	adaptor *ClientAdaptor
+	key     string
+	// persistent subscriptions survive reconnects
+	persistent bool
+
+	ch      chan []byte
+	f       func([]byte)
+	dropped uint64
+	once    sync.Once
+}
+
+func (s *Subscription) deliver() {
+	for data := range s.ch {
+		s.f(data)
+	}
+}
+
+// Dropped returns how many notifications didn't fit the buffer
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivering notifications. Notifications on the
+// device stay enabled for the other subscribers.
+func (s *Subscription) Unsubscribe() {
+	s.adaptor.subMu.Lock()
+	defer s.adaptor.subMu.Unlock()
+	s.remove()
+}
+
+// remove is Unsubscribe for callers holding subMu
+func (s *Subscription) remove() {
+	subs := s.adaptor.subs[s.key]
+	for i, sub := range subs {
+		if sub == s {
+			s.adaptor.subs[s.key] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	s.once.Do(func() { close(s.ch) })
+}
+
+// Subscribe subscribes to notifications from the BLE device for the
+// requested service and characteristic. The subscription lasts for the
+// current connection, since gobot drivers subscribe again every time they
+// start.
+func (b *ClientAdaptor) Subscribe(cUUID string, f func([]byte, error)) (err error) {
+	sub := b.addSubscriber(cUUID, false, func(d []byte) { f(d, nil) })
+	if err := b.enableNotifications(cUUID); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	return nil
+}
+
+// Listen calls f with every notification on the characteristic until the
+// subscription is cancelled, subscribing again after every reconnect
+func (b *ClientAdaptor) Listen(cUUID string, f func([]byte)) *Subscription {
+	sub := b.addSubscriber(cUUID, true, f)
+	if b.connected {
+		if err := b.enableNotifications(cUUID); err != nil {
+			log.Println("error subscribing to", cUUID, err)
+		}
+	}
+	return sub
+}
+
+// listen is Listen for drivers that never cancel their subscription
+func (b *ClientAdaptor) listen(cUUID string, f func([]byte)) {
+	b.Listen(cUUID, f)
+}
+
+func (b *ClientAdaptor) addSubscriber(cUUID string, persistent bool, f func([]byte)) *Subscription {
+	sub := &Subscription{
+		adaptor:    b,
+		key:        convertUUID(cUUID),
+		persistent: persistent,
+		ch:         make(chan []byte, subscriberBuffer),
+		f:          f,
+	}
+	go sub.deliver()
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	b.subs[sub.key] = append(b.subs[sub.key], sub)
+	return sub
+}
+
+// enableNotifications turns on notifications for the characteristic once
+// per connection, fanning them out to every subscriber
+func (b *ClientAdaptor) enableNotifications(cUUID string) error {
+	key := convertUUID(cUUID)
+
+	b.subMu.Lock()
+	enabled := b.notifying[key]
+	b.subMu.Unlock()
+	if enabled {
+		return nil
+	}
+
+	err := b.gattOp("subscribe", cUUID, func(char bluetooth.DeviceCharacteristic) error {
+		return char.EnableNotifications(func(d []byte) {
+			b.fanOut(key, d)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	b.subMu.Lock()
+	b.notifying[key] = true
+	b.subMu.Unlock()
+	return nil
+}
+
+func (b *ClientAdaptor) fanOut(key string, d []byte) {
+	b.record(TraceNotify, key, d, nil)
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+
+	for _, sub := range b.subs[key] {
+		// the buffer may be reused for the next notification
+		data := append([]byte(nil), d...)
+		select {
+		case sub.ch <- data:
+		default:
+			if n := atomic.AddUint64(&sub.dropped, 1); n == 1 || n%100 == 0 {
+				log.Println("slow subscriber to", key, "dropped", n, "notifications")
+			}
+		}
+	}
+}
+
+// resubscribe enables notifications again for the subscriptions that
+// outlive a connection
+func (b *ClientAdaptor) resubscribe() {
+	b.subMu.Lock()
+	var keys []string
+	for key, subs := range b.subs {
+		if len(subs) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	b.subMu.Unlock()
+
+	for _, key := range keys {
+		if err := b.enableNotifications(key); err != nil {
+			log.Println("error subscribing again to", key, err)
+		}
+	}
+}
+
+// dropSubscriptions ends the subscriptions tied to the connection
+func (b *ClientAdaptor) dropSubscriptions() {
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+
+	b.notifying = make(map[string]bool)
+	for _, subs := range b.subs {
+		for _, sub := range append([]*Subscription(nil), subs...) {
+			if !sub.persistent {
+				sub.remove()
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// notifications collects what a subscriber was sent
+type notifications struct {
+	mu   sync.Mutex
+	got  []string
+	hold chan struct{}
+}
+
+func (n *notifications) f(d []byte) {
+	if n.hold != nil {
+		<-n.hold
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.got = append(n.got, string(d))
+}
+
+// listeningAdaptor takes subscriptions without enabling notifications on
+// a device
+func listeningAdaptor() *ClientAdaptor {
+	b := testAdaptor()
+	b.connected = false
+	return b
+}
+
+func (n *notifications) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.got)
+}
+
+func TestSubscriptionFanOut(t *testing.T) {
+	b := listeningAdaptor()
+	key := convertUUID("fff3")
+	var first, second, other notifications
+	b.Listen("fff3", first.f)
+	b.Listen("fff3", second.f)
+	b.Listen("fff4", other.f)
+
+	buf := []byte("a")
+	b.fanOut(key, buf)
+	// the adapter reuses its buffer for the next notification
+	buf[0] = 'b'
+	b.fanOut(key, buf)
+
+	for name, n := range map[string]*notifications{"first": &first, "second": &second} {
+		waitFor(t, name+" subscriber", func() bool { return n.count() == 2 })
+		n.mu.Lock()
+		if n.got[0] != "a" || n.got[1] != "b" {
+			t.Errorf("%s got %q", name, n.got)
+		}
+		n.mu.Unlock()
+	}
+	if other.count() != 0 {
+		t.Errorf("another characteristic's subscriber got %q", other.got)
+	}
+}
+
+func TestSlowSubscriberOnlyMissesItsOwn(t *testing.T) {
+	b := listeningAdaptor()
+	key := convertUUID("fff3")
+	slow := notifications{hold: make(chan struct{})}
+	var fast notifications
+	slowSub := b.Listen("fff3", slow.f)
+	fastSub := b.Listen("fff3", fast.f)
+
+	// the slow subscriber takes one and buffers a few more, while the fast
+	// one keeps up
+	sent := 0
+	for round := 0; round < 4; round++ {
+		for i := 0; i < subscriberBuffer/2; i++ {
+			b.fanOut(key, []byte{byte(sent)})
+			sent++
+		}
+		waitFor(t, "the fast subscriber", func() bool { return fast.count() == sent })
+	}
+	close(slow.hold)
+
+	if fastSub.Dropped() != 0 {
+		t.Errorf("fast subscriber dropped %d", fastSub.Dropped())
+	}
+	dropped := slowSub.Dropped()
+	if dropped == 0 {
+		t.Fatal("slow subscriber dropped nothing")
+	}
+	waitFor(t, "the slow subscriber", func() bool { return slow.count() == sent-int(dropped) })
+}
+
+func TestSubscriptionsEnd(t *testing.T) {
+	b := listeningAdaptor()
+	key := convertUUID("fff3")
+	var kept, cancelled, connection notifications
+	b.Listen("fff3", kept.f)
+	b.Listen("fff3", cancelled.f).Unsubscribe()
+	b.addSubscriber("fff3", false, connection.f)
+
+	// a reconnect only keeps the subscriptions made with Listen
+	b.dropSubscriptions()
+	b.fanOut(key, []byte("a"))
+	waitFor(t, "the listener", func() bool { return kept.count() == 1 })
+
+	b.subMu.Lock()
+	subs := len(b.subs[key])
+	b.subMu.Unlock()
+	if subs != 1 {
+		t.Errorf("%d subscriptions left, want 1", subs)
+	}
+	if n := cancelled.count() + connection.count(); n != 0 {
+		t.Errorf("ended subscriptions got %d notifications", n)
+	}
+}
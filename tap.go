@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gobot.io/x/gobot/platforms/sphero"
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+// collisionDriver is a robot that can report bumps
+type collisionDriver interface {
+	ConfigureCollisionDetection(cc sphero.CollisionConfig)
+	On(name string, f func(s interface{})) error
+}
+
+// TapConfig tunes tap detection. Threshold is the collision threshold on
+// both axes; lower is more sensitive. Taps within Debounce of the last
+// one are ignored.
+type TapConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Threshold uint8    `json:"threshold"`
+	Debounce  Duration `json:"debounce"`
+}
+
+func DefaultTapConfig() TapConfig {
+	return TapConfig{
+		Enabled:   true,
+		Threshold: 0x40,
+		Debounce:  Duration(2 * time.Second),
+	}
+}
+
+// TapDetector acknowledges the most severe pipeline when someone taps
+// the robot
+type TapDetector struct {
+	cfg      TapConfig
+	registry *StatusRegistry
+	history  *History
+	moving   func() bool
+
+	mu       sync.Mutex
+	attached map[collisionDriver]bool
+	last     time.Time
+}
+
+// NewTapDetector creates a tap detector. Bumps while moving returns true
+// are the robot's own doing and are ignored.
+func NewTapDetector(cfg TapConfig, registry *StatusRegistry, history *History, moving func() bool) *TapDetector {
+	return &TapDetector{
+		cfg:      cfg,
+		registry: registry,
+		history:  history,
+		moving:   moving,
+		attached: make(map[collisionDriver]bool),
+	}
+}
+
+// Connected configures collision detection on a freshly connected robot
+func (t *TapDetector) Connected(driver lightDriver) {
+	robot, ok := driver.(collisionDriver)
+	if !ok || !t.cfg.Enabled {
+		return
+	}
+
+	robot.ConfigureCollisionDetection(sphero.CollisionConfig{
+		Method: 0x01,
+		Xt:     t.cfg.Threshold,
+		Yt:     t.cfg.Threshold,
+		Xs:     0x40,
+		Ys:     0x40,
+		Dead:   0x32,
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.attached[robot] {
+		t.attached[robot] = true
+		robot.On(ollie.Collision, func(interface{}) { t.tap() })
+	}
+}
+
+func (t *TapDetector) tap() {
+	if t.moving() {
+		return
+	}
+
+	t.mu.Lock()
+	if time.Since(t.last) < time.Duration(t.cfg.Debounce) {
+		t.mu.Unlock()
+		return
+	}
+	t.last = time.Now()
+	t.mu.Unlock()
+
+	ps, ok := t.registry.AcknowledgeWorst(Acknowledgment{By: "tap"})
+	if !ok {
+		log.Println("tap with nothing to acknowledge")
+		return
+	}
+	t.history.Record("acknowledged", ps.Pipeline, "tap")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"gobot.io/x/gobot"
+	"gobot.io/x/gobot/platforms/sphero"
+	"gobot.io/x/gobot/platforms/sphero/ollie"
+)
+
+func TestTapDetector(t *testing.T) {
+	tests := []struct {
+		name      string
+		moving    bool
+		sinceLast time.Duration
+		ack       bool
+	}{
+		{"first tap", false, time.Hour, true},
+		{"bounce", false, time.Second, false},
+		{"after debounce", false, 3 * time.Second, true},
+		{"own motion", true, time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewStatusRegistry()
+			registry.Set("build", StatusFailure, "ci")
+			history := NewHistory(10)
+			d := NewTapDetector(DefaultTapConfig(), registry, history, func() bool { return tt.moving })
+			d.last = time.Now().Add(-tt.sinceLast)
+
+			d.tap()
+
+			ps, _ := registry.Get("build")
+			if ps.Acknowledged() != tt.ack {
+				t.Errorf("acknowledged %v, want %v", ps.Acknowledged(), tt.ack)
+			}
+			events := history.Events()
+			if tt.ack && (len(events) != 1 || events[0].Kind != "acknowledged" || events[0].Pipeline != "build" || events[0].Detail != "tap") {
+				t.Errorf("history %+v, want the tap acknowledgment", events)
+			}
+			if !tt.ack && len(events) != 0 {
+				t.Errorf("history %+v, want nothing", events)
+			}
+		})
+	}
+}
+
+func TestTapDetectorAcknowledgesWorstOnce(t *testing.T) {
+	registry := NewStatusRegistry()
+	registry.Set("build", StatusFailure, "ci")
+	history := NewHistory(10)
+	d := NewTapDetector(TapConfig{Enabled: true}, registry, history, func() bool { return false })
+
+	// more taps don't acknowledge it again
+	for i := 0; i < 3; i++ {
+		d.tap()
+	}
+	if ps, _ := registry.Get("build"); !ps.Acknowledged() {
+		t.Error("build wasn't acknowledged")
+	}
+	if n := len(history.Events()); n != 1 {
+		t.Errorf("recorded %d acknowledgments, want 1", n)
+	}
+}
+
+// bumpyDriver is a robot that records its collision configuration and
+// lets the test bump it
+type bumpyDriver struct {
+	name string
+
+	mu         sync.Mutex
+	configured bool
+	collision  func(interface{})
+}
+
+func (d *bumpyDriver) Name() string                 { return d.name }
+func (d *bumpyDriver) SetName(name string)          { d.name = name }
+func (d *bumpyDriver) Start() error                 { return nil }
+func (d *bumpyDriver) Halt() error                  { return nil }
+func (d *bumpyDriver) Connection() gobot.Connection { return nil }
+func (d *bumpyDriver) SetRGB(r, g, b uint8) error   { return nil }
+
+func (d *bumpyDriver) ConfigureCollisionDetection(cc sphero.CollisionConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.configured = true
+}
+
+func (d *bumpyDriver) On(name string, f func(s interface{})) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if name == ollie.Collision {
+		d.collision = f
+	}
+	return nil
+}
+
+func (d *bumpyDriver) bump() bool {
+	d.mu.Lock()
+	f := d.collision
+	d.mu.Unlock()
+	if f == nil {
+		return false
+	}
+	f(sphero.CollisionPacket{})
+	return true
+}
+
+// idleConnection is a gobot connection with nothing behind it
+type idleConnection struct{ name string }
+
+func (c *idleConnection) Name() string        { return c.name }
+func (c *idleConnection) SetName(name string) { c.name = name }
+func (c *idleConnection) Connect() error      { return nil }
+func (c *idleConnection) Finalize() error     { return nil }
+
+func TestTapDuringLiveConnection(t *testing.T) {
+	registry := NewStatusRegistry()
+	registry.Set("build", StatusFailure, "ci")
+	history := NewHistory(10)
+
+	driver := &bumpyDriver{name: "robot"}
+	adp := newGobotAdapter("test", &idleConnection{name: "ble"}, driver)
+	adp.queue = NewCommandQueue(QueueConfig{Interval: Duration(time.Millisecond)})
+	adp.OnConnect(NewTapDetector(DefaultTapConfig(), registry, history, func() bool { return false }).Connected)
+
+	power, err := NewPowerPolicy(PowerConfig{
+		Refresh: Duration(time.Hour),
+		Linger:  Duration(500 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewBgConn(adp, adp.queue, power)
+	done := make(chan struct{})
+	go func() {
+		c.liveLoop(Color{})
+		close(done)
+	}()
+
+	// gobot's Start hasn't returned, but the robot is configured and
+	// listening for taps
+	waitFor(t, "collision detection", func() bool { return driver.bump() })
+	if ps, _ := registry.Get("build"); !ps.Acknowledged() {
+		t.Error("tap didn't acknowledge the failure")
+	}
+	driver.mu.Lock()
+	configured := driver.configured
+	driver.mu.Unlock()
+	if !configured {
+		t.Error("collision detection wasn't configured")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the light never let go")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TraceConfig records a device's BLE traffic to Path. Format is "jsonl",
+// the default, or "btsnoop" for Wireshark.
+type TraceConfig struct {
+	Path   string `json:"path,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// HexBytes is a byte slice written as hex in JSON
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	buf, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = buf
+	return nil
+}
+
+// Trace operations
+const (
+	TraceWrite  = "write"
+	TraceRead   = "read"
+	TraceNotify = "notify"
+)
+
+// TraceRecord is one characteristic write, read or notification.
+// WithoutResponse marks a write sent as a write command.
+type TraceRecord struct {
+	Time            time.Time `json:"time"`
+	Op              string    `json:"op"`
+	Characteristic  string    `json:"characteristic"`
+	Data            HexBytes  `json:"data"`
+	WithoutResponse bool      `json:"withoutResponse,omitempty"`
+	Err             string    `json:"err,omitempty"`
+}
+
+// TraceRecorder stores BLE traffic
+type TraceRecorder interface {
+	Record(rec TraceRecord)
+	Close() error
+}
+
+// OpenTrace creates the trace file for cfg
+func OpenTrace(cfg TraceConfig) (TraceRecorder, error) {
+	f, err := os.Create(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Format {
+	case "", "jsonl":
+		return &jsonlTrace{f: f, enc: json.NewEncoder(f)}, nil
+	case "btsnoop":
+		return newBtsnoopTrace(f)
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown trace format %q", cfg.Format)
+	}
+}
+
+// Record makes the adaptor log its traffic to rec
+func (b *ClientAdaptor) Record(rec TraceRecorder) {
+	b.trace = rec
+}
+
+// Trace records the adaptor's traffic as configured, if at all
+func (b *ClientAdaptor) Trace(cfg TraceConfig) error {
+	if cfg.Path == "" {
+		return nil
+	}
+	rec, err := OpenTrace(cfg)
+	if err != nil {
+		return errors.Wrap(err, "can't open trace")
+	}
+	log.Println("recording ble traffic to", cfg.Path)
+	b.Record(rec)
+	return nil
+}
+
+// record logs an operation when tracing is on. Operations refused for
+// lack of a connection never reached the device and are left out.
+func (b *ClientAdaptor) record(op, cUUID string, data []byte, err error) {
+	if b.trace == nil || errors.Is(err, ErrNotConnected) {
+		return
+	}
+	rec := TraceRecord{
+		Time:           time.Now(),
+		Op:             op,
+		Characteristic: convertUUID(cUUID),
+		Data:           append(HexBytes(nil), data...),
+	}
+	if op == TraceWrite {
+		rec.WithoutResponse = b.withoutResponses
+	}
+	if err != nil {
+		rec.Err = err.Error()
+	}
+	b.trace.Record(rec)
+}
+
+// jsonlTrace writes one JSON record per line
+type jsonlTrace struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func (t *jsonlTrace) Record(rec TraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(rec)
+}
+
+func (t *jsonlTrace) Close() error {
+	return t.f.Close()
+}
+
+// LoadTrace reads a JSONL trace
+func LoadTrace(r io.Reader) ([]TraceRecord, error) {
+	var recs []TraceRecord
+	dec := json.NewDecoder(r)
+	for {
+		var rec TraceRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+// btsnoop files hold HCI packets, so every record is framed as an ATT PDU
+// in an L2CAP packet in an ACL packet. The tinygo adapter doesn't expose
+// attribute handles, so each characteristic gets a made up handle in the
+// order they first show up; the JSONL trace keeps the UUIDs.
+const (
+	btsnoopUART     = 1002
+	btsnoopEpoch    = 0x00dcddb30f2f8000 // microseconds from year 0 to 1970
+	btsnoopReceived = 1
+
+	attReadResponse = 0x0b
+	attWriteRequest = 0x12
+	attWriteCommand = 0x52
+	attNotification = 0x1b
+)
+
+type btsnoopTrace struct {
+	mu      sync.Mutex
+	f       *os.File
+	handles map[string]uint16
+}
+
+func newBtsnoopTrace(f *os.File) (*btsnoopTrace, error) {
+	header := make([]byte, 16)
+	copy(header, "btsnoop\x00")
+	binary.BigEndian.PutUint32(header[8:], 1)
+	binary.BigEndian.PutUint32(header[12:], btsnoopUART)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &btsnoopTrace{f: f, handles: make(map[string]uint16)}, nil
+}
+
+func (t *btsnoopTrace) Record(rec TraceRecord) {
+	if rec.Err != "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	handle, ok := t.handles[rec.Characteristic]
+	if !ok {
+		handle = uint16(0x10 + len(t.handles))
+		t.handles[rec.Characteristic] = handle
+	}
+
+	var att []byte
+	var flags uint32
+	switch rec.Op {
+	case TraceWrite:
+		opcode := byte(attWriteRequest)
+		if rec.WithoutResponse {
+			opcode = attWriteCommand
+		}
+		att = []byte{opcode, byte(handle), byte(handle >> 8)}
+	case TraceNotify:
+		att = []byte{attNotification, byte(handle), byte(handle >> 8)}
+		flags = btsnoopReceived
+	case TraceRead:
+		att = []byte{attReadResponse}
+		flags = btsnoopReceived
+	}
+	att = append(att, rec.Data...)
+
+	// H4 ACL packet on connection handle 1, then L2CAP on the ATT channel
+	pkt := []byte{0x02, 0x01, 0x20, 0, 0, 0, 0, 0x04, 0x00}
+	binary.LittleEndian.PutUint16(pkt[3:], uint16(len(att)+4))
+	binary.LittleEndian.PutUint16(pkt[5:], uint16(len(att)))
+	pkt = append(pkt, att...)
+
+	hdr := make([]byte, 24)
+	binary.BigEndian.PutUint32(hdr[0:], uint32(len(pkt)))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(len(pkt)))
+	binary.BigEndian.PutUint32(hdr[8:], flags)
+	binary.BigEndian.PutUint64(hdr[16:], uint64(rec.Time.UnixMicro()+btsnoopEpoch))
+	t.f.Write(append(hdr, pkt...))
+}
+
+func (t *btsnoopTrace) Close() error {
+	return t.f.Close()
+}
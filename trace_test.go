@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBtsnoopWriteOpcodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.btsnoop")
+	rec, err := OpenTrace(TraceConfig{Path: path, Format: "btsnoop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	char := convertUUID(ollieCommandsCharacteristic)
+	rec.Record(TraceRecord{Time: time.Now(), Op: TraceWrite, Characteristic: char, Data: HexBytes{0x01}})
+	rec.Record(TraceRecord{Time: time.Now(), Op: TraceWrite, Characteristic: char, Data: HexBytes{0x02}, WithoutResponse: true})
+	rec.Close()
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 16 byte file header, then records of a 24 byte header, 9 bytes of
+	// H4, ACL and L2CAP framing and the ATT PDU
+	const header, framing, pdu = 16, 24 + 9, 4
+	if len(buf) != header+2*(framing+pdu) {
+		t.Fatalf("got %d bytes", len(buf))
+	}
+	for i, want := range []byte{attWriteRequest, attWriteCommand} {
+		if got := buf[header+i*(framing+pdu)+framing]; got != want {
+			t.Errorf("write %d: ATT opcode %#x, want %#x", i, got, want)
+		}
+	}
+}